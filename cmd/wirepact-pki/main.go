@@ -0,0 +1,129 @@
+// Command wirepact-pki runs the reference PKI server (see package pki/server)
+// standalone, e.g. for integration tests or deployments without Kubernetes.
+//
+// Usage:
+//
+//	wirepact-pki -ca-cert ca.crt -ca-key ca.key [-listen :8080] [-validity 168h] [-common-names 'translator-*'] [-uris 'spiffe://example.org/translator/{cn}'] [-crl]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/list"
+	"github.com/WirePact/go-translator/pki/server"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	flags := flag.NewFlagSet("wirepact-pki", flag.ExitOnError)
+	listen := flags.String("listen", ":8080", "address to listen on")
+	caCert := flags.String("ca-cert", "ca.crt", "PEM file of the CA certificate (generated with -ca-key if both files do not exist)")
+	caKey := flags.String("ca-key", "ca.key", "PEM file of the CA private key")
+	caName := flags.String("ca-name", "WirePact PKI CA", "common name of a generated CA")
+	caValidity := flags.Duration("ca-validity", 10*365*24*time.Hour, "validity of a generated CA")
+	validity := flags.Duration("validity", 0, "validity of the issued certificates (if omitted, 168h are used)")
+	commonNames := flags.String("common-names", "", "comma separated list of allowed common name patterns (e.g. 'translator-*')")
+	dnsNames := flags.String("dns-names", "", "comma separated list of allowed dns name patterns, {cn} is replaced with the common name (if omitted, only the common name is allowed)")
+	uris := flags.String("uris", "", "comma separated list of allowed uri patterns, {cn} is replaced with the common name (e.g. 'spiffe://example.org/translator/{cn}')")
+	ipNetworks := flags.String("ip-networks", "", "comma separated list of networks of the allowed ip addresses (e.g. '10.0.0.0/8')")
+	bootstrapTokenFile := flags.String("bootstrap-token-file", "", "file with the accepted bootstrap tokens (one per line)")
+	crl := flags.Bool("crl", false, "serve the CRL on /crl")
+	revoked := flags.String("revoked", "", "comma separated list of revoked serial numbers (decimal or 0x hex) for the CRL")
+	tlsCert := flags.String("tls-cert", "", "PEM file of the TLS server certificate (if omitted, plain http is served)")
+	tlsKey := flags.String("tls-key", "", "PEM file of the TLS server private key")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wirepact-pki [flags]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+
+	if flags.NArg() != 0 || (*tlsCert == "") != (*tlsKey == "") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config := &server.Config{
+		Validity:           *validity,
+		AllowedCommonNames: list.Split(*commonNames),
+		AllowedDNSNames:    list.Split(*dnsNames),
+		AllowedURIs:        list.Split(*uris),
+		ServeCRL:           *crl,
+	}
+
+	for _, network := range list.Split(*ipNetworks) {
+		_, ipNetwork, err := net.ParseCIDR(network)
+		if err != nil {
+			logrus.WithError(err).Fatalf("Invalid ip network %q.", network)
+		}
+		config.AllowedIPNetworks = append(config.AllowedIPNetworks, ipNetwork)
+	}
+
+	var err error
+	config.CA, config.CAKey, err = server.LoadOrCreateCA(*caCert, *caKey, *caName, *caValidity)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not load the CA.")
+	}
+
+	if *bootstrapTokenFile != "" {
+		config.BootstrapTokens, err = readBootstrapTokens(*bootstrapTokenFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not read the bootstrap tokens.")
+		}
+	}
+
+	pkiServer, err := server.New(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not create the PKI server.")
+	}
+
+	for _, serial := range list.Split(*revoked) {
+		serialNumber, ok := new(big.Int).SetString(serial, 0)
+		if !ok {
+			logrus.Fatalf("Invalid revoked serial number %q.", serial)
+		}
+		pkiServer.Revoke(serialNumber)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"listen": *listen,
+		"ca":     config.CA.Subject,
+		"tls":    *tlsCert != "",
+		"crl":    config.ServeCRL,
+	}).Info("Start PKI server.")
+
+	httpServer := &http.Server{
+		Addr:              *listen,
+		Handler:           pkiServer,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if *tlsCert != "" {
+		err = httpServer.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	logrus.WithError(err).Fatal("PKI server stopped.")
+}
+
+// readBootstrapTokens reads the tokens of the file (one per line).
+func readBootstrapTokens(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []string
+	for _, token := range strings.Split(string(data), "\n") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
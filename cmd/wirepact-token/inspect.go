@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/list"
+	"github.com/WirePact/go-translator/pki"
+	"github.com/WirePact/go-translator/wirepact"
+)
+
+var errVerificationFailed = errors.New("token verification failed")
+
+func inspect(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	caPath := flags.String("ca", "", "CA certificate file (or directory) the token is verified against")
+	audience := flags.String("audience", "", "expected audience (if omitted, the legacy audience is expected)")
+	issuers := flags.String("issuers", "", "comma separated list of allowed issuers (if omitted, the issuer must match the signer certificate)")
+	leeway := flags.Duration("leeway", 0, "allowed clock skew (if omitted, 60s are used)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wirepact-token inspect -ca ca.crt [flags] <token|->")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	token, err := readToken(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	headers, payload, err := decodeToken(token)
+	if err != nil {
+		return err
+	}
+
+	// The certificates are printed separately.
+	printJSON(out, "Headers", withoutKey(headers, "x5c"))
+	printJSON(out, "Claims", payload)
+	printTimes(out, payload)
+	printCertificateChain(out, headers["x5c"])
+
+	if *caPath == "" {
+		fmt.Fprintln(out, "Verification: skipped (no CA given)")
+		return nil
+	}
+
+	trustBundle := pki.NewTrustBundle(pki.FileTrustSource(*caPath))
+	err = trustBundle.Reload()
+	if err != nil {
+		return err
+	}
+
+	config := &wirepact.JWTConfig{
+		Audience:       *audience,
+		ClockLeeway:    *leeway,
+		TrustBundle:    trustBundle,
+		AllowedIssuers: list.Split(*issuers),
+	}
+
+	identity, err := wirepact.GetJWTIdentity(config, token)
+	if err != nil {
+		fmt.Fprintf(out, "Verification: FAILED (%v)\n", err)
+		return errVerificationFailed
+	}
+
+	fmt.Fprintf(out, "Verification: OK (subject %q)\n", identity.Subject)
+	return nil
+}
+
+// decodeToken decodes the header and the payload of the compact
+// serialized JWT without verifying it.
+func decodeToken(token string) (map[string]interface{}, map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("token has %v parts, expected 3", len(parts))
+	}
+
+	headers := map[string]interface{}{}
+	err := decodeSegment(parts[0], &headers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not decode headers: %w", err)
+	}
+
+	payload := map[string]interface{}{}
+	err = decodeSegment(parts[1], &payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not decode claims: %w", err)
+	}
+
+	return headers, payload, nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+func printJSON(out io.Writer, title string, value map[string]interface{}) {
+	data, _ := json.MarshalIndent(value, "", "  ")
+	fmt.Fprintf(out, "%v:\n%v\n\n", title, string(data))
+}
+
+func printTimes(out io.Writer, claims map[string]interface{}) {
+	fmt.Fprintln(out, "Times:")
+	for _, claim := range []string{"iat", "nbf", "exp"} {
+		if seconds, ok := claims[claim].(float64); ok {
+			fmt.Fprintf(out, "  %v: %v\n", claim, time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339))
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+func printCertificateChain(out io.Writer, x5c interface{}) {
+	chain, _ := x5c.([]interface{})
+	fmt.Fprintf(out, "Certificate chain (%v):\n", len(chain))
+
+	for index, entry := range chain {
+		encoded, _ := entry.(string)
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			fmt.Fprintf(out, "  [%v] invalid base64: %v\n", index, err)
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			fmt.Fprintf(out, "  [%v] invalid certificate: %v\n", index, err)
+			continue
+		}
+
+		fingerprint := sha256.Sum256(certificate.Raw)
+		fmt.Fprintf(out, "  [%v] subject:     %v\n", index, certificate.Subject)
+		fmt.Fprintf(out, "      issuer:      %v\n", certificate.Issuer)
+		fmt.Fprintf(out, "      serial:      %v\n", certificate.SerialNumber)
+		fmt.Fprintf(out, "      valid:       %v - %v\n",
+			certificate.NotBefore.UTC().Format(time.RFC3339),
+			certificate.NotAfter.UTC().Format(time.RFC3339))
+		fmt.Fprintf(out, "      sha256:      %v\n", base64.StdEncoding.EncodeToString(fingerprint[:]))
+	}
+	fmt.Fprintln(out)
+}
+
+func withoutKey(value map[string]interface{}, key string) map[string]interface{} {
+	result := make(map[string]interface{}, len(value))
+	for k, v := range value {
+		if k != key {
+			result[k] = v
+		}
+	}
+	return result
+}
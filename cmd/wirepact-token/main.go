@@ -0,0 +1,68 @@
+// Command wirepact-token inspects, verifies and mints WirePact JWTs offline.
+//
+// Usage:
+//
+//	wirepact-token inspect -ca ca.crt [-audience name] [-issuers a,b] <token|->
+//	wirepact-token mint -dir ./certs -sub user [-audience name] [-lifetime 1h] [-claim key=value]
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: wirepact-token <command> [flags]
+
+Commands:
+  inspect  Decode a WirePact JWT and verify it against a CA file.
+  mint     Sign a test WirePact JWT with local key material.
+
+Run "wirepact-token <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "inspect":
+		err = inspect(os.Args[2:], os.Stdout)
+	case "mint":
+		err = mint(os.Args[2:], os.Stdout)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n%v", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if errors.Is(err, errVerificationFailed) {
+		// The reason was already printed by the command.
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// readToken returns the token of the argument or reads it from stdin if the argument is "-".
+func readToken(argument string) (string, error) {
+	if argument != "-" {
+		return strings.TrimSpace(argument), nil
+	}
+
+	token, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
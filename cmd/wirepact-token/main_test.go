@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"github.com/WirePact/go-translator/pki"
+)
+
+// newCertDir enrolls key material at the PKI and returns the directory
+// with the files of the key material (ca.crt, cert.crt and cert.key).
+func newCertDir(t *testing.T) string {
+	t.Helper()
+
+	testPKI := pkitest.NewPKI(t, nil)
+	dir := t.TempDir()
+	err := pki.NewKeyMaterialProvider(&pki.Config{
+		BaseAddress:           testPKI.URL,
+		CAPath:                pkitest.CAPath,
+		CSRPath:               pkitest.CSRPath,
+		CRLPath:               pkitest.CRLPath,
+		RequestRetries:        -1,
+		LocalCertPath:         dir,
+		CertificateCommonName: "translator",
+		KeyType:               pki.KeyTypeECDSAP256,
+	}).Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func mintToken(t *testing.T, args ...string) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	err := mint(args, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func TestMintAndInspect(t *testing.T) {
+	dir := newCertDir(t)
+	token := mintToken(t, "-dir", dir, "-sub", "alice", "-audience", "service", "-roles", "admin,user", "-claim", "level=3")
+
+	var out bytes.Buffer
+	err := inspect([]string{"-ca", filepath.Join(dir, "ca.crt"), "-audience", "service", token}, &out)
+	if err != nil {
+		t.Fatalf("%v\n%v", err, out.String())
+	}
+
+	for _, expected := range []string{
+		`"sub": "alice"`,
+		`"iss": "translator"`,
+		"\"aud\": [\n    \"service\"\n  ]",
+		`"level": 3`,
+		"subject:     CN=translator,",
+		`Verification: OK (subject "alice")`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("output does not contain %q:\n%v", expected, out.String())
+		}
+	}
+
+	// Another audience is rejected.
+	out.Reset()
+	err = inspect([]string{"-ca", filepath.Join(dir, "ca.crt"), "-audience", "other", token}, &out)
+	if !errors.Is(err, errVerificationFailed) {
+		t.Fatalf("token of another audience was verified: %v", err)
+	}
+}
+
+func TestInspectTamperedToken(t *testing.T) {
+	dir := newCertDir(t)
+	parts := strings.Split(mintToken(t, "-dir", dir, "-sub", "alice"), ".")
+
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString(bytes.Replace(claims, []byte(`"alice"`), []byte(`"mallory"`), 1))
+
+	var out bytes.Buffer
+	err = inspect([]string{"-ca", filepath.Join(dir, "ca.crt"), strings.Join(parts, ".")}, &out)
+	if !errors.Is(err, errVerificationFailed) {
+		t.Fatalf("tampered token was verified: %v\n%v", err, out.String())
+	}
+
+	// The decoded claims are printed, followed by the reason of the failed verification.
+	output := out.String()
+	if !strings.Contains(output, `"sub": "mallory"`) {
+		t.Fatalf("output does not contain the tampered claims:\n%v", output)
+	}
+	if !strings.Contains(output, "Verification: FAILED (") || strings.Contains(output, "Verification: OK") {
+		t.Fatalf("output does not contain the failed verification:\n%v", output)
+	}
+
+	// Tokens that can not be decoded are returned as error.
+	out.Reset()
+	err = inspect([]string{"not-a-token"}, &out)
+	if err == nil || errors.Is(err, errVerificationFailed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
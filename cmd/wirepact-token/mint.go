@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/WirePact/go-translator/internal/list"
+	"github.com/WirePact/go-translator/pki"
+	"github.com/WirePact/go-translator/wirepact"
+)
+
+// claimFlags collects repeated "-claim key=value" flags.
+type claimFlags map[string]interface{}
+
+func (claims claimFlags) String() string {
+	return fmt.Sprint(map[string]interface{}(claims))
+}
+
+// Set parses the value as JSON. If this fails, the value is used as string.
+func (claims claimFlags) Set(definition string) error {
+	parts := strings.SplitN(definition, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("claim %q is not in the form key=value", definition)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+		value = parts[1]
+	}
+	claims[parts[0]] = value
+
+	return nil
+}
+
+func mint(args []string, out io.Writer) error {
+	claims := claimFlags{}
+
+	flags := flag.NewFlagSet("mint", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory with the key material (ca.crt, cert.crt and cert.key), see pki.Config.LocalCertPath")
+	keyType := flags.String("key-type", "", "type of the private key (only needed to distinguish rsa from rsa-pss)")
+	subject := flags.String("sub", "", "subject (user ID) of the token")
+	issuer := flags.String("issuer", "", "issuer of the token (if omitted, the common name of the certificate is used)")
+	audience := flags.String("audience", "", "audience of the token (if omitted, the legacy audience is used)")
+	lifetime := flags.Duration("lifetime", 0, "lifetime of the token (if omitted, 60s are used)")
+	roles := flags.String("roles", "", "comma separated list of roles")
+	tenant := flags.String("tenant", "", "tenant of the user")
+	email := flags.String("email", "", "email address of the user")
+	name := flags.String("name", "", "display name of the user")
+	flags.Var(claims, "claim", "additional claim in the form key=value (repeatable, JSON values are decoded)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wirepact-token mint -dir ./certs -sub user [flags]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if *subject == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	keyMaterial := pki.NewKeyMaterialProvider(&pki.Config{
+		LocalCertPath: *dir,
+		KeyType:       pki.KeyType(*keyType),
+	})
+	err := keyMaterial.Load()
+	if err != nil {
+		return err
+	}
+
+	if *issuer == "" {
+		*issuer = keyMaterial.KeyMaterial().Certificate.Subject.CommonName
+	}
+
+	identity := &wirepact.Identity{
+		Subject: *subject,
+		Roles:   list.Split(*roles),
+		Tenant:  *tenant,
+		Email:   *email,
+		Name:    *name,
+	}
+	if len(claims) > 0 {
+		identity.Claims = claims
+	}
+
+	token, err := wirepact.CreateSignedJWT(
+		&wirepact.JWTConfig{Issuer: *issuer, Lifetime: *lifetime, KeyMaterialProvider: keyMaterial},
+		identity,
+		&wirepact.TokenOptions{Audience: *audience})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, token)
+	return nil
+}
@@ -2,9 +2,13 @@ package go_translator
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"time"
 
+	"github.com/WirePact/go-translator/internal/list"
 	"github.com/WirePact/go-translator/pki"
 	"github.com/WirePact/go-translator/translator"
 	"github.com/WirePact/go-translator/wirepact"
@@ -16,10 +20,59 @@ const (
 	TranslatorEnvIngressPort     = "INGRESS_PORT"
 	TranslatorEnvEgressPort      = "EGRESS_PORT"
 	TranslatorEnvCommonName      = "COMMON_NAME"
+	TranslatorEnvKeyType         = "KEY_TYPE"
+	TranslatorEnvTrustBundlePath = "TRUST_BUNDLE_PATH"
+	TranslatorEnvCrlPath         = "CRL_PATH"
+	TranslatorEnvCrlFailOpen     = "CRL_FAIL_OPEN"
+
+	TranslatorEnvPkiTLSCAPath          = "PKI_TLS_CA_PATH"
+	TranslatorEnvPkiTLSCertPath        = "PKI_TLS_CERT_PATH"
+	TranslatorEnvPkiTLSKeyPath         = "PKI_TLS_KEY_PATH"
+	TranslatorEnvPkiBootstrapToken     = "PKI_BOOTSTRAP_TOKEN"
+	TranslatorEnvPkiBootstrapTokenPath = "PKI_BOOTSTRAP_TOKEN_PATH"
+	TranslatorEnvPkiCAFingerprints     = "PKI_CA_FINGERPRINTS"
+
+	TranslatorEnvCertificateDNSNames    = "CERTIFICATE_DNS_NAMES"
+	TranslatorEnvCertificateIPAddresses = "CERTIFICATE_IP_ADDRESSES"
+	TranslatorEnvSpiffeID               = "SPIFFE_ID"
+	TranslatorEnvSpiffeTrustDomain      = "SPIFFE_TRUST_DOMAIN"
+	TranslatorEnvPodNamespace           = "POD_NAMESPACE"
+	TranslatorEnvPodServiceAccount      = "POD_SERVICE_ACCOUNT"
+
+	TranslatorEnvKeyMaterialSource = "KEY_MATERIAL_SOURCE"
+	TranslatorEnvDevCAPath         = "DEV_CA_PATH"
+
+	TranslatorEnvKeyStore                = "KEY_STORE"
+	TranslatorEnvKeyStoreSecretName      = "KEY_STORE_SECRET_NAME"
+	TranslatorEnvKeyStoreSecretNamespace = "KEY_STORE_SECRET_NAMESPACE"
+
+	TranslatorEnvEgressTransport   = "EGRESS_IDENTITY_TRANSPORT"
+	TranslatorEnvIngressTransports = "INGRESS_IDENTITY_TRANSPORTS"
+	TranslatorEnvTrustEndpointPort = "TRUST_ENDPOINT_PORT"
+	TranslatorEnvRequestBinding    = "REQUEST_BINDING_RULES"
+	TranslatorEnvRenewBefore       = "CERTIFICATE_RENEW_BEFORE"
+	TranslatorEnvReloadInterval    = "KEY_MATERIAL_RELOAD_INTERVAL"
+	TranslatorEnvDelegation        = "DELEGATION"
+
+	TranslatorEnvAudience             = "AUDIENCE"
+	TranslatorEnvAudienceAliases      = "AUDIENCE_ALIASES"
+	TranslatorEnvAcceptLegacyAudience = "ACCEPT_LEGACY_AUDIENCE"
+	TranslatorEnvEmitLegacyAudience   = "EMIT_LEGACY_AUDIENCE"
+
 	TranslatorDefaultIngressPort = 50051
 	TranslatorDefaultEgressPort  = 50052
 	TranslatorDefaultCaPath      = "/ca"
 	TranslatorDefaultCsrPath     = "/csr"
+
+	TranslatorDefaultTrustBundleReloadInterval = time.Minute
+
+	TranslatorKeyMaterialSourcePKI    = "pki"
+	TranslatorKeyMaterialSourceSpiffe = "spiffe"
+	TranslatorKeyMaterialSourceDev    = "dev"
+
+	TranslatorKeyStoreFile       = "file"
+	TranslatorKeyStoreMemory     = "memory"
+	TranslatorKeyStoreKubernetes = "kubernetes"
 )
 
 // TranslatorConfig contains all necessary configurations for the Translator.
@@ -34,9 +87,39 @@ type TranslatorConfig struct {
 	// Function for the outgoing translation.
 	EgressTranslator translator.EgressTranslation
 
+	// The transport that is used to send the WirePact JWT to other translators.
+	// If omitted, the JWT is sent in the x-wirepact-identity header.
+	EgressTransport wirepact.Transport
+
+	// The ordered list of transports that are searched for a WirePact JWT
+	// in incoming requests. The first transport that contains a JWT is used.
+	// If omitted, only the x-wirepact-identity header is searched.
+	IngressTransports []wirepact.Transport
+
+	// If set, the ingress forwards the verified WirePact JWT to the application in
+	// the x-wirepact-delegation header. If the application propagates the header to
+	// its outgoing requests, the egress delegates the identity (the "act" chain of
+	// the sent JWT contains the translators of the previous hops).
+	Delegation bool
+
+	// If set, the translator serves the JWKS and the trusted CA certificates
+	// on the given port (see wirepact.NewTrustHandler).
+	TrustEndpointPort int
+
+	// The interval in which the TrustBundle of the JWTConfig (if any) is reloaded.
+	// If omitted, the bundle is reloaded every minute.
+	TrustBundleReloadInterval time.Duration
+
+	// If set and the TrustBundle of the JWTConfig is omitted, the certificates in
+	// the file (or directory) are trusted in addition to the CA of the key material.
+	TrustBundlePath string
+
 	// Config for the PKI.
 	pki.Config
-	// Config for the WirePact JWT.
+	// Config for the WirePact JWT. If the KeyMaterialProvider is omitted,
+	// the key material is managed with the PKI config (pki.NewKeyMaterialProvider).
+	// If the RevocationChecker is omitted and a CRLPath is configured, the
+	// certificates are checked against the CRL of the PKI (pki.NewRevocationChecker).
 	wirepact.JWTConfig
 }
 
@@ -45,14 +128,64 @@ type TranslatorConfig struct {
 // after it is returned.
 //
 // The variables are:
-// INGRESS_PORT, EGRESS_PORT, PKI_ADDRESS, COMMON_NAME
+// INGRESS_PORT, EGRESS_PORT, PKI_ADDRESS, COMMON_NAME, KEY_TYPE, TRUST_BUNDLE_PATH
 // The common name gets set for the certificate common name and the issuer for the JWTs.
-// Ingress and Egress ports have default values.
+// Ingress and Egress ports have default values. If KEY_TYPE is omitted, an RSA key is used.
+// If TRUST_BUNDLE_PATH is set, the certificates in the file (or directory) are trusted
+// in addition to the CA of the PKI. If CRL_PATH is set, the certificates of received
+// JWTs are checked against the CRL of the PKI (CRL_FAIL_OPEN=true accepts certificates
+// when the CRL is stale). EGRESS_IDENTITY_TRANSPORT and INGRESS_IDENTITY_TRANSPORTS
+// configure the transport of the WirePact JWT (see wirepact.ParseTransport and
+// wirepact.ParseTransports), e.g. "authorization" or "header:x-identity,cookie".
+// If TRUST_ENDPOINT_PORT is set, the JWKS and the trusted CA certificates are served on that port.
+// REQUEST_BINDING_RULES binds the WirePact JWTs to the requests of the given path prefixes
+// (see wirepact.ParseRequestBindingRules), e.g. "/api/payments=request-body,/api=request".
+// PKI_TLS_CA_PATH, PKI_TLS_CERT_PATH and PKI_TLS_KEY_PATH configure the TLS connection
+// to the PKI (trusted CA and client certificate). PKI_BOOTSTRAP_TOKEN (or the file
+// PKI_BOOTSTRAP_TOKEN_PATH) is sent as bearer token with the CSR. PKI_CA_FINGERPRINTS
+// pins the CA certificate of the PKI to a comma separated list of SHA-256 fingerprints.
+// KEY_STORE defines where the key material is stored: "file" (default, in the working
+// directory), "memory" or "kubernetes" (in the Secret KEY_STORE_SECRET_NAME of the
+// namespace KEY_STORE_SECRET_NAMESPACE, which defaults to the namespace of the pod).
+// CERTIFICATE_RENEW_BEFORE defines when the certificate is renewed before it expires (e.g. "24h").
+// KEY_MATERIAL_RELOAD_INTERVAL defines how often the key store is checked for rotated key
+// material (e.g. "30s", default "10s", a negative value disables the reload).
+// CERTIFICATE_DNS_NAMES and CERTIFICATE_IP_ADDRESSES (comma separated) are requested as SANs
+// of the certificate. SPIFFE_ID is requested as URI SAN of the certificate. If it is omitted
+// and SPIFFE_TRUST_DOMAIN is set, the ID is derived from POD_NAMESPACE and POD_SERVICE_ACCOUNT
+// (e.g. from the downward API): "spiffe://<trust-domain>/ns/<namespace>/sa/<service-account>".
+// AUDIENCE defines the audience that is expected in received JWTs (default: COMMON_NAME).
+// AUDIENCE_ALIASES (comma separated, default: CERTIFICATE_DNS_NAMES) are accepted in addition,
+// e.g. the host names of the service, which the egress of the caller sends by default. When a
+// service is called with a host name that differs from its common name, the host name must be
+// one of the aliases. For a rollout next to translators without audience scoped tokens,
+// ACCEPT_LEGACY_AUDIENCE=true accepts and EMIT_LEGACY_AUDIENCE=true sends the legacy
+// audience "WirePact" (see wirepact.JWTConfig). Once all translators send audience scoped
+// tokens and the aliases are configured, ACCEPT_LEGACY_AUDIENCE can be removed.
+// DELEGATION=true forwards the verified WirePact JWT to the application (x-wirepact-delegation
+// header), such that the egress delegates the identity if the header is propagated.
+// KEY_MATERIAL_SOURCE defines where the key material comes from: "pki" (default) or "spiffe"
+// (X.509-SVIDs and bundles of the SPIFFE Workload API at SPIFFE_ENDPOINT_SOCKET, e.g. of a
+// SPIRE agent). With "spiffe", PKI_ADDRESS is not required and SPIFFE_ID (required) selects
+// the SVID and is used as issuer of the JWTs.
+// "dev" uses a self-signed development CA instead of the PKI (NOT for production, see
+// pki.Config.DevMode), which is shared by all translators with the same DEV_CA_PATH.
 func NewConfigFromEnvironmentVariables(
 	ingressTranslator translator.IngressTranslation,
 	egressTranslator translator.EgressTranslation) (TranslatorConfig, error) {
+	keyMaterialSource := os.Getenv(TranslatorEnvKeyMaterialSource)
+	if keyMaterialSource == "" {
+		keyMaterialSource = TranslatorKeyMaterialSourcePKI
+	}
+	switch keyMaterialSource {
+	case TranslatorKeyMaterialSourcePKI, TranslatorKeyMaterialSourceSpiffe, TranslatorKeyMaterialSourceDev:
+	default:
+		logrus.Error("KEY_MATERIAL_SOURCE env variable is invalid.")
+		return TranslatorConfig{}, fmt.Errorf("%v: %q", ErrUnknownKeyMaterialSource, keyMaterialSource)
+	}
+
 	pkiAddress := os.Getenv(TranslatorEnvPkiAddress)
-	if pkiAddress == "" {
+	if pkiAddress == "" && keyMaterialSource == TranslatorKeyMaterialSourcePKI {
 		logrus.Error("PKI_ADDRESS env variable is not set.")
 		return TranslatorConfig{}, errors.New(ErrPkiAddressNotSet)
 	}
@@ -65,31 +198,227 @@ func NewConfigFromEnvironmentVariables(
 
 	ingressPort := getIntEnvironment(TranslatorEnvIngressPort, TranslatorDefaultIngressPort)
 	egressPort := getIntEnvironment(TranslatorEnvEgressPort, TranslatorDefaultEgressPort)
+	trustEndpointPort := getIntEnvironment(TranslatorEnvTrustEndpointPort, 0)
+	keyType := pki.KeyType(os.Getenv(TranslatorEnvKeyType))
+	trustBundlePath := os.Getenv(TranslatorEnvTrustBundlePath)
+	crlPath := os.Getenv(TranslatorEnvCrlPath)
+	crlFailOpen, _ := strconv.ParseBool(os.Getenv(TranslatorEnvCrlFailOpen))
+	delegation, _ := strconv.ParseBool(os.Getenv(TranslatorEnvDelegation))
+	acceptLegacyAudience, _ := strconv.ParseBool(os.Getenv(TranslatorEnvAcceptLegacyAudience))
+	emitLegacyAudience, _ := strconv.ParseBool(os.Getenv(TranslatorEnvEmitLegacyAudience))
+
+	var egressTransport wirepact.Transport
+	if value := os.Getenv(TranslatorEnvEgressTransport); value != "" {
+		var err error
+		egressTransport, err = wirepact.ParseTransport(value)
+		if err != nil {
+			logrus.WithError(err).Error("EGRESS_IDENTITY_TRANSPORT env variable is invalid.")
+			return TranslatorConfig{}, err
+		}
+	}
+
+	ingressTransports, err := wirepact.ParseTransports(os.Getenv(TranslatorEnvIngressTransports))
+	if err != nil {
+		logrus.WithError(err).Error("INGRESS_IDENTITY_TRANSPORTS env variable is invalid.")
+		return TranslatorConfig{}, err
+	}
+
+	var renewBefore time.Duration
+	if value := os.Getenv(TranslatorEnvRenewBefore); value != "" {
+		renewBefore, err = time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Error("CERTIFICATE_RENEW_BEFORE env variable is invalid.")
+			return TranslatorConfig{}, err
+		}
+	}
+
+	var reloadInterval time.Duration
+	if value := os.Getenv(TranslatorEnvReloadInterval); value != "" {
+		reloadInterval, err = time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).Error("KEY_MATERIAL_RELOAD_INTERVAL env variable is invalid.")
+			return TranslatorConfig{}, err
+		}
+	}
+
+	store, err := newStoreFromEnvironment()
+	if err != nil {
+		logrus.WithError(err).Error("KEY_STORE env variables are invalid.")
+		return TranslatorConfig{}, err
+	}
+
+	ipAddresses, err := parseIPAddresses(list.Split(os.Getenv(TranslatorEnvCertificateIPAddresses)))
+	if err != nil {
+		logrus.WithError(err).Error("CERTIFICATE_IP_ADDRESSES env variable is invalid.")
+		return TranslatorConfig{}, err
+	}
+
+	spiffeID, err := spiffeIDFromEnvironment()
+	if err != nil {
+		logrus.WithError(err).Error("SPIFFE env variables are invalid.")
+		return TranslatorConfig{}, err
+	}
+	if spiffeID == "" && keyMaterialSource == TranslatorKeyMaterialSourceSpiffe {
+		logrus.Error("SPIFFE_ID or SPIFFE_TRUST_DOMAIN env variable is not set.")
+		return TranslatorConfig{}, errors.New(ErrSpiffeIDNotSet)
+	}
+
+	requestBindingRules, err := wirepact.ParseRequestBindingRules(os.Getenv(TranslatorEnvRequestBinding))
+	if err != nil {
+		logrus.WithError(err).Error("REQUEST_BINDING_RULES env variable is invalid.")
+		return TranslatorConfig{}, err
+	}
 
 	logrus.WithFields(map[string]interface{}{
 		"COMMON_NAME":  commonName,
 		"PKI_ADDRESS":  pkiAddress,
 		"INGERSS_PORT": ingressPort,
 		"EGRESS_PORT":  egressPort,
+		"KEY_TYPE":     keyType,
+		"SPIFFE_ID":    spiffeID,
+		"KEY_SOURCE":   keyMaterialSource,
 	}).Info("Create translator config.")
 
+	pkiConfig := pki.Config{
+		BaseAddress:            pkiAddress,
+		CAPath:                 TranslatorDefaultCaPath,
+		CSRPath:                TranslatorDefaultCsrPath,
+		CRLPath:                crlPath,
+		CRLFailOpen:            crlFailOpen,
+		Store:                  store,
+		RenewBefore:            renewBefore,
+		ReloadInterval:         reloadInterval,
+		TLSCAPath:              os.Getenv(TranslatorEnvPkiTLSCAPath),
+		TLSCertPath:            os.Getenv(TranslatorEnvPkiTLSCertPath),
+		TLSKeyPath:             os.Getenv(TranslatorEnvPkiTLSKeyPath),
+		BootstrapToken:         os.Getenv(TranslatorEnvPkiBootstrapToken),
+		BootstrapTokenPath:     os.Getenv(TranslatorEnvPkiBootstrapTokenPath),
+		CAFingerprints:         list.Split(os.Getenv(TranslatorEnvPkiCAFingerprints)),
+		DevMode:                keyMaterialSource == TranslatorKeyMaterialSourceDev,
+		DevCAPath:              os.Getenv(TranslatorEnvDevCAPath),
+		CertificateCommonName:  commonName,
+		CertificateDNSNames:    list.Split(os.Getenv(TranslatorEnvCertificateDNSNames)),
+		CertificateIPAddresses: ipAddresses,
+		SPIFFEID:               spiffeID,
+		KeyType:                keyType,
+	}
+
+	if trustBundlePath != "" {
+		logrus.WithField("TRUST_BUNDLE_PATH", trustBundlePath).Info("Use trust bundle.")
+	}
+
+	if crlPath != "" && keyMaterialSource != TranslatorKeyMaterialSourcePKI {
+		logrus.WithField("KEY_MATERIAL_SOURCE", keyMaterialSource).Warn("CRL_PATH is ignored for the key material source.")
+		pkiConfig.CRLPath = ""
+	} else if crlPath != "" {
+		logrus.WithFields(logrus.Fields{
+			"CRL_PATH":      crlPath,
+			"CRL_FAIL_OPEN": crlFailOpen,
+		}).Info("Use certificate revocation list.")
+	}
+
+	// The provider of the PKI key material (and its revocation checker) is created
+	// by NewTranslator, such that it uses the (customized) config of the translator.
+	issuer := commonName
+	var keyMaterial pki.KeyMaterialProvider
+	var trustBundle *pki.TrustBundle
+	if keyMaterialSource == TranslatorKeyMaterialSourceSpiffe {
+		// The X.509-SVID identifies the translator with its SPIFFE ID (not with the common name).
+		issuer = spiffeID
+		workloadAPI := pki.NewWorkloadAPIKeyMaterialProvider(&pki.WorkloadAPIConfig{SPIFFEID: spiffeID})
+		keyMaterial = workloadAPI
+
+		trustSources := []pki.TrustSource{workloadAPI.TrustSource()}
+		if trustBundlePath != "" {
+			trustSources = append(trustSources, pki.FileTrustSource(trustBundlePath))
+		}
+		trustBundle = pki.NewTrustBundle(trustSources...)
+
+		// Bundles that are pushed by the Workload API are trusted immediately.
+		workloadAPI.OnUpdate(func() {
+			err := trustBundle.Reload()
+			if err != nil {
+				logrus.WithError(err).Warn("Could not reload trust bundle.")
+			}
+		})
+	}
+
 	return TranslatorConfig{
 		IngressPort:       ingressPort,
 		IngressTranslator: ingressTranslator,
 		EgressPort:        egressPort,
 		EgressTranslator:  egressTranslator,
-		Config: pki.Config{
-			BaseAddress:           pkiAddress,
-			CAPath:                TranslatorDefaultCaPath,
-			CSRPath:               TranslatorDefaultCsrPath,
-			CertificateCommonName: commonName,
-		},
+		EgressTransport:   egressTransport,
+		IngressTransports: ingressTransports,
+		TrustEndpointPort: trustEndpointPort,
+		Delegation:        delegation,
+		TrustBundlePath:   trustBundlePath,
+		Config:            pkiConfig,
 		JWTConfig: wirepact.JWTConfig{
-			Issuer: commonName,
+			Issuer:               issuer,
+			Audience:             os.Getenv(TranslatorEnvAudience),
+			AudienceAliases:      list.Split(os.Getenv(TranslatorEnvAudienceAliases)),
+			AcceptLegacyAudience: acceptLegacyAudience,
+			EmitLegacyAudience:   emitLegacyAudience,
+			KeyMaterialProvider:  keyMaterial,
+			TrustBundle:          trustBundle,
+			RequestBindingRules:  requestBindingRules,
 		},
 	}, nil
 }
 
+func newStoreFromEnvironment() (pki.Store, error) {
+	switch value := os.Getenv(TranslatorEnvKeyStore); value {
+	case "", TranslatorKeyStoreFile:
+		return nil, nil
+	case TranslatorKeyStoreMemory:
+		return pki.NewMemoryStore(), nil
+	case TranslatorKeyStoreKubernetes:
+		name := os.Getenv(TranslatorEnvKeyStoreSecretName)
+		if name == "" {
+			return nil, errors.New(ErrSecretNameNotSet)
+		}
+		return pki.NewInClusterKubernetesSecretStore(os.Getenv(TranslatorEnvKeyStoreSecretNamespace), name)
+	default:
+		return nil, fmt.Errorf("%v: %q", ErrUnknownKeyStore, value)
+	}
+}
+
+func spiffeIDFromEnvironment() (string, error) {
+	spiffeID := os.Getenv(TranslatorEnvSpiffeID)
+	if spiffeID == "" {
+		trustDomain := os.Getenv(TranslatorEnvSpiffeTrustDomain)
+		if trustDomain == "" {
+			return "", nil
+		}
+
+		namespace := os.Getenv(TranslatorEnvPodNamespace)
+		serviceAccount := os.Getenv(TranslatorEnvPodServiceAccount)
+		if namespace == "" || serviceAccount == "" {
+			return "", errors.New(ErrSpiffeWorkloadNotSet)
+		}
+		spiffeID = pki.SPIFFEIDForServiceAccount(trustDomain, namespace, serviceAccount)
+	}
+
+	_, err := pki.ParseSPIFFEID(spiffeID)
+	if err != nil {
+		return "", err
+	}
+	return spiffeID, nil
+}
+
+func parseIPAddresses(values []string) ([]net.IP, error) {
+	var ipAddresses []net.IP
+	for _, value := range values {
+		ipAddress := net.ParseIP(value)
+		if ipAddress == nil {
+			return nil, fmt.Errorf("invalid ip address %q", value)
+		}
+		ipAddresses = append(ipAddresses, ipAddress)
+	}
+	return ipAddresses, nil
+}
+
 func getIntEnvironment(name string, defaultValue int) int {
 	if value, ok := os.LookupEnv(name); ok {
 		if intValue, err := strconv.Atoi(value); err == nil {
@@ -1,11 +1,14 @@
 package envoy
 
 import (
+	"strings"
+
 	"github.com/WirePact/go-translator/wirepact"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	types "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 const (
@@ -29,11 +32,37 @@ func CreateNoopOKResponse() *auth.CheckResponse {
 // CreateEgressOKResponse creates an outbound OK response by encoding the given userID with
 // the given jwtConfig and then returning an auth result that adds the WirePact JWT header.
 func CreateEgressOKResponse(jwtConfig *wirepact.JWTConfig, userID string, headersToRemove []string) (*auth.CheckResponse, error) {
-	jwt, err := wirepact.CreateSignedJWTForUser(jwtConfig, userID)
+	return CreateEgressOKResponseForIdentity(jwtConfig, &wirepact.Identity{Subject: userID}, headersToRemove)
+}
+
+// CreateEgressOKResponseForIdentity creates an outbound OK response by encoding the given identity with
+// the given jwtConfig and then returning an auth result that adds the WirePact JWT header.
+func CreateEgressOKResponseForIdentity(jwtConfig *wirepact.JWTConfig, identity *wirepact.Identity, headersToRemove []string) (*auth.CheckResponse, error) {
+	jwt, err := wirepact.CreateSignedJWTForIdentity(jwtConfig, identity)
 	if err != nil {
 		return nil, err
 	}
 
+	return CreateEgressOKResponseForToken(jwt, headersToRemove), nil
+}
+
+// CreateEgressOKResponseForToken creates an outbound OK response that adds the
+// given (already signed) WirePact JWT header.
+func CreateEgressOKResponseForToken(jwt string, headersToRemove []string) *auth.CheckResponse {
+	return CreateEgressOKResponseForTransport(wirepact.DefaultTransport, jwt, nil, headersToRemove)
+}
+
+// CreateEgressOKResponseForTransport creates an outbound OK response that places the
+// given (already signed) WirePact JWT in the request according to the transport.
+// The request headers are required to merge the JWT into existing cookies.
+// An existing (e.g. propagated) WirePact JWT is replaced.
+func CreateEgressOKResponseForTransport(
+	transport wirepact.Transport,
+	jwt string,
+	requestHeaders map[string]string,
+	headersToRemove []string) *auth.CheckResponse {
+	update := transport.Set(jwt, requestHeaders)
+
 	return &auth.CheckResponse{
 		Status: &rpcstatus.Status{
 			Code: grpcOk,
@@ -43,15 +72,19 @@ func CreateEgressOKResponse(jwtConfig *wirepact.JWTConfig, userID string, header
 				Headers: []*core.HeaderValueOption{
 					{
 						Header: &core.HeaderValue{
-							Key:   wirepact.IdentityHeader,
-							Value: jwt,
+							Key:   update.Name,
+							Value: update.Value,
 						},
+						// Replace a WirePact JWT that was propagated by the application.
+						Append: wrapperspb.Bool(false),
 					},
 				},
-				HeadersToRemove: headersToRemove,
+				// Envoy removes headers after setting them, therefore the transport
+				// header must not be removed (e.g. a consumed authorization header).
+				HeadersToRemove: withoutHeader(headersToRemove, update.Name),
 			},
 		},
-	}, nil
+	}
 }
 
 // CreateIngressOKResponse creates an outbound OK response by encoding the given userID with
@@ -76,6 +109,55 @@ func CreateIngressOKResponse(headersToAdd []*core.HeaderValue, headersToRemove [
 	}
 }
 
+// CreateIngressOKResponseForTransport creates an inbound OK response that removes the
+// WirePact JWT from the request according to the transport. If a header that is
+// added by the translator is also used by the transport (e.g. the authorization header),
+// the header replaces the WirePact JWT instead of being appended.
+func CreateIngressOKResponseForTransport(
+	transport wirepact.Transport,
+	requestHeaders map[string]string,
+	headersToAdd []*core.HeaderValue,
+	headersToRemove []string) *auth.CheckResponse {
+	update := transport.Unset(requestHeaders)
+
+	var headerValues []*core.HeaderValueOption
+	replaced := false
+
+	for _, header := range headersToAdd {
+		option := &core.HeaderValueOption{Header: header}
+		if strings.EqualFold(header.Key, update.Name) {
+			if !replaced {
+				option.Append = wrapperspb.Bool(false)
+			}
+			replaced = true
+		}
+		headerValues = append(headerValues, option)
+	}
+
+	if !replaced {
+		if update.Remove {
+			headersToRemove = append(headersToRemove, update.Name)
+		} else {
+			headerValues = append(headerValues, &core.HeaderValueOption{
+				Header: &core.HeaderValue{Key: update.Name, Value: update.Value},
+				Append: wrapperspb.Bool(false),
+			})
+		}
+	}
+
+	return &auth.CheckResponse{
+		Status: &rpcstatus.Status{
+			Code: grpcOk,
+		},
+		HttpResponse: &auth.CheckResponse_OkResponse{
+			OkResponse: &auth.OkHttpResponse{
+				Headers:         headerValues,
+				HeadersToRemove: headersToRemove,
+			},
+		},
+	}
+}
+
 // CreateForbiddenResponse creates a forbidden response for the up/downstream with the given reason.
 func CreateForbiddenResponse(reason string) *auth.CheckResponse {
 	return &auth.CheckResponse{
@@ -90,3 +172,13 @@ func CreateForbiddenResponse(reason string) *auth.CheckResponse {
 		},
 	}
 }
+
+func withoutHeader(headers []string, name string) []string {
+	var result []string
+	for _, header := range headers {
+		if !strings.EqualFold(header, name) {
+			result = append(result, header)
+		}
+	}
+	return result
+}
@@ -3,4 +3,10 @@ package go_translator
 const (
 	ErrPkiAddressNotSet = "pki address not set"
 	ErrCommonNameNotSet = "common name not set"
+	ErrUnknownKeyStore  = "unknown key store"
+	ErrSecretNameNotSet = "key store secret name not set"
+
+	ErrUnknownKeyMaterialSource = "unknown key material source"
+	ErrSpiffeWorkloadNotSet     = "pod namespace or service account for spiffe id not set"
+	ErrSpiffeIDNotSet           = "spiffe id not set"
 )
@@ -8,7 +8,7 @@ import (
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 )
 
-func ingress(_ string, _ *auth.CheckRequest) (translator.IngressResult, error) {
+func ingress(_ *wirepact.Identity, _ *auth.CheckRequest) (translator.IngressResult, error) {
 	return translator.IngressResult{
 		HeadersToAdd:    nil,
 		HeadersToRemove: []string{"foobar"},
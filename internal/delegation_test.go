@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"github.com/WirePact/go-translator/pki"
+	"github.com/WirePact/go-translator/translator"
+	"github.com/WirePact/go-translator/wirepact"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+type testTranslator struct {
+	ingress *IngressServer
+	egress  *EgressServer
+	userID  string
+
+	received *wirepact.Identity
+}
+
+func newTestTranslator(t *testing.T, testPKI *pkitest.PKI, name string) *testTranslator {
+	provider := pki.NewKeyMaterialProvider(&pki.Config{
+		BaseAddress:           testPKI.URL,
+		CAPath:                pkitest.CAPath,
+		CSRPath:               pkitest.CSRPath,
+		RequestRetries:        -1,
+		Store:                 pki.NewMemoryStore(),
+		CertificateCommonName: name,
+		KeyType:               pki.KeyTypeECDSAP256,
+	})
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwtConfig := &wirepact.JWTConfig{
+		Issuer:              name,
+		Audience:            name,
+		KeyMaterialProvider: provider,
+	}
+
+	testTranslator := &testTranslator{}
+	testTranslator.ingress = &IngressServer{
+		IngressTranslator: func(identity *wirepact.Identity, _ *auth.CheckRequest) (translator.IngressResult, error) {
+			testTranslator.received = identity
+			return translator.IngressResult{}, nil
+		},
+		JWTConfig:  jwtConfig,
+		Transports: []wirepact.Transport{wirepact.DefaultTransport},
+		Delegation: true,
+	}
+	testTranslator.egress = &EgressServer{
+		EgressTranslator: func(_ *auth.CheckRequest) (translator.EgressResult, error) {
+			return translator.EgressResult{UserID: testTranslator.userID}, nil
+		},
+		JWTConfig:  jwtConfig,
+		TokenCache: wirepact.NewTokenCache(jwtConfig),
+		Transport:  wirepact.DefaultTransport,
+		Delegation: true,
+	}
+
+	return testTranslator
+}
+
+func newCheckRequest(host string, headers map[string]string) *auth.CheckRequest {
+	return &auth.CheckRequest{
+		Attributes: &auth.AttributeContext{
+			Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{
+					Method:  "GET",
+					Host:    host,
+					Path:    "/",
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func responseHeader(response *auth.CheckResponse, name string) string {
+	for _, header := range response.GetOkResponse().GetHeaders() {
+		if header.GetHeader().GetKey() == name {
+			return header.GetHeader().GetValue()
+		}
+	}
+	return ""
+}
+
+// forward sends the request from the egress of the caller to the ingress of the
+// receiver and returns the headers that the application of the receiver sees.
+func forward(t *testing.T, caller *testTranslator, receiver *testTranslator, host string, headers map[string]string) map[string]string {
+	egressResponse, err := caller.egress.Check(context.Background(), newCheckRequest(host, headers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if egressResponse.GetOkResponse() == nil {
+		t.Fatalf("egress denied the request: %v", egressResponse.GetDeniedResponse().GetBody())
+	}
+	removed := egressResponse.GetOkResponse().GetHeadersToRemove()
+	if !reflect.DeepEqual(removed, []string{wirepact.DelegationHeader}) {
+		t.Fatalf("egress did not remove the delegation header: %v", removed)
+	}
+
+	token := responseHeader(egressResponse, wirepact.IdentityHeader)
+	ingressResponse, err := receiver.ingress.Check(context.Background(), newCheckRequest(host, map[string]string{
+		wirepact.IdentityHeader: token,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingressResponse.GetOkResponse() == nil {
+		t.Fatalf("ingress denied the request: %v", ingressResponse.GetDeniedResponse().GetBody())
+	}
+
+	return map[string]string{
+		wirepact.DelegationHeader: responseHeader(ingressResponse, wirepact.DelegationHeader),
+	}
+}
+
+func TestDelegationOverIngressAndEgress(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	a := newTestTranslator(t, testPKI, "a")
+	b := newTestTranslator(t, testPKI, "b")
+	c := newTestTranslator(t, testPKI, "c")
+	a.userID = "alice"
+
+	// The application of b propagates the delegation header (but has no own user).
+	received := forward(t, a, b, "b", map[string]string{})
+	if received[wirepact.DelegationHeader] == "" {
+		t.Fatal("ingress did not forward the delegation header")
+	}
+	if chain := b.received.ActorChain(); len(chain) != 0 {
+		t.Fatalf("unexpected actor chain at b: %v", chain)
+	}
+
+	forward(t, b, c, "c", received)
+	if c.received.Subject != "alice" {
+		t.Fatalf("unexpected subject at c: %v", c.received.Subject)
+	}
+	if chain := c.received.ActorChain(); !reflect.DeepEqual(chain, []string{"b", "a"}) {
+		t.Fatalf("unexpected actor chain at c: %v", chain)
+	}
+
+	// The same user returned by the translator of b keeps the chain.
+	b.userID = "alice"
+	forward(t, b, c, "c", received)
+	if chain := c.received.ActorChain(); !reflect.DeepEqual(chain, []string{"b", "a"}) {
+		t.Fatalf("unexpected actor chain at c: %v", chain)
+	}
+
+	// Another user is not delegated.
+	b.userID = "bob"
+	forward(t, b, c, "c", received)
+	if c.received.Subject != "bob" || c.received.Actor != nil {
+		t.Fatalf("unexpected identity at c: %v %v", c.received.Subject, c.received.ActorChain())
+	}
+}
+
+func TestDelegationRejectsForgedHeader(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	b := newTestTranslator(t, testPKI, "b")
+
+	// An incoming delegation header without a WirePact JWT is removed by the ingress.
+	response, err := b.ingress.Check(context.Background(), newCheckRequest("b", map[string]string{
+		wirepact.DelegationHeader: "forged",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := response.GetOkResponse().GetHeadersToRemove()
+	if !reflect.DeepEqual(removed, []string{wirepact.DelegationHeader}) {
+		t.Fatalf("delegation header was not removed: %v", removed)
+	}
+
+	// An invalid delegation header is rejected by the egress.
+	response, err = b.egress.Check(context.Background(), newCheckRequest("c", map[string]string{
+		wirepact.DelegationHeader: "forged",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetDeniedResponse() == nil {
+		t.Fatal("egress accepted a forged delegation header")
+	}
+}
@@ -2,16 +2,26 @@ package internal
 
 import (
 	"context"
+	"errors"
 
 	"github.com/WirePact/go-translator/envoy"
 	"github.com/WirePact/go-translator/translator"
 	"github.com/WirePact/go-translator/wirepact"
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/sirupsen/logrus"
 )
 
 type EgressServer struct {
 	EgressTranslator translator.EgressTranslation
 	JWTConfig        *wirepact.JWTConfig
+	TokenCache       *wirepact.TokenCache
+
+	// The transport for the created JWTs.
+	Transport wirepact.Transport
+
+	// If set, the WirePact JWT in the delegation header (forwarded by the ingress
+	// and propagated by the application) is delegated by this translator.
+	Delegation bool
 }
 
 func (server *EgressServer) Check(_ context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
@@ -28,7 +38,21 @@ func (server *EgressServer) Check(_ context.Context, req *auth.CheckRequest) (*a
 		return envoy.CreateNoopOKResponse(), nil
 	}
 
-	if result.UserID == "" {
+	identity := egressIdentity(&result)
+	headersToRemove := result.HeadersToRemove
+	if server.Delegation {
+		delegated, err := server.delegatedIdentity(req)
+		if err != nil {
+			logrus.WithError(err).Warn("Rejected propagated WirePact JWT.")
+			return envoy.CreateForbiddenResponse("Invalid propagated WirePact identity."), nil
+		}
+		identity = delegate(identity, delegated)
+
+		// The delegation header is only meant for the translator.
+		headersToRemove = append(append([]string{}, headersToRemove...), wirepact.DelegationHeader)
+	}
+
+	if identity.Subject == "" {
 		return envoy.CreateForbiddenResponse("No UserID given for outbound communication."), nil
 	}
 
@@ -36,5 +60,78 @@ func (server *EgressServer) Check(_ context.Context, req *auth.CheckRequest) (*a
 		return envoy.CreateForbiddenResponse(result.Forbidden), nil
 	}
 
-	return envoy.CreateEgressOKResponse(server.JWTConfig, result.UserID, result.HeadersToRemove)
+	options := &wirepact.TokenOptions{
+		Audience: egressAudience(&result, req),
+		Request:  boundRequest(req),
+	}
+
+	jwt, err := server.TokenCache.GetOrCreate(server.JWTConfig, identity, options)
+	if errors.Is(err, wirepact.ErrDelegationTooDeep) {
+		return envoy.CreateForbiddenResponse("Delegation chain too deep."), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	return envoy.CreateEgressOKResponseForTransport(server.Transport, jwt, headers, headersToRemove), nil
+}
+
+// delegatedIdentity checks if the outgoing request carries the delegation header
+// with a WirePact JWT that was received by the ingress (and propagated by the
+// application). If so, the verified identity is delegated by this translator.
+// If no JWT is present, nil is returned.
+func (server *EgressServer) delegatedIdentity(req *auth.CheckRequest) (*wirepact.Identity, error) {
+	headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	wirePactJWT, ok := headers[wirepact.DelegationHeader]
+	if !ok || wirePactJWT == "" {
+		return nil, nil
+	}
+
+	identity, err := wirepact.GetPropagatedJWTIdentity(server.JWTConfig, wirePactJWT)
+	if err != nil {
+		return nil, err
+	}
+
+	return identity.Delegate(server.JWTConfig.Issuer), nil
+}
+
+// delegate returns the identity for the outgoing request. The delegated identity
+// is used if the translator returned no subject. If the translator returned the
+// same subject, the identity of the translator is sent with the delegation chain.
+// Otherwise, the application acts on behalf of another user and nothing is delegated.
+func delegate(identity *wirepact.Identity, delegated *wirepact.Identity) *wirepact.Identity {
+	switch {
+	case delegated == nil:
+		return identity
+	case identity.Subject == "":
+		return delegated
+	case identity.Subject == delegated.Subject:
+		chained := *identity
+		chained.Actor = delegated.Actor
+		return &chained
+	default:
+		return identity
+	}
+}
+
+func egressIdentity(result *translator.EgressResult) *wirepact.Identity {
+	if result.Identity == nil {
+		return &wirepact.Identity{Subject: result.UserID}
+	}
+
+	identity := *result.Identity
+	if identity.Subject == "" {
+		identity.Subject = result.UserID
+	}
+
+	return &identity
+}
+
+func egressAudience(result *translator.EgressResult, req *auth.CheckRequest) string {
+	if result.Audience != "" {
+		return result.Audience
+	}
+
+	return wirepact.AuthorityAudience(req.GetAttributes().GetRequest().GetHttp().GetHost())
 }
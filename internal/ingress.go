@@ -6,40 +6,70 @@ import (
 	"github.com/WirePact/go-translator/envoy"
 	"github.com/WirePact/go-translator/translator"
 	"github.com/WirePact/go-translator/wirepact"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type IngressServer struct {
 	IngressTranslator translator.IngressTranslation
+	JWTConfig         *wirepact.JWTConfig
+	Transports        []wirepact.Transport
+
+	// If set, the verified WirePact JWT is forwarded to the application in the
+	// delegation header (and a delegation header of the caller is removed).
+	Delegation bool
 }
 
 func (server *IngressServer) Check(_ context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
-	// Basically, the check runs for every incoming request. If the request contains the
-	// specific X-WirePact-Identity header, the header value is processed.
+	// Basically, the check runs for every incoming request. If the request contains a
+	// WirePact JWT in one of the configured transports, the JWT is processed.
 	// If not, then the request is just forwarded and therefore allowed to the target system.
 
-	wirePactJWT, ok := req.Attributes.Request.Http.Headers[wirepact.IdentityHeader]
+	headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	wirePactJWT, transport, ok := wirepact.ExtractFirst(server.Transports, headers)
 	if !ok {
-		return envoy.CreateNoopOKResponse(), nil
+		return server.noopResponse(), nil
 	}
 
-	subject, err := wirepact.GetJWTUserSubject(wirePactJWT)
+	identity, err := wirepact.GetJWTIdentityForRequest(server.JWTConfig, wirePactJWT, boundRequest(req))
 	if err != nil {
-		return nil, err
+		logrus.WithError(err).Warn("Rejected WirePact JWT.")
+		return envoy.CreateForbiddenResponse("Invalid WirePact identity."), nil
 	}
 
-	result, err := server.IngressTranslator(subject, req)
+	result, err := server.IngressTranslator(identity, req)
 	if err != nil {
 		return nil, err
 	}
 
 	if result.Skip {
-		return envoy.CreateNoopOKResponse(), nil
+		return server.noopResponse(), nil
 	}
 
 	if result.Forbidden != "" {
 		return envoy.CreateForbiddenResponse(result.Forbidden), nil
 	}
 
-	return envoy.CreateIngressOKResponse(result.HeadersToAdd, append(result.HeadersToRemove, wirepact.IdentityHeader)), nil
+	response := envoy.CreateIngressOKResponseForTransport(transport, headers, result.HeadersToAdd, result.HeadersToRemove)
+	if server.Delegation {
+		// The header replaces a delegation header that was sent by the caller.
+		okResponse := response.GetOkResponse()
+		okResponse.Headers = append(okResponse.Headers, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: wirepact.DelegationHeader, Value: wirePactJWT},
+			Append: wrapperspb.Bool(false),
+		})
+	}
+
+	return response, nil
+}
+
+// noopResponse forwards the request unchanged. If delegation is enabled, a delegation
+// header is removed, since only verified JWTs must reach the application.
+func (server *IngressServer) noopResponse() *auth.CheckResponse {
+	if server.Delegation {
+		return envoy.CreateIngressOKResponse(nil, []string{wirepact.DelegationHeader})
+	}
+	return envoy.CreateNoopOKResponse()
 }
@@ -0,0 +1,16 @@
+// Package list contains helpers for lists given as a single string (e.g. in
+// environment variables or command line flags).
+package list
+
+import "strings"
+
+// Split splits a comma separated list and drops empty items.
+func Split(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
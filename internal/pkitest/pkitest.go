@@ -0,0 +1,263 @@
+// Package pkitest contains a CA and a PKI for the tests of the translator.
+// The PKI speaks the protocol of the WirePact PKI (CA, CSR and CRL endpoints)
+// over an httptest server. The package only depends on the standard library,
+// such that the tests of the pki package can use it as well.
+package pkitest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The paths of the endpoints of the PKI.
+const (
+	CAPath  = "/ca"
+	CSRPath = "/csr"
+	CRLPath = "/crl"
+)
+
+// CA is a certificate authority with its private key.
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// NewCA creates a CA that is valid for a day. If a parent is given,
+// the CA is signed (cross-signed) by the parent instead of itself.
+func NewCA(t testing.TB, name string, parent *CA) *CA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	issuer := &CA{Certificate: template, Key: key}
+	if parent != nil {
+		issuer = parent
+	}
+
+	return &CA{Certificate: issuer.Issue(t, template, key.Public()), Key: key}
+}
+
+// Issue signs the template with the CA.
+func (ca *CA) Issue(t testing.TB, template *x509.Certificate, publicKey crypto.PublicKey) *x509.Certificate {
+	t.Helper()
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, publicKey, ca.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// SignCSR issues a certificate with the subject and the SANs of the CSR
+// that is valid for an hour.
+func (ca *CA) SignCSR(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		URIs:         csr.URIs,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca.Certificate, csr.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(certDER)
+}
+
+// CRL creates a DER encoded CRL of the CA with the revoked certificates.
+func (ca *CA) CRL(revoked []pkix.RevokedCertificate, nextUpdate time.Duration) ([]byte, error) {
+	now := time.Now()
+	return ca.Certificate.CreateCRL(rand.Reader, ca.Key, revoked, now.Add(-time.Minute), now.Add(nextUpdate))
+}
+
+// PEM returns the PEM encoded certificate of the CA.
+func (ca *CA) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+// PKI is a PKI that is served by an httptest server. The CA of the PKI can be
+// rotated and certificates can be revoked at any time. The CRL endpoint serves
+// the DER encoded CRL of the CA or, after a rotation, a PEM bundle with the CRLs
+// of the current and all previous CAs.
+type PKI struct {
+	// The base address of the PKI.
+	URL string
+
+	mutex         sync.Mutex
+	ca            *CA
+	previous      []*CA
+	revoked       []pkix.RevokedCertificate
+	crlNextUpdate time.Duration
+}
+
+// NewPKI starts a PKI with the CA. If no CA is given, a new CA is created.
+// The server is closed when the test completes.
+func NewPKI(t testing.TB, ca *CA) *PKI {
+	t.Helper()
+
+	if ca == nil {
+		ca = NewCA(t, "WirePact Test CA", nil)
+	}
+
+	pki := &PKI{ca: ca, crlNextUpdate: time.Hour}
+	server := httptest.NewServer(pki)
+	t.Cleanup(server.Close)
+	pki.URL = server.URL
+
+	return pki
+}
+
+// CA returns the current CA of the PKI.
+func (pki *PKI) CA() *CA {
+	pki.mutex.Lock()
+	defer pki.mutex.Unlock()
+	return pki.ca
+}
+
+// Rotate replaces the CA of the PKI. The CSRs are signed with the new CA
+// from now on and the CRL of the new CA is added to the CRL endpoint.
+func (pki *PKI) Rotate(ca *CA) {
+	pki.mutex.Lock()
+	defer pki.mutex.Unlock()
+	pki.previous = append(pki.previous, pki.ca)
+	pki.ca = ca
+}
+
+// Revoke adds the serial number to the CRL.
+func (pki *PKI) Revoke(serialNumber *big.Int) {
+	pki.mutex.Lock()
+	defer pki.mutex.Unlock()
+	pki.revoked = append(pki.revoked, pkix.RevokedCertificate{SerialNumber: serialNumber, RevocationTime: time.Now()})
+}
+
+// SetCRLNextUpdate sets the time (relative to the request) that is
+// announced as next update of the CRL. The default is an hour.
+func (pki *PKI) SetCRLNextUpdate(nextUpdate time.Duration) {
+	pki.mutex.Lock()
+	defer pki.mutex.Unlock()
+	pki.crlNextUpdate = nextUpdate
+}
+
+func (pki *PKI) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	pki.mutex.Lock()
+	ca, previous, revoked, crlNextUpdate := pki.ca, pki.previous, pki.revoked, pki.crlNextUpdate
+	pki.mutex.Unlock()
+
+	switch {
+	case request.URL.Path == CAPath && request.Method == http.MethodGet:
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = writer.Write(ca.PEM())
+
+	case request.URL.Path == CSRPath && request.Method == http.MethodPost:
+		certificate, err := signCSR(ca, request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = writer.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+
+	case request.URL.Path == CRLPath && request.Method == http.MethodGet:
+		crl, err := ca.CRL(revoked, crlNextUpdate)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(previous) == 0 {
+			writer.Header().Set("Content-Type", "application/pkix-crl")
+			_, _ = writer.Write(crl)
+			return
+		}
+
+		bundle := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+		for _, previousCA := range previous {
+			crl, err = previousCA.CRL(revoked, crlNextUpdate)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})...)
+		}
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = writer.Write(bundle)
+
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func signCSR(ca *CA, request *http.Request) (*x509.Certificate, error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("no pem encoded csr found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	return ca.SignCSR(csr)
+}
+
+var (
+	serialMutex sync.Mutex
+	lastSerial  int64
+)
+
+// serialNumber returns a unique serial number, such that a CRL never
+// revokes another certificate by accident.
+func serialNumber() *big.Int {
+	serialMutex.Lock()
+	defer serialMutex.Unlock()
+
+	serial := time.Now().UnixNano()
+	if serial <= lastSerial {
+		serial = lastSerial + 1
+	}
+	lastSerial = serial
+	return big.NewInt(serial)
+}
@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"github.com/WirePact/go-translator/wirepact"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// boundRequest returns the parts of the checked HTTP request that can be bound to a WirePact JWT.
+// The body is only available if envoy is configured to send it (with_request_body).
+func boundRequest(req *auth.CheckRequest) *wirepact.BoundRequest {
+	http := req.GetAttributes().GetRequest().GetHttp()
+
+	body := http.GetRawBody()
+	if len(body) == 0 && http.GetBody() != "" {
+		body = []byte(http.GetBody())
+	}
+
+	return &wirepact.BoundRequest{
+		Method:    http.GetMethod(),
+		Authority: http.GetHost(),
+		Path:      http.GetPath(),
+		Body:      body,
+	}
+}
@@ -0,0 +1,12 @@
+// Package serial generates serial numbers for certificates.
+package serial
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// Random returns a random 128 bit serial number for a certificate.
+func Random() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,84 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// newHTTPClient creates the http client for the requests to the PKI. The client
+// trusts the TLSCAPath (if set) and presents the TLS client certificate (if set).
+func (config *Config) newHTTPClient() (*http.Client, error) {
+	if config.HTTPClient != nil {
+		return config.HTTPClient, nil
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Timeout: defaultHTTPTimeout, Transport: transport}, nil
+}
+
+func (config *Config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.TLSCAPath != "" {
+		caPEMBlock, err := os.ReadFile(config.TLSCAPath)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEMBlock) {
+			return nil, fmt.Errorf("%v does not contain a pem encoded certificate", config.TLSCAPath)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if config.TLSCertPath != "" || config.TLSKeyPath != "" {
+		if config.TLSCertPath == "" || config.TLSKeyPath == "" {
+			return nil, errors.New("tls client certificate and key must be configured together")
+		}
+
+		// Check the key pair once, such that a misconfiguration is reported early.
+		_, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// The key pair is read for every handshake to support rotated client certificates.
+		tlsConfig.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			return &certificate, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// bootstrapToken returns the token that is sent with CSR requests.
+// A token file is read on every call to support rotated tokens.
+func (config *Config) bootstrapToken() (string, error) {
+	if config.BootstrapTokenPath == "" {
+		return config.BootstrapToken, nil
+	}
+
+	token, err := os.ReadFile(config.BootstrapTokenPath)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,158 @@
+package pki
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+// writeKeyPair issues a certificate for the usage by the CA and writes
+// the PEM encoded certificate and key into the directory.
+func writeKeyPair(t *testing.T, dir string, name string, ca *pkitest.CA, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+
+	key, err := KeyTypeECDSAP256.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := ca.Issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}, key.Public())
+	keyPEMBlock, err := encodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certPath, encodeCertificate(certificate), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyPath, keyPEMBlock, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestClientWithMutualTLS(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	serverCA, clientCA := pkitest.NewCA(t, "server ca", nil), pkitest.NewCA(t, "client ca", nil)
+	dir := t.TempDir()
+
+	serverCert, serverKey := writeKeyPair(t, dir, "server", serverCA, x509.ExtKeyUsageServerAuth)
+	serverKeyPair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.Certificate)
+
+	server := httptest.NewUnstartedServer(testPKI)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	tlsCAPath := filepath.Join(dir, "server-ca.pem")
+	if err = os.WriteFile(tlsCAPath, serverCA.PEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey := writeKeyPair(t, dir, "client", clientCA, x509.ExtKeyUsageClientAuth)
+
+	fetchCA := func(config *Config) error {
+		config = withTestPKI(config, testPKI)
+		config.BaseAddress = server.URL
+		_, err := NewClient(config).FetchCA(context.Background())
+		return err
+	}
+
+	err = fetchCA(&Config{TLSCAPath: tlsCAPath, TLSCertPath: clientCert, TLSKeyPath: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetchCA(&Config{TLSCAPath: tlsCAPath}) == nil {
+		t.Fatal("request without client certificate succeeded")
+	}
+
+	otherCert, otherKey := writeKeyPair(t, dir, "other", pkitest.NewCA(t, "other ca", nil), x509.ExtKeyUsageClientAuth)
+	if fetchCA(&Config{TLSCAPath: tlsCAPath, TLSCertPath: otherCert, TLSKeyPath: otherKey}) == nil {
+		t.Fatal("request with an untrusted client certificate succeeded")
+	}
+
+	// The PKI is not trusted without the TLSCAPath.
+	if fetchCA(&Config{TLSCertPath: clientCert, TLSKeyPath: clientKey}) == nil {
+		t.Fatal("request to an untrusted pki succeeded")
+	}
+}
+
+func TestTLSConfigRejectsIncompleteClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeKeyPair(t, dir, "client", pkitest.NewCA(t, "ca", nil), x509.ExtKeyUsageClientAuth)
+
+	invalid := []*Config{
+		{TLSCertPath: certPath},
+		{TLSKeyPath: keyPath},
+		{TLSCertPath: certPath, TLSKeyPath: certPath},
+		{TLSCAPath: keyPath},
+		{TLSCAPath: filepath.Join(dir, "missing.pem")},
+	}
+	for _, config := range invalid {
+		_, err := config.newHTTPClient()
+		if err == nil {
+			t.Fatalf("accepted the invalid tls configuration %+v", config)
+		}
+
+		// The error is returned for all requests of the client.
+		_, err = NewClient(config).FetchCA(context.Background())
+		if err == nil {
+			t.Fatal("client with an invalid tls configuration sent a request")
+		}
+	}
+}
+
+func TestBootstrapTokenFile(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	config := &Config{BootstrapToken: "ignored", BootstrapTokenPath: tokenPath}
+
+	if _, err := config.bootstrapToken(); err == nil {
+		t.Fatal("missing token file was ignored")
+	}
+
+	// The file is read on every call, such that rotated tokens are used.
+	for _, token := range []string{"first", "second"} {
+		if err := os.WriteFile(tokenPath, []byte(" "+token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		read, err := config.bootstrapToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != token {
+			t.Fatalf("expected token %q, got %q", token, read)
+		}
+	}
+
+	token, err := (&Config{BootstrapToken: "static"}).bootstrapToken()
+	if err != nil || token != "static" {
+		t.Fatalf("unexpected token %q (%v)", token, err)
+	}
+}
@@ -2,52 +2,93 @@ package pki
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/base64"
 	"encoding/pem"
-	"net/http"
-	"os"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	caFilename   = "ca.crt"
 	certFilename = "cert.crt"
 	keyFilename  = "cert.key"
+
+	// The previous CA certificates after a CA rotation (see RefreshCA).
+	caChainFilename = "ca-chain.crt"
 )
 
-var ca *x509.Certificate
-var certificate *x509.Certificate
-var privateKey *rsa.PrivateKey
+var defaultProviderMutex sync.RWMutex
+var defaultProvider KeyMaterialProvider
 
 // EnsureKeyMaterial checks if the CA and a local certificate/key
 // is available. If not, the CA and/or the certificate are fetched
-// from the configured (WirePact-)PKI.
+// from the configured (WirePact-)PKI. The loaded key material is
+// used by the deprecated package functions.
+//
+// Deprecated: Use NewKeyMaterialProvider and KeyMaterialProvider.Ensure.
 func EnsureKeyMaterial(config *Config) error {
-	err := loadCA(config)
+	provider := NewKeyMaterialProvider(config)
+	err := provider.Ensure()
 	if err != nil {
 		return err
 	}
 
-	err = loadLocalKey(config)
-	if err != nil {
-		return err
-	}
+	defaultProviderMutex.Lock()
+	defer defaultProviderMutex.Unlock()
+	defaultProvider = provider
+	return nil
+}
 
-	err = loadLocalCert(config)
-	if err != nil {
-		return err
+// GetKeyMaterial returns the current snapshot of the key material that was
+// loaded by EnsureKeyMaterial. If no key material is loaded, nil is returned.
+//
+// Deprecated: Use KeyMaterialProvider.KeyMaterial.
+func GetKeyMaterial() *KeyMaterial {
+	defaultProviderMutex.RLock()
+	defer defaultProviderMutex.RUnlock()
+	if defaultProvider == nil {
+		return nil
 	}
+	return defaultProvider.KeyMaterial()
+}
 
-	return nil
+func getKeyMaterial() *KeyMaterial {
+	if material := GetKeyMaterial(); material != nil {
+		return material
+	}
+	return &KeyMaterial{}
 }
 
 // GetPrivateKey returns the RSA private key to sign JWTs.
+// If the key material does not contain an RSA key, nil is returned.
+//
+// Deprecated: Use KeyMaterialProvider.KeyMaterial, which supports all key types.
 func GetPrivateKey() *rsa.PrivateKey {
-	return privateKey
+	rsaKey, _ := getKeyMaterial().PrivateKey.(*rsa.PrivateKey)
+	return rsaKey
+}
+
+// GetSigningKey returns the private key to sign JWTs.
+//
+// Deprecated: Use KeyMaterialProvider.KeyMaterial.
+func GetSigningKey() crypto.Signer {
+	return getKeyMaterial().PrivateKey
+}
+
+// GetKeyType returns the type of the loaded private key.
+//
+// Deprecated: Use KeyMaterialProvider.KeyMaterial.
+func GetKeyType() KeyType {
+	return getKeyMaterial().KeyType
 }
 
 // GetJWTCertificateHeaders returns a tuple containing the x5c and x5t
@@ -59,153 +100,227 @@ func GetPrivateKey() *rsa.PrivateKey {
 // 	x5c, x5t := pki.GetJWTCertificateHeaders()
 // 	jwt.Headers["x5c"] = x5c
 // 	jwt.Headers["x5t"] = x5t
+//
+// If no key material is loaded, empty headers are returned.
+//
+// Deprecated: Use KeyMaterial.JWTCertificateHeaders.
 func GetJWTCertificateHeaders() ([]string, string) {
-	signature := sha256.Sum256(certificate.Raw)
-	return []string{
-			base64.StdEncoding.EncodeToString(certificate.Raw),
-			base64.StdEncoding.EncodeToString(ca.Raw),
-		},
-		base64.StdEncoding.EncodeToString(signature[:])
+	material := getKeyMaterial()
+	if material.CA == nil || material.Certificate == nil {
+		return nil, ""
+	}
+	return material.JWTCertificateHeaders()
 }
 
 // GetCA returns the fetched PKI CA certificate.
+//
+// Deprecated: Use KeyMaterialProvider.KeyMaterial.
 func GetCA() *x509.Certificate {
-	return ca
+	return getKeyMaterial().CA
+}
+
+// GetCertificate returns the signed certificate of the translator.
+//
+// Deprecated: Use KeyMaterialProvider.KeyMaterial.
+func GetCertificate() *x509.Certificate {
+	return getKeyMaterial().Certificate
 }
 
-func loadCA(config *Config) error {
-	if !config.fileExists(caFilename) {
-		response, err := http.Get(config.caAddress())
+// loadCA parses the stored CA certificate. If no CA is stored, the CA is
+// fetched from the PKI and returned PEM encoded to be stored. In DevMode,
+// the CA of the development CA always replaces the stored CA.
+func loadCA(ctx context.Context, config *Config, authority certificateAuthority, stored []byte, previous []*trustedCA) (*x509.Certificate, []byte, error) {
+	var ca *x509.Certificate
+	var created []byte
+	var err error
+	if stored == nil || config.DevMode {
+		ca, err = authority.FetchCA(ctx)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-
-		caFile, err := os.Create(config.filePath(caFilename))
+		created = encodeCertificate(ca)
+		if bytes.Equal(created, stored) {
+			created = nil
+		}
+	} else {
+		ca, err = parseStoredCertificate(caFilename, stored)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+	}
+
+	err = config.verifyCAPin(ca, previous)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca, created, nil
+}
 
-		_, err = caFile.ReadFrom(response.Body)
+// loadLocalKey parses the stored private key. If no key is stored (or the
+// stored key is invalid and enroll is set), a key is generated and returned
+// PEM encoded to be stored.
+func loadLocalKey(config *Config, stored []byte, enroll bool) (crypto.Signer, KeyType, []byte, error) {
+	var privateKey crypto.Signer
+	var created []byte
+	var err error
+	if stored != nil {
+		privateKey, err = parsePrivateKey(stored)
+		if err != nil && !enroll {
+			return nil, "", nil, fmt.Errorf("%v: %w", keyFilename, err)
+		}
 		if err != nil {
-			return err
+			logrus.WithError(err).Warn("Stored private key is invalid, generating a new key.")
+			privateKey = nil
 		}
-		err = caFile.Close()
+	}
+
+	if privateKey == nil {
+		privateKey, err = config.KeyType.generate()
 		if err != nil {
-			return err
+			return nil, "", nil, err
 		}
-		err = response.Body.Close()
+		created, err = encodePrivateKey(privateKey)
 		if err != nil {
-			return err
+			return nil, "", nil, err
 		}
 	}
 
-	certPEMBlock, err := os.ReadFile(config.filePath(caFilename))
+	keyType, err := keyTypeOf(privateKey, config.KeyType)
 	if err != nil {
-		return err
+		return nil, "", nil, err
 	}
 
-	certBlock, _ := pem.Decode(certPEMBlock)
-
-	ca, err = x509.ParseCertificate(certBlock.Bytes)
-	if err != nil {
-		return err
+	if config.KeyType != "" && keyType != config.KeyType {
+		logrus.WithFields(logrus.Fields{
+			"configured": config.KeyType,
+			"loaded":     keyType,
+		}).Warn("Loaded private key does not match the configured key type.")
 	}
 
-	return nil
+	return privateKey, keyType, created, nil
 }
 
-func loadLocalKey(config *Config) error {
-	if !config.fileExists(keyFilename) {
-		var err error
-		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			return err
-		}
-		keyOut := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-
-		keyFile, err := os.Create(config.filePath(keyFilename))
-		if err != nil {
-			return err
+// loadLocalCert parses and validates the stored certificate (see validateStoredCertificate).
+// If no certificate is stored (or the stored certificate is invalid and enroll is set),
+// a certificate is requested from the PKI and returned PEM encoded to be stored.
+func loadLocalCert(ctx context.Context, config *Config, authority certificateAuthority, material *KeyMaterial, stored []byte, enroll bool) (*x509.Certificate, []byte, error) {
+	if stored != nil {
+		certificate, err := parseStoredCertificate(certFilename, stored)
+		if err == nil {
+			err = validateStoredCertificate(config, certificate, material)
 		}
-		_, err = keyFile.Write(keyOut)
-		if err != nil {
-			return err
+		if err == nil {
+			return certificate, nil, nil
 		}
-		err = keyFile.Close()
-		if err != nil {
-			return err
-		}
-	} else {
-		keyPEMBlock, err := os.ReadFile(config.filePath(keyFilename))
-		if err != nil {
-			return err
+		if !enroll {
+			return nil, nil, err
 		}
 
-		keyBlock, _ := pem.Decode(keyPEMBlock)
-		privateKey, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
-		if err != nil {
-			return err
-		}
+		logrus.WithError(err).Warn("Stored certificate is invalid, requesting a new certificate.")
 	}
 
-	return nil
+	certificate, err := requestCertificate(ctx, config, authority, material)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certificate, encodeCertificate(certificate), nil
 }
 
-func loadLocalCert(config *Config) error {
-	if !config.fileExists(certFilename) {
-		csr := x509.CertificateRequest{
-			Subject: pkix.Name{
-				Organization: []string{"WirePact PKI", "Translator"},
-				CommonName:   config.CertificateCommonName,
-			},
-			SignatureAlgorithm: x509.SHA256WithRSA,
-		}
+// validateStoredCertificate checks that the certificate matches the private key,
+// is signed by the CA, is currently valid and contains the configured common name
+// and SANs (such that a changed config leads to a new certificate).
+func validateStoredCertificate(config *Config, certificate *x509.Certificate, material *KeyMaterial) error {
+	err := validateCertificate(certificate, material.PrivateKey, material.CA)
+	if err != nil {
+		return err
+	}
 
-		csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &csr, privateKey)
-		if err != nil {
-			return err
-		}
+	if config.CertificateCommonName != "" && certificate.Subject.CommonName != config.CertificateCommonName {
+		return fmt.Errorf("certificate common name %q does not match %q",
+			certificate.Subject.CommonName, config.CertificateCommonName)
+	}
 
-		csrBuffer := &bytes.Buffer{}
-		err = pem.Encode(csrBuffer, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
-		if err != nil {
-			return err
+	for _, dnsName := range config.CertificateDNSNames {
+		if !containsString(certificate.DNSNames, dnsName) {
+			return fmt.Errorf("certificate does not contain the dns name %q", dnsName)
 		}
+	}
 
-		response, err := http.Post(config.csrAddress(), "application/pkcs10", csrBuffer)
-		if err != nil {
-			return err
+	for _, ipAddress := range config.CertificateIPAddresses {
+		if !containsIP(certificate.IPAddresses, ipAddress) {
+			return fmt.Errorf("certificate does not contain the ip address %v", ipAddress)
 		}
+	}
 
-		certFile, err := os.Create(config.filePath(certFilename))
-		if err != nil {
-			return err
-		}
+	if config.SPIFFEID != "" && SPIFFEID(certificate) != config.SPIFFEID {
+		return fmt.Errorf("certificate does not contain the spiffe id %q", config.SPIFFEID)
+	}
 
-		_, err = certFile.ReadFrom(response.Body)
-		if err != nil {
-			return err
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
-		err = certFile.Close()
-		if err != nil {
-			return err
+	}
+	return false
+}
+
+func containsIP(values []net.IP, value net.IP) bool {
+	for _, v := range values {
+		if v.Equal(value) {
+			return true
 		}
-		err = response.Body.Close()
+	}
+	return false
+}
+
+// requestCertificate sends a CSR for the private key of the key material to
+// the PKI (or the DevCA) and returns the validated certificate (see Client.SignCSR).
+func requestCertificate(ctx context.Context, config *Config, authority certificateAuthority, material *KeyMaterial) (*x509.Certificate, error) {
+	csr := x509.CertificateRequest{
+		Subject: pkix.Name{
+			Organization: config.certificateOrganization(),
+			CommonName:   config.CertificateCommonName,
+		},
+		DNSNames:           config.CertificateDNSNames,
+		IPAddresses:        config.CertificateIPAddresses,
+		SignatureAlgorithm: material.KeyType.csrSignatureAlgorithm(),
+	}
+
+	if config.SPIFFEID != "" {
+		spiffeID, err := ParseSPIFFEID(config.SPIFFEID)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		csr.URIs = []*url.URL{spiffeID}
 	}
 
-	certPEMBlock, err := os.ReadFile(config.filePath(certFilename))
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &csr, material.PrivateKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	csrPEMBlock := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+
+	return authority.SignCSR(ctx, csrPEMBlock, material.PrivateKey, material.CA)
+}
+
+// parseStoredCertificate parses the first PEM encoded certificate of the stored entry.
+func parseStoredCertificate(name string, certPEMBlock []byte) (*x509.Certificate, error) {
 	certBlock, _ := pem.Decode(certPEMBlock)
-	certificate, err = x509.ParseCertificate(certBlock.Bytes)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%v does not contain a pem encoded certificate", name)
+	}
+
+	certificate, err := x509.ParseCertificate(certBlock.Bytes)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%v: %w", name, err)
 	}
 
-	return nil
+	return certificate, nil
 }
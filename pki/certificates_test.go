@@ -0,0 +1,175 @@
+package pki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+// resetKeyMaterial removes the key material of EnsureKeyMaterial.
+func resetKeyMaterial() {
+	defaultProviderMutex.Lock()
+	defer defaultProviderMutex.Unlock()
+	defaultProvider = nil
+}
+
+func TestDeprecatedFunctionsWithoutProvider(t *testing.T) {
+	resetKeyMaterial()
+
+	if GetKeyMaterial() != nil {
+		t.Fatal("key material without provider")
+	}
+	if GetPrivateKey() != nil || GetSigningKey() != nil || GetKeyType() != "" {
+		t.Fatal("private key without provider")
+	}
+	if GetCA() != nil || GetCertificate() != nil {
+		t.Fatal("certificates without provider")
+	}
+	if x5c, x5t := GetJWTCertificateHeaders(); x5c != nil || x5t != "" {
+		t.Fatalf("jwt headers without provider: %v %q", x5c, x5t)
+	}
+}
+
+func TestDeprecatedFunctionsUseEnsuredKeyMaterial(t *testing.T) {
+	err := EnsureKeyMaterial(withTestPKI(&Config{
+		Store:                 NewMemoryStore(),
+		CertificateCommonName: "translator",
+		KeyType:               KeyTypeRSA,
+	}, pkitest.NewPKI(t, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(resetKeyMaterial)
+
+	material := GetKeyMaterial()
+	if material == nil || material.Certificate == nil {
+		t.Fatal("key material of EnsureKeyMaterial is not returned")
+	}
+	if GetPrivateKey() == nil || GetSigningKey() != material.PrivateKey || GetKeyType() != KeyTypeRSA {
+		t.Fatal("private key of EnsureKeyMaterial is not returned")
+	}
+	if !GetCA().Equal(material.CA) || !GetCertificate().Equal(material.Certificate) {
+		t.Fatal("certificates of EnsureKeyMaterial are not returned")
+	}
+
+	x5c, x5t := GetJWTCertificateHeaders()
+	expectedX5C, expectedX5T := material.JWTCertificateHeaders()
+	if len(x5c) != len(expectedX5C) || x5t != expectedX5T {
+		t.Fatal("jwt headers of EnsureKeyMaterial are not returned")
+	}
+}
+
+func TestStoredKeyMaterialIsValidated(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+
+	// issue replaces the stored certificate with a certificate for the stored key.
+	issue := func(t *testing.T, store Store, ca *pkitest.CA, notAfter time.Time) {
+		t.Helper()
+		entries, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := parsePrivateKey(entries[keyFilename])
+		if err != nil {
+			t.Fatal(err)
+		}
+		certificate := ca.Issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: "translator"},
+			NotBefore:    time.Now().Add(-2 * time.Hour),
+			NotAfter:     notAfter,
+		}, key.Public())
+		err = store.Save(map[string][]byte{certFilename: encodeCertificate(certificate)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		change func(t *testing.T, store Store)
+	}{
+		{
+			name: "certificate of another key",
+			change: func(t *testing.T, store Store) {
+				key, err := KeyTypeECDSAP256.generate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				keyPEMBlock, err := encodePrivateKey(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = store.Save(map[string][]byte{keyFilename: keyPEMBlock}); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "invalid private key",
+			change: func(t *testing.T, store Store) {
+				if err := store.Save(map[string][]byte{keyFilename: []byte("invalid")}); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "expired certificate",
+			change: func(t *testing.T, store Store) {
+				issue(t, store, testPKI.CA(), time.Now().Add(-time.Hour))
+			},
+		},
+		{
+			name: "certificate of another ca",
+			change: func(t *testing.T, store Store) {
+				issue(t, store, pkitest.NewCA(t, "other", nil), time.Now().Add(time.Hour))
+			},
+		},
+		{
+			name:   "changed common name",
+			config: Config{CertificateCommonName: "other"},
+		},
+		{
+			name:   "changed dns names",
+			config: Config{CertificateDNSNames: []string{"translator.local"}},
+		},
+		{
+			name:   "changed spiffe id",
+			config: Config{SPIFFEID: "spiffe://example.org/translator"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			initial := newTestProvider(t, &Config{Store: store}, testPKI).KeyMaterial()
+			if test.change != nil {
+				test.change(t, store)
+			}
+
+			config := test.config
+			config.Store = store
+
+			// Without enrollment, the invalid key material is an error.
+			loaded := NewKeyMaterialProvider(withTestPKI(&config, testPKI))
+			if loaded.Load() == nil {
+				t.Fatal("invalid key material was loaded")
+			}
+
+			// With enrollment, a new certificate is requested.
+			enrolled := newTestProvider(t, &config, testPKI).KeyMaterial()
+			if enrolled.Certificate.Equal(initial.Certificate) {
+				t.Fatal("invalid certificate was kept")
+			}
+			err := validateStoredCertificate(&config, enrolled.Certificate, enrolled)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHTTPTimeout       = 10 * time.Second
+	defaultRequestRetries    = 3
+	defaultRequestRetryDelay = 500 * time.Millisecond
+	maxResponseSize          = 1 << 20
+)
+
+// certificateContentTypes are the accepted content types of PKI responses.
+// An empty content type is accepted as well.
+var certificateContentTypes = map[string]bool{
+	"application/x-pem-file":            true,
+	"application/pem-certificate-chain": true,
+	"application/x-x509-ca-cert":        true,
+	"application/x-x509-user-cert":      true,
+	"application/pkix-cert":             true,
+	"application/pkix-crl":              true,
+	"application/octet-stream":          true,
+	"text/plain":                        true,
+}
+
+// Client communicates with the (WirePact-)PKI. Failed requests (network
+// errors, 5xx and 429 responses) are retried with an exponential backoff.
+// Responses are checked for the status code, the content type and the size.
+//
+// CSR requests contain the bootstrap token of the config as bearer token.
+type Client struct {
+	config     *Config
+	httpClient *http.Client
+
+	// The error of the http client creation (e.g. an invalid TLS configuration).
+	// It is returned for all requests.
+	err error
+}
+
+// NewClient creates a client for the PKI of the given config.
+// If the config contains no HTTPClient, a client with a timeout of 10 seconds
+// and the TLS options of the config is used. If the TLS options are invalid,
+// all requests of the client fail.
+func NewClient(config *Config) *Client {
+	httpClient, err := config.newHTTPClient()
+	return &Client{
+		config:     config,
+		httpClient: httpClient,
+		err:        err,
+	}
+}
+
+// WithHTTPClient sets the http client that is used for the requests to the PKI.
+func (client *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	client.httpClient = httpClient
+	client.err = nil
+	return client
+}
+
+// FetchCA fetches the CA certificate from the CA endpoint of the PKI.
+// The certificate must be a valid CA certificate.
+func (client *Client) FetchCA(ctx context.Context) (*x509.Certificate, error) {
+	body, err := client.do(ctx, http.MethodGet, client.config.caAddress(), "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := parseCertificate(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ca certificate from pki: %w", err)
+	}
+
+	err = validateCA(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+// FetchCABundle fetches all certificates from the CA endpoint of the PKI.
+func (client *Client) FetchCABundle(ctx context.Context) ([]byte, error) {
+	return client.do(ctx, http.MethodGet, client.config.caAddress(), "", "", nil)
+}
+
+// FetchCRL fetches the (PEM or DER encoded) certificate revocation list from the PKI.
+func (client *Client) FetchCRL(ctx context.Context) ([]byte, error) {
+	return client.do(ctx, http.MethodGet, client.config.crlAddress(), "", "", nil)
+}
+
+// SignCSR sends the PEM encoded CSR to the PKI and returns the signed certificate.
+// The certificate must match the private key and must be signed by the CA.
+func (client *Client) SignCSR(ctx context.Context, csrPEMBlock []byte, privateKey crypto.Signer, ca *x509.Certificate) (*x509.Certificate, error) {
+	token, err := client.config.bootstrapToken()
+	if err != nil {
+		return nil, fmt.Errorf("could not read bootstrap token: %w", err)
+	}
+	if token != "" && strings.HasPrefix(client.config.csrAddress(), "http://") {
+		logrus.Warn("The bootstrap token is sent to the PKI without TLS.")
+	}
+
+	body, err := client.do(ctx, http.MethodPost, client.config.csrAddress(), "application/pkcs10", token, csrPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := parseCertificate(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate from pki: %w", err)
+	}
+
+	err = validateCertificate(certificate, privateKey, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	return certificate, nil
+}
+
+// do executes the request and retries it with an exponential backoff
+// if the PKI is not reachable or returns a temporary error.
+func (client *Client) do(ctx context.Context, method string, url string, contentType string, token string, body []byte) ([]byte, error) {
+	if client.err != nil {
+		return nil, client.err
+	}
+
+	retries := client.config.requestRetries()
+	delay := client.config.requestRetryDelay()
+
+	for attempt := 0; ; attempt++ {
+		responseBody, retry, err := client.doOnce(ctx, method, url, contentType, token, body)
+		if err == nil {
+			return responseBody, nil
+		}
+		if !retry || attempt >= retries {
+			return nil, err
+		}
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"url":      url,
+			"attempt":  attempt + 1,
+			"retry_in": delay,
+		}).Debug("PKI request failed, retrying.")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// doOnce executes the request and returns the response body.
+// The returned bool defines if the request may be retried.
+func (client *Client) doOnce(ctx context.Context, method string, url string, contentType string, token string, body []byte) ([]byte, bool, error) {
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return nil, ctx.Err() == nil && !isCertificateError(err), err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("pki returned status %v for %v %v", response.Status, method, url)
+	}
+
+	if value := response.Header.Get("Content-Type"); value != "" {
+		mediaType, _, err := mime.ParseMediaType(value)
+		if err != nil || !certificateContentTypes[mediaType] {
+			return nil, false, fmt.Errorf("pki returned unexpected content type %q for %v %v", value, method, url)
+		}
+	}
+
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, true, err
+	}
+	if len(responseBody) > maxResponseSize {
+		return nil, false, fmt.Errorf("pki response for %v %v exceeds %v bytes", method, url, maxResponseSize)
+	}
+
+	return responseBody, false, nil
+}
+
+// isCertificateError checks if the TLS certificate of the PKI was rejected.
+// Such errors are not temporary and therefore not retried.
+func isCertificateError(err error) bool {
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var certificateInvalidError x509.CertificateInvalidError
+	var hostnameError x509.HostnameError
+	return errors.As(err, &unknownAuthorityError) ||
+		errors.As(err, &certificateInvalidError) ||
+		errors.As(err, &hostnameError)
+}
+
+// parseCertificate parses the first certificate of the PEM or DER encoded data.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("empty certificate")
+	}
+
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		return nil, errors.New("no pem encoded certificate found")
+	}
+
+	return x509.ParseCertificate(data)
+}
+
+func encodeCertificate(certificate *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+}
+
+func validateCA(ca *x509.Certificate) error {
+	if !ca.BasicConstraintsValid || !ca.IsCA {
+		return errors.New("certificate from pki is not a ca certificate")
+	}
+
+	return validateValidity(ca)
+}
+
+// validateCertificate checks that the certificate belongs to the private key,
+// is signed by the CA and is currently valid.
+func validateCertificate(certificate *x509.Certificate, privateKey crypto.Signer, ca *x509.Certificate) error {
+	publicKey, ok := privateKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(certificate.PublicKey) {
+		return errors.New("certificate does not match the private key")
+	}
+
+	err := certificate.CheckSignatureFrom(ca)
+	if err != nil {
+		return fmt.Errorf("certificate is not signed by the ca: %w", err)
+	}
+
+	return validateValidity(certificate)
+}
+
+func validateValidity(certificate *x509.Certificate) error {
+	now := time.Now()
+	if now.After(certificate.NotAfter) {
+		return fmt.Errorf("certificate %v expired at %v", certificate.Subject, certificate.NotAfter)
+	}
+	if now.Before(certificate.NotBefore) {
+		return fmt.Errorf("certificate %v is not valid before %v", certificate.Subject, certificate.NotBefore)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+// newTestClient creates a client for the handler, which is served in front of the PKI.
+func newTestClient(t *testing.T, testPKI *pkitest.PKI, handler http.HandlerFunc) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	config := withTestPKI(&Config{}, testPKI)
+	config.BaseAddress = server.URL
+	config.RequestRetries = 3
+	config.RequestRetryDelay = time.Millisecond
+	return NewClient(config)
+}
+
+func TestClientRetriesTemporaryErrors(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadGateway}
+
+	var attempts int32
+	client := newTestClient(t, testPKI, func(writer http.ResponseWriter, request *http.Request) {
+		attempt := atomic.AddInt32(&attempts, 1)
+		if int(attempt) <= len(statuses) {
+			writer.WriteHeader(statuses[attempt-1])
+			return
+		}
+		testPKI.ServeHTTP(writer, request)
+	})
+
+	ca, err := client.FetchCA(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Equal(testPKI.CA().Certificate) {
+		t.Fatal("fetched wrong ca certificate")
+	}
+	if attempts != 4 {
+		t.Fatalf("expected 4 attempts, got %v", attempts)
+	}
+}
+
+func TestClientRetriesAreLimited(t *testing.T) {
+	var attempts int32
+	client := newTestClient(t, pkitest.NewPKI(t, nil), func(writer http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		writer.WriteHeader(http.StatusInternalServerError)
+	})
+
+	_, err := client.FetchCA(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if attempts != 4 {
+		t.Fatalf("expected 4 attempts, got %v", attempts)
+	}
+}
+
+func TestClientDoesNotRetryPermanentErrors(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	leaf := testPKI.CA().Issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "not a ca"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, testPKI.CA().Key.Public())
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		err     string
+	}{
+		{
+			name: "client error",
+			handler: func(writer http.ResponseWriter, _ *http.Request) {
+				writer.WriteHeader(http.StatusForbidden)
+			},
+			err: "status 403",
+		},
+		{
+			name: "unexpected content type",
+			handler: func(writer http.ResponseWriter, _ *http.Request) {
+				writer.Header().Set("Content-Type", "text/html")
+				_, _ = writer.Write(testPKI.CA().PEM())
+			},
+			err: "unexpected content type",
+		},
+		{
+			name: "invalid certificate",
+			handler: func(writer http.ResponseWriter, _ *http.Request) {
+				writer.Header().Set("Content-Type", "application/x-pem-file")
+				_, _ = writer.Write([]byte("not a certificate"))
+			},
+			err: "invalid ca certificate",
+		},
+		{
+			name: "not a ca certificate",
+			handler: func(writer http.ResponseWriter, _ *http.Request) {
+				writer.Header().Set("Content-Type", "application/x-pem-file")
+				_, _ = writer.Write(encodeCertificate(leaf))
+			},
+			err: "not a ca certificate",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			client := newTestClient(t, testPKI, func(writer http.ResponseWriter, request *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				test.handler(writer, request)
+			})
+
+			_, err := client.FetchCA(context.Background())
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+			if attempts != 1 {
+				t.Fatalf("expected a single attempt, got %v", attempts)
+			}
+		})
+	}
+}
+
+func TestClientLimitsResponseSize(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	bundle := testPKI.CA().PEM()
+
+	var attempts int32
+	client := newTestClient(t, testPKI, func(writer http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = writer.Write(bytes.Repeat(bundle, maxResponseSize/len(bundle)+1))
+	})
+
+	_, err := client.FetchCABundle(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected a size error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected a single attempt, got %v", attempts)
+	}
+
+	// A response of exactly the maximum size is accepted.
+	client = newTestClient(t, testPKI, func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = writer.Write(bytes.Repeat([]byte{'\n'}, maxResponseSize))
+	})
+	body, err := client.FetchCABundle(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != maxResponseSize {
+		t.Fatalf("expected %v bytes, got %v", maxResponseSize, len(body))
+	}
+}
+
+func TestClientSendsBootstrapToken(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+
+	var authorization atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == pkitest.CSRPath {
+			authorization.Store(request.Header.Get("Authorization"))
+		}
+		testPKI.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+
+	config := withTestPKI(&Config{
+		Store:                 NewMemoryStore(),
+		CertificateCommonName: "translator",
+		KeyType:               KeyTypeECDSAP256,
+		BootstrapToken:        "join-token",
+	}, testPKI)
+	config.BaseAddress = server.URL
+
+	err := NewKeyMaterialProvider(config).Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization.Load() != "Bearer join-token" {
+		t.Fatalf("unexpected authorization header %q", authorization.Load())
+	}
+}
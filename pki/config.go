@@ -1,15 +1,28 @@
 package pki
 
 import (
+	"crypto/x509"
 	"fmt"
-	"os"
-	"path/filepath"
+	"net"
+	"net/http"
+	"time"
 )
 
 // Config contains the information about the PKI.
 // It instructs the certificate methods on where to fetch
 // the CA certificate and where to send the CSR to.
 type Config struct {
+	// If set, a self-signed development CA (see DevCA) issues the certificate
+	// instead of the PKI, such that no PKI is needed to run the translator locally.
+	// The PKI options (BaseAddress and the TLS options) are ignored.
+	// NEVER use the DevMode in production.
+	DevMode bool
+
+	// The directory where the development CA is stored in DevMode. Translators
+	// that use the same directory share the CA and therefore trust each other.
+	// If omitted, an ephemeral in-memory CA is generated on every start.
+	DevCAPath string
+
 	// The base address (uri) of the PKI.
 	// This config is only compatible with the k8s-pki for WirePact
 	// (https://github.com/WirePact/k8s-pki).
@@ -21,13 +34,113 @@ type Config struct {
 	// The path of the CSR (http post) endpoint.
 	CSRPath string
 
+	// If set, defines the SHA-256 fingerprints (hex, optionally separated by colons)
+	// of the accepted CA certificates. A CA certificate that is not pinned is rejected.
+	// If omitted, the first CA certificate of the PKI is trusted (trust on first use).
+	// A CA which was accepted at runtime because it is cross-signed by the current
+	// CA (see DefaultKeyMaterialProvider.RefreshCA) is accepted on the next start,
+	// since the previous CAs are stored with the key material. A previous CA is no
+	// longer trusted once its overlap has passed, but it stays in the store as long
+	// as it links the current CA to a pinned CA.
+	CAFingerprints []string
+
+	// The interval in which the CA certificate is refreshed from the PKI (see
+	// DefaultKeyMaterialProvider.RefreshCA). If omitted, the CA is refreshed
+	// every hour. A negative value disables the refresh.
+	CARefreshInterval time.Duration
+
+	// The time in which both the current and a new CA certificate are trusted when
+	// the PKI rotates its CA. The certificate is re-enrolled with the new CA after
+	// the overlap (such that the peers trust the new CA in the meantime) and the
+	// previous CA stays trusted for the same time afterwards.
+	// If omitted, twice the CARefreshInterval is used.
+	CARotationOverlap time.Duration
+
+	// The http client for the requests to the PKI.
+	// If omitted, a client with a timeout of 10 seconds is used
+	// that is configured with the TLS options below.
+	HTTPClient *http.Client
+
+	// If set, defines the path to a PEM file with the CA certificates
+	// that are trusted for the TLS connection to the PKI.
+	// If omitted, the system roots are used.
+	TLSCAPath string
+
+	// If set, defines the paths to the PEM encoded client certificate and key
+	// that are presented to the PKI (mutual TLS). Both must be set together.
+	TLSCertPath string
+	TLSKeyPath  string
+
+	// The bootstrap (join) token that is sent as bearer token with CSR requests.
+	BootstrapToken string
+
+	// If set, the bootstrap token is read from the file for every CSR request
+	// (e.g. a mounted Kubernetes secret). Overrides BootstrapToken.
+	BootstrapTokenPath string
+
+	// The number of retries for failed requests to the PKI (network errors, 5xx
+	// and 429 responses). If omitted, requests are retried 3 times. A negative
+	// value disables the retries.
+	RequestRetries int
+
+	// The delay before the first retry of a failed request to the PKI.
+	// The delay is doubled for every further retry. If omitted, 500ms are used.
+	RequestRetryDelay time.Duration
+
+	// The path of the CRL (http get) endpoint. Only used by the RevocationChecker.
+	CRLPath string
+
+	// The interval in which the RevocationChecker refreshes the CRL.
+	// If omitted, the CRL is refreshed every 5 minutes.
+	CRLRefreshInterval time.Duration
+
+	// If set, the RevocationChecker accepts certificates when the CRL is stale
+	// (fail open). By default, certificates are rejected (fail closed).
+	CRLFailOpen bool
+
+	// The time before the certificate expires at which the renewal (DefaultKeyMaterialProvider.Watch)
+	// starts. If omitted, the certificate is renewed after two thirds of its validity.
+	RenewBefore time.Duration
+
+	// The interval after the first failed renewal attempt. The interval is doubled
+	// for every further failure (up to 5 minutes). If omitted, 10 seconds are used.
+	RenewalRetryInterval time.Duration
+
+	// The interval in which the store is polled for changed key material, e.g. files
+	// that were rotated by a secret manager (see DefaultKeyMaterialProvider.Reload).
+	// If omitted, the store is polled every 10 seconds. A negative value disables the polling.
+	ReloadInterval time.Duration
+
 	// If set, defines a relative or absolute path to a directory
 	// where the key material should be stored. If omitted, the current
 	// application execution directory is used.
 	LocalCertPath string
 
+	// The store for the key material (e.g. NewMemoryStore or a KubernetesSecretStore).
+	// If omitted, the key material is stored as files in the LocalCertPath (FileStore).
+	Store Store
+
 	// The name that should be set in the CSR as the common name for the translator.
 	CertificateCommonName string
+
+	// The organizations of the CSR subject.
+	// If omitted, "WirePact PKI" and "Translator" are used.
+	CertificateOrganization []string
+
+	// The DNS names (SANs) that are requested for the certificate.
+	CertificateDNSNames []string
+
+	// The IP addresses (SANs) that are requested for the certificate.
+	CertificateIPAddresses []net.IP
+
+	// The SPIFFE ID (URI SAN) that is requested for the certificate
+	// (e.g. "spiffe://cluster.local/ns/default/sa/app", see SPIFFEIDForServiceAccount).
+	SPIFFEID string
+
+	// The type of the private key that is generated for the translator.
+	// If omitted, an RSA-2048 key (KeyTypeRSA) is used. An existing key
+	// in LocalCertPath is used regardless of the configured type.
+	KeyType KeyType
 }
 
 func (config *Config) caAddress() string {
@@ -38,15 +151,67 @@ func (config *Config) csrAddress() string {
 	return fmt.Sprintf("%v%v", config.BaseAddress, config.CSRPath)
 }
 
-func (config *Config) fileExists(filename string) bool {
-	_, err := os.Stat(config.filePath(filename))
-	return err == nil
+func (config *Config) crlAddress() string {
+	return fmt.Sprintf("%v%v", config.BaseAddress, config.CRLPath)
+}
+
+func (config *Config) requestRetries() int {
+	if config.RequestRetries == 0 {
+		return defaultRequestRetries
+	}
+	if config.RequestRetries < 0 {
+		return 0
+	}
+	return config.RequestRetries
+}
+
+func (config *Config) requestRetryDelay() time.Duration {
+	if config.RequestRetryDelay == 0 {
+		return defaultRequestRetryDelay
+	}
+	return config.RequestRetryDelay
+}
+
+func (config *Config) crlRefreshInterval() time.Duration {
+	if config.CRLRefreshInterval == 0 {
+		return defaultCRLRefreshInterval
+	}
+	return config.CRLRefreshInterval
 }
 
-func (config *Config) filePath(filename string) string {
-	if config.LocalCertPath != "" {
-		return filepath.Join(config.LocalCertPath, filename)
+func (config *Config) renewalTime(certificate *x509.Certificate) time.Time {
+	if config.RenewBefore > 0 {
+		return certificate.NotAfter.Add(-config.RenewBefore)
 	}
 
-	return filename
+	validity := certificate.NotAfter.Sub(certificate.NotBefore)
+	return certificate.NotBefore.Add(validity * 2 / 3)
+}
+
+func (config *Config) renewalRetryInterval() time.Duration {
+	if config.RenewalRetryInterval == 0 {
+		return defaultRenewalRetryInterval
+	}
+	return config.RenewalRetryInterval
+}
+
+func (config *Config) reloadInterval() time.Duration {
+	if config.ReloadInterval == 0 {
+		return defaultReloadInterval
+	}
+	return config.ReloadInterval
+}
+
+func (config *Config) certificateOrganization() []string {
+	if len(config.CertificateOrganization) == 0 {
+		return []string{"WirePact PKI", "Translator"}
+	}
+	return config.CertificateOrganization
+}
+
+func (config *Config) store() Store {
+	if config.Store == nil {
+		return &FileStore{Dir: config.LocalCertPath}
+	}
+	return config.Store
 }
@@ -0,0 +1,262 @@
+package pki
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/serial"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	devCAFilename          = "wirepact-dev-ca.pem"
+	devCAValidity          = 365 * 24 * time.Hour
+	devCertificateValidity = 24 * time.Hour
+)
+
+// certificateAuthority issues the certificates of the translator
+// (the Client of the PKI or the DevCA).
+type certificateAuthority interface {
+	FetchCA(ctx context.Context) (*x509.Certificate, error)
+	SignCSR(ctx context.Context, csrPEMBlock []byte, privateKey crypto.Signer, ca *x509.Certificate) (*x509.Certificate, error)
+}
+
+// DevCA is a self-signed development CA that replaces the PKI (see Config.DevMode).
+// If a directory is given, the CA is stored in the directory and shared by all
+// translators that use the same directory. Otherwise, an ephemeral in-memory CA
+// is generated. The DevCA must never be used in production.
+type DevCA struct {
+	dir string
+
+	mutex sync.Mutex
+	cert  *x509.Certificate
+	key   crypto.Signer
+}
+
+// NewDevCA creates a development CA in the given directory (or in memory if the
+// directory is empty). The CA is loaded or generated on first use.
+func NewDevCA(dir string) *DevCA {
+	return &DevCA{dir: dir}
+}
+
+// FetchCA returns the certificate of the development CA.
+func (devCA *DevCA) FetchCA(_ context.Context) (*x509.Certificate, error) {
+	cert, _, err := devCA.load()
+	return cert, err
+}
+
+// SignCSR signs the PEM encoded CSR with the development CA. The certificate
+// contains the subject and the SANs of the CSR and is valid for 24 hours.
+func (devCA *DevCA) SignCSR(_ context.Context, csrPEMBlock []byte, privateKey crypto.Signer, ca *x509.Certificate) (*x509.Certificate, error) {
+	caCert, caKey, err := devCA.load()
+	if err != nil {
+		return nil, err
+	}
+
+	csrBlock, _ := pem.Decode(csrPEMBlock)
+	if csrBlock == nil {
+		return nil, errors.New("no pem encoded csr found")
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csr signature: %w", err)
+	}
+
+	serialNumber, err := serial.Random()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(devCertificateValidity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		URIs:         csr.URIs,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateCertificate(certificate, privateKey, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	return certificate, nil
+}
+
+// load returns the CA certificate and key. They are generated (and stored
+// in the directory, if any) on the first call.
+func (devCA *DevCA) load() (*x509.Certificate, crypto.Signer, error) {
+	devCA.mutex.Lock()
+	defer devCA.mutex.Unlock()
+
+	if devCA.cert != nil {
+		return devCA.cert, devCA.key, nil
+	}
+
+	var err error
+	if devCA.dir == "" {
+		devCA.cert, devCA.key, err = generateDevCA()
+	} else {
+		devCA.cert, devCA.key, err = loadOrCreateDevCA(filepath.Join(devCA.dir, devCAFilename))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"dir":         devCA.dir,
+		"fingerprint": CAFingerprint(devCA.cert),
+	}).Warn("!!! The translator uses a self-signed DEVELOPMENT CA instead of a PKI. This is NOT secure and must NOT be used in production !!!")
+
+	return devCA.cert, devCA.key, nil
+}
+
+// loadOrCreateDevCA loads the CA from the file. If the file does not exist, a CA
+// is generated and linked into place, such that concurrently starting translators
+// agree on the same CA.
+func loadOrCreateDevCA(filename string) (*x509.Certificate, crypto.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = createDevCAFile(filename)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, rest := pem.Decode(data)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("no pem encoded certificate found in %v", filename)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := parsePrivateKey(rest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid private key in %v: %w", filename, err)
+	}
+
+	err = validateValidity(cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid development ca (delete %v to generate a new one): %w", filename, err)
+	}
+
+	return cert, key, nil
+}
+
+func createDevCAFile(filename string) ([]byte, error) {
+	cert, key, err := generateDevCA()
+	if err != nil {
+		return nil, err
+	}
+
+	keyOut, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := append(encodeCertificate(cert), keyOut...)
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike a rename, the link fails if another translator created the CA in the meantime.
+	err = os.Link(file.Name(), filename)
+	if errors.Is(err, os.ErrExist) {
+		return os.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func generateDevCA() (*x509.Certificate, crypto.Signer, error) {
+	key, err := KeyTypeECDSAP256.generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := serial.Random()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"WirePact PKI"},
+			CommonName:   "WirePact Development CA",
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(devCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
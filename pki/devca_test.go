@@ -0,0 +1,68 @@
+package pki
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newDevProvider(name string, dir string) *DefaultKeyMaterialProvider {
+	return NewKeyMaterialProvider(&Config{
+		DevMode:               true,
+		DevCAPath:             dir,
+		Store:                 NewMemoryStore(),
+		CertificateCommonName: name,
+		KeyType:               KeyTypeECDSAP256,
+	})
+}
+
+func TestDevCASharedByConcurrentProviders(t *testing.T) {
+	// The race is repeated a few times, since both providers must create the CA.
+	for i := 0; i < 10; i++ {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			dir := t.TempDir()
+			providers := []*DefaultKeyMaterialProvider{newDevProvider("translator-a", dir), newDevProvider("translator-b", dir)}
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(providers))
+			for i, provider := range providers {
+				wg.Add(1)
+				go func(i int, provider *DefaultKeyMaterialProvider) {
+					defer wg.Done()
+					errs[i] = provider.Ensure()
+				}(i, provider)
+			}
+			wg.Wait()
+
+			for _, err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			a, b := providers[0].KeyMaterial(), providers[1].KeyMaterial()
+			if !a.CA.Equal(b.CA) {
+				t.Fatal("providers use different development cas")
+			}
+			if err := b.Certificate.CheckSignatureFrom(a.CA); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDevCAWithoutDirectoryIsEphemeral(t *testing.T) {
+	a, b := newDevProvider("translator-a", ""), newDevProvider("translator-b", "")
+	for _, provider := range []*DefaultKeyMaterialProvider{a, b} {
+		if err := provider.Ensure(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if a.KeyMaterial().CA.Equal(b.KeyMaterial().CA) {
+		t.Fatal("providers without directory share a development ca")
+	}
+	if err := a.KeyMaterial().Certificate.CheckSignatureFrom(a.KeyMaterial().CA); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// KeyType defines the type of the private key that is generated
+// for the translator. The key type determines the signature algorithm
+// of the CSR and of the WirePact JWTs.
+type KeyType string
+
+const (
+	// KeyTypeRSA generates an RSA-2048 key. JWTs are signed with RS256.
+	KeyTypeRSA KeyType = "rsa"
+
+	// KeyTypeRSAPSS generates an RSA-2048 key. JWTs are signed with PS256.
+	KeyTypeRSAPSS KeyType = "rsa-pss"
+
+	// KeyTypeECDSAP256 generates an ECDSA key on the P-256 curve. JWTs are signed with ES256.
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+
+	// KeyTypeECDSAP384 generates an ECDSA key on the P-384 curve. JWTs are signed with ES384.
+	KeyTypeECDSAP384 KeyType = "ecdsa-p384"
+
+	// KeyTypeEd25519 generates an Ed25519 key. JWTs are signed with EdDSA.
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+func (keyType KeyType) generate() (crypto.Signer, error) {
+	switch keyType {
+	case "", KeyTypeRSA, KeyTypeRSAPSS:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+}
+
+// csrSignatureAlgorithm returns the signature algorithm for the CSR.
+// The zero value lets the x509 package choose the default for the key.
+func (keyType KeyType) csrSignatureAlgorithm() x509.SignatureAlgorithm {
+	if keyType == KeyTypeRSAPSS {
+		return x509.SHA256WithRSAPSS
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// keyTypeOf determines the key type of the given private key. Since
+// RSA and RSA-PSS keys cannot be distinguished, the configured type
+// decides which of them is used for RSA keys.
+func keyTypeOf(key crypto.Signer, configured KeyType) (KeyType, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if configured == KeyTypeRSAPSS {
+			return KeyTypeRSAPSS, nil
+		}
+		return KeyTypeRSA, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyTypeECDSAP256, nil
+		case elliptic.P384():
+			return KeyTypeECDSAP384, nil
+		}
+		return "", fmt.Errorf("unsupported ecdsa curve %v", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return KeyTypeEd25519, nil
+	default:
+		return "", fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), nil
+	default:
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+	}
+}
+
+func parsePrivateKey(keyPEMBlock []byte) (crypto.Signer, error) {
+	keyBlock, _ := pem.Decode(keyPEMBlock)
+	if keyBlock == nil {
+		return nil, errors.New("no pem encoded private key found")
+	}
+
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(keyBlock.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %q", keyBlock.Type)
+	}
+}
@@ -0,0 +1,246 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubernetesDefaultBaseURL     = "https://kubernetes.default.svc"
+	kubernetesSaveRetries        = 5
+)
+
+// KubernetesSecretStore stores the entries in the data of a Kubernetes
+// Secret. Updates use the resource version of the Secret (optimistic locking),
+// such that concurrent writers never overwrite each other. Updates only patch
+// the data, such that the labels, annotations and owner references of the Secret
+// are kept.
+type KubernetesSecretStore struct {
+	// The base URL of the Kubernetes API server.
+	BaseURL string
+
+	// The namespace and the name of the Secret.
+	Namespace string
+	Name      string
+
+	// The path of the file with the bearer token for the API server.
+	// The file is read for every request to support rotated tokens.
+	// If omitted, no token is sent.
+	TokenPath string
+
+	// The http client for the requests to the API server.
+	HTTPClient *http.Client
+}
+
+// NewInClusterKubernetesSecretStore creates a store for the Secret with the given name
+// that uses the service account of the pod. If the namespace is omitted, the
+// namespace of the service account is used.
+func NewInClusterKubernetesSecretStore(namespace string, name string) (*KubernetesSecretStore, error) {
+	if namespace == "" {
+		namespaceBytes, err := os.ReadFile(kubernetesServiceAccountPath + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("could not read the namespace of the service account: %w", err)
+		}
+		namespace = strings.TrimSpace(string(namespaceBytes))
+	}
+
+	caPEMBlock, err := os.ReadFile(kubernetesServiceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read the ca of the service account: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEMBlock) {
+		return nil, errors.New("the ca of the service account does not contain a pem encoded certificate")
+	}
+
+	baseURL := kubernetesDefaultBaseURL
+	if host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"); host != "" && port != "" {
+		baseURL = "https://" + net.JoinHostPort(host, port)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+
+	return &KubernetesSecretStore{
+		BaseURL:    baseURL,
+		Namespace:  namespace,
+		Name:       name,
+		TokenPath:  kubernetesServiceAccountPath + "/token",
+		HTTPClient: &http.Client{Timeout: defaultHTTPTimeout, Transport: transport},
+	}, nil
+}
+
+type kubernetesSecret struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Metadata   kubernetesMetadata `json:"metadata"`
+	Type       string             `json:"type,omitempty"`
+	Data       map[string][]byte  `json:"data,omitempty"`
+}
+
+type kubernetesMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// kubernetesSecretPatch is a JSON merge patch of the data of a Secret. The
+// resource version is a precondition of the patch.
+type kubernetesSecretPatch struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+var errKubernetesConflict = errors.New("secret was modified concurrently")
+
+// Load reads the data of the Secret. If the Secret does not exist, no entries are returned.
+func (store *KubernetesSecretStore) Load() (map[string][]byte, error) {
+	secret, err := store.get()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string][]byte{}
+	if secret != nil {
+		for name, data := range secret.Data {
+			entries[name] = data
+		}
+	}
+	return entries, nil
+}
+
+// Save merges the entries into the data of the Secret (which is created if it
+// does not exist). If the Secret was modified concurrently, the Secret is read
+// again and the update is retried.
+func (store *KubernetesSecretStore) Save(entries map[string][]byte) error {
+	for attempt := 0; ; attempt++ {
+		secret, err := store.get()
+		if err != nil {
+			return err
+		}
+
+		if secret == nil {
+			err = store.write(http.MethodPost, store.collectionURL(), "application/json", &kubernetesSecret{
+				APIVersion: "v1",
+				Kind:       "Secret",
+				Metadata:   kubernetesMetadata{Name: store.Name, Namespace: store.Namespace},
+				Type:       "Opaque",
+				Data:       entries,
+			})
+		} else {
+			patch := &kubernetesSecretPatch{Data: entries}
+			patch.Metadata.ResourceVersion = secret.Metadata.ResourceVersion
+			err = store.write(http.MethodPatch, store.secretURL(), "application/merge-patch+json", patch)
+		}
+		if errors.Is(err, errKubernetesConflict) && attempt < kubernetesSaveRetries {
+			time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+			continue
+		}
+		return err
+	}
+}
+
+func (store *KubernetesSecretStore) get() (*kubernetesSecret, error) {
+	response, err := store.do(http.MethodGet, store.secretURL(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, kubernetesError(response)
+	}
+
+	secret := &kubernetesSecret{}
+	err = json.NewDecoder(response.Body).Decode(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func (store *KubernetesSecretStore) write(method string, url string, contentType string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	response, err := store.do(method, url, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		// The resource version did not match (PATCH) or the Secret was created concurrently (POST).
+		return errKubernetesConflict
+	default:
+		return kubernetesError(response)
+	}
+}
+
+func (store *KubernetesSecretStore) do(method string, url string, contentType string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	if store.TokenPath != "" {
+		token, err := os.ReadFile(store.TokenPath)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	httpClient := store.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+
+	return httpClient.Do(request)
+}
+
+func (store *KubernetesSecretStore) collectionURL() string {
+	return fmt.Sprintf("%v/api/v1/namespaces/%v/secrets", strings.TrimSuffix(store.BaseURL, "/"), url.PathEscape(store.Namespace))
+}
+
+func (store *KubernetesSecretStore) secretURL() string {
+	return fmt.Sprintf("%v/%v", store.collectionURL(), url.PathEscape(store.Name))
+}
+
+func kubernetesError(response *http.Response) error {
+	status := struct {
+		Message string `json:"message"`
+	}{}
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if json.Unmarshal(body, &status) == nil && status.Message != "" {
+		return fmt.Errorf("kubernetes api returned status %v: %v", response.Status, status.Message)
+	}
+	return fmt.Errorf("kubernetes api returned status %v", response.Status)
+}
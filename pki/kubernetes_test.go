@@ -0,0 +1,273 @@
+package pki
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+const (
+	testSecretsPath = "/api/v1/namespaces/wirepact/secrets"
+	testSecretPath  = testSecretsPath + "/key-material"
+	testToken       = "service-account-token"
+)
+
+// fakeKubernetesAPI implements the Secret endpoints of the Kubernetes API
+// with resource version checks. The Secret is kept as JSON object, such that
+// the fields that are unknown to the store are kept as well.
+type fakeKubernetesAPI struct {
+	mutex           sync.Mutex
+	secret          map[string]interface{}
+	resourceVersion int
+}
+
+func (api *fakeKubernetesAPI) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	if request.Header.Get("Authorization") != "Bearer "+testToken {
+		writeKubernetesStatus(writer, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch {
+	case request.Method == http.MethodGet && request.URL.Path == testSecretPath:
+		if api.secret == nil {
+			writeKubernetesStatus(writer, http.StatusNotFound, `secrets "key-material" not found`)
+			return
+		}
+		_ = json.NewEncoder(writer).Encode(api.secret)
+	case request.Method == http.MethodPost && request.URL.Path == testSecretsPath:
+		if api.secret != nil {
+			writeKubernetesStatus(writer, http.StatusConflict, `secrets "key-material" already exists`)
+			return
+		}
+		secret := map[string]interface{}{}
+		if err := json.NewDecoder(request.Body).Decode(&secret); err != nil {
+			writeKubernetesStatus(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		api.store(writer, secret, http.StatusCreated)
+	case request.Method == http.MethodPatch && request.URL.Path == testSecretPath:
+		api.patch(writer, request)
+	default:
+		writeKubernetesStatus(writer, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// patch applies a JSON merge patch with the resource version as precondition.
+func (api *fakeKubernetesAPI) patch(writer http.ResponseWriter, request *http.Request) {
+	if request.Header.Get("Content-Type") != "application/merge-patch+json" {
+		writeKubernetesStatus(writer, http.StatusUnsupportedMediaType, "unsupported patch type")
+		return
+	}
+	if api.secret == nil {
+		writeKubernetesStatus(writer, http.StatusNotFound, `secrets "key-material" not found`)
+		return
+	}
+
+	patch := map[string]interface{}{}
+	if err := json.NewDecoder(request.Body).Decode(&patch); err != nil {
+		writeKubernetesStatus(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	metadata, _ := patch["metadata"].(map[string]interface{})
+	if metadata["resourceVersion"] != strconv.Itoa(api.resourceVersion) {
+		writeKubernetesStatus(writer, http.StatusConflict, "the object has been modified")
+		return
+	}
+
+	mergePatch(api.secret, patch)
+	api.store(writer, api.secret, http.StatusOK)
+}
+
+func (api *fakeKubernetesAPI) store(writer http.ResponseWriter, secret map[string]interface{}, status int) {
+	api.resourceVersion++
+	if _, ok := secret["metadata"].(map[string]interface{}); !ok {
+		secret["metadata"] = map[string]interface{}{}
+	}
+	secret["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(api.resourceVersion)
+	api.secret = secret
+
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(secret)
+}
+
+// mergePatch applies the JSON merge patch (RFC 7386) to the target.
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) {
+	for key, value := range patch {
+		patchObject, isObject := value.(map[string]interface{})
+		targetObject, targetIsObject := target[key].(map[string]interface{})
+		switch {
+		case value == nil:
+			delete(target, key)
+		case isObject && targetIsObject:
+			mergePatch(targetObject, patchObject)
+		default:
+			target[key] = value
+		}
+	}
+}
+
+func writeKubernetesStatus(writer http.ResponseWriter, status int, message string) {
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(map[string]string{"message": message})
+}
+
+func newTestKubernetesSecretStore(t *testing.T, api *fakeKubernetesAPI) *KubernetesSecretStore {
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenPath, []byte(testToken+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &KubernetesSecretStore{
+		BaseURL:   server.URL,
+		Namespace: "wirepact",
+		Name:      "key-material",
+		TokenPath: tokenPath,
+	}
+}
+
+func TestKubernetesSecretStoreCreatesAndMergesSecret(t *testing.T) {
+	api := &fakeKubernetesAPI{}
+	store := newTestKubernetesSecretStore(t, api)
+
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unexpected entries of a missing secret: %q", entries)
+	}
+
+	err = store.Save(map[string][]byte{caFilename: []byte("ca")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save(map[string][]byte{certFilename: []byte("cert"), keyFilename: []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entries[caFilename]) != "ca" || string(entries[certFilename]) != "cert" || string(entries[keyFilename]) != "key" {
+		t.Fatalf("unexpected entries: %q", entries)
+	}
+	metadata := api.secret["metadata"].(map[string]interface{})
+	if api.secret["kind"] != "Secret" || api.secret["type"] != "Opaque" || metadata["namespace"] != "wirepact" {
+		t.Fatalf("unexpected secret %+v", api.secret)
+	}
+}
+
+func TestKubernetesSecretStoreKeepsMetadata(t *testing.T) {
+	secret := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{
+		"apiVersion": "v1",
+		"kind": "Secret",
+		"metadata": {
+			"name": "key-material",
+			"namespace": "wirepact",
+			"resourceVersion": "0",
+			"labels": {"app": "translator"},
+			"annotations": {"example.com/owner": "platform"},
+			"ownerReferences": [{"apiVersion": "apps/v1", "kind": "Deployment", "name": "translator", "uid": "1234"}]
+		},
+		"type": "Opaque",
+		"data": {"other": "b3RoZXI="}
+	}`), &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeKubernetesAPI{secret: secret}
+	store := newTestKubernetesSecretStore(t, api)
+
+	err = store.Save(map[string][]byte{caFilename: []byte("ca")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := api.secret["metadata"].(map[string]interface{})
+	if !reflect.DeepEqual(metadata["labels"], map[string]interface{}{"app": "translator"}) ||
+		!reflect.DeepEqual(metadata["annotations"], map[string]interface{}{"example.com/owner": "platform"}) ||
+		len(metadata["ownerReferences"].([]interface{})) != 1 {
+		t.Fatalf("metadata of the secret was not kept: %+v", metadata)
+	}
+
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entries[caFilename]) != "ca" || string(entries["other"]) != "other" {
+		t.Fatalf("unexpected entries: %q", entries)
+	}
+}
+
+func TestKubernetesSecretStoreRetriesConflicts(t *testing.T) {
+	api := &fakeKubernetesAPI{}
+	store := newTestKubernetesSecretStore(t, api)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := store.Save(map[string][]byte{fmt.Sprintf("entry-%v", i): []byte(strconv.Itoa(i))})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if string(entries[fmt.Sprintf("entry-%v", i)]) != strconv.Itoa(i) {
+			t.Fatalf("concurrent save of entry %v was lost: %q", i, entries)
+		}
+	}
+}
+
+func TestKubernetesSecretStoreReturnsAPIErrors(t *testing.T) {
+	store := newTestKubernetesSecretStore(t, &fakeKubernetesAPI{})
+	err := os.WriteFile(store.TokenPath, []byte("expired"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Load()
+	if err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+}
+
+func TestKubernetesSecretStoreKeepsKeyMaterial(t *testing.T) {
+	api := &fakeKubernetesAPI{}
+	authority := pkitest.NewPKI(t, nil)
+	provider := newTestProvider(t, &Config{Store: newTestKubernetesSecretStore(t, api)}, authority)
+
+	// A restarted translator loads the key material from the secret.
+	restarted := newTestProvider(t, &Config{Store: newTestKubernetesSecretStore(t, api)}, authority)
+	if !restarted.KeyMaterial().Certificate.Equal(provider.KeyMaterial().Certificate) {
+		t.Fatal("restarted provider enrolled a new certificate")
+	}
+}
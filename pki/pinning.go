@@ -0,0 +1,343 @@
+package pki
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCARefreshInterval = time.Hour
+	trustedUntilHeader       = "Trusted-Until"
+)
+
+// CAFingerprint returns the SHA-256 fingerprint of the certificate in the
+// format of openssl (upper case hex with colons, e.g. "AB:CD:...").
+func CAFingerprint(certificate *x509.Certificate) string {
+	fingerprint := sha256.Sum256(certificate.Raw)
+	encoded := strings.ToUpper(hex.EncodeToString(fingerprint[:]))
+
+	pairs := make([]string, 0, len(encoded)/2)
+	for i := 0; i < len(encoded); i += 2 {
+		pairs = append(pairs, encoded[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// caPinned checks if the fingerprint of the CA is one of the CAFingerprints.
+func (config *Config) caPinned(ca *x509.Certificate) (bool, error) {
+	fingerprint := sha256.Sum256(ca.Raw)
+	for _, pinned := range config.CAFingerprints {
+		pinnedBytes, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(pinned), ":", ""))
+		if err != nil || len(pinnedBytes) != sha256.Size {
+			return false, fmt.Errorf("invalid ca fingerprint %q", pinned)
+		}
+		if string(pinnedBytes) == string(fingerprint[:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyCAPin returns an error if CAFingerprints are configured and the CA is
+// neither pinned nor cross-signed by a pinned CA over the chain of the previous
+// CAs (most recent first, see RefreshCA).
+func (config *Config) verifyCAPin(ca *x509.Certificate, previous []*trustedCA) error {
+	if len(config.CAFingerprints) == 0 {
+		return nil
+	}
+
+	certificate := ca
+	for i := 0; ; i++ {
+		pinned, err := config.caPinned(certificate)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			return nil
+		}
+
+		if i == len(previous) || certificate.CheckSignatureFrom(previous[i].certificate) != nil {
+			return fmt.Errorf("ca certificate %v with fingerprint %v is not pinned", ca.Subject, CAFingerprint(ca))
+		}
+		certificate = previous[i].certificate
+	}
+}
+
+func (config *Config) caRefreshInterval() time.Duration {
+	if config.CARefreshInterval == 0 {
+		return defaultCARefreshInterval
+	}
+	return config.CARefreshInterval
+}
+
+func (config *Config) caRotationOverlap() time.Duration {
+	if config.CARotationOverlap > 0 {
+		return config.CARotationOverlap
+	}
+
+	interval := config.caRefreshInterval()
+	if interval < 0 {
+		interval = defaultCARefreshInterval
+	}
+	return 2 * interval
+}
+
+// trustedCA is a previous CA certificate, which stays trusted until the overlap
+// of the CA rotation has passed. The previous CAs are stored (see caChainFilename),
+// such that a cross-signed CA is accepted on the next start. Afterwards, the CA
+// is only kept as link to a pinned CA (see caLineage).
+type trustedCA struct {
+	certificate  *x509.Certificate
+	trustedUntil time.Time
+}
+
+// caRotation is the state of the CA rotation of a DefaultKeyMaterialProvider.
+type caRotation struct {
+	// The accepted new CA, which is trusted but not used before the overlap has passed.
+	next      *x509.Certificate
+	nextSince time.Time
+
+	// The previous CAs, the most recent one first.
+	previous []*trustedCA
+}
+
+// RefreshCA fetches the CA certificate from the PKI. A new CA is only accepted
+// if it is pinned (see Config.CAFingerprints) or cross-signed by the current CA.
+// An accepted CA is trusted immediately, but the certificate is only re-enrolled
+// with it after the CARotationOverlap (by Watch), such that the peers trust the new
+// CA in the meantime. Afterwards, the previous CA stays trusted for the same overlap.
+// If any error occurs, the current key material stays active.
+func (provider *DefaultKeyMaterialProvider) RefreshCA() error {
+	current := provider.KeyMaterial()
+	if current == nil {
+		return errors.New("no key material loaded to refresh the ca")
+	}
+
+	ca, err := provider.authority.FetchCA(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if ca.Equal(current.CA) {
+		return nil
+	}
+
+	provider.mutex.RLock()
+	next := provider.rotation.next
+	provider.mutex.RUnlock()
+	if next != nil && next.Equal(ca) {
+		return nil
+	}
+
+	pinned, err := provider.config.caPinned(ca)
+	if err != nil {
+		return err
+	}
+	if !pinned {
+		err = ca.CheckSignatureFrom(current.CA)
+		if err != nil {
+			return fmt.Errorf("new ca certificate %v with fingerprint %v is neither pinned nor cross-signed by the current ca: %w",
+				ca.Subject, CAFingerprint(ca), err)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"subject":     ca.Subject,
+		"fingerprint": CAFingerprint(ca),
+		"overlap":     provider.config.caRotationOverlap(),
+	}).Info("Accepted new PKI CA certificate, it is used after the overlap.")
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.rotation.next = ca
+	provider.rotation.nextSince = time.Now()
+	provider.current = provider.withTrustedCAs(provider.current)
+
+	return nil
+}
+
+// rotateCA re-enrolls the certificate with the accepted new CA once the overlap
+// has passed and stops trusting the previous CAs whose overlap has passed. These
+// are removed from the store unless they link the current CA to a pinned CA.
+func (provider *DefaultKeyMaterialProvider) rotateCA() error {
+	provider.mutex.RLock()
+	next, nextSince := provider.rotation.next, provider.rotation.nextSince
+	provider.mutex.RUnlock()
+
+	if next != nil && time.Since(nextSince) >= provider.config.caRotationOverlap() {
+		err := provider.renew(next)
+		if err != nil {
+			return err
+		}
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.current = provider.withTrustedCAs(provider.current)
+	if provider.current == nil {
+		return nil
+	}
+
+	previous := provider.config.caLineage(provider.current.CA, provider.rotation.previous)
+	if len(previous) == len(provider.rotation.previous) {
+		return nil
+	}
+	provider.rotation.previous = previous
+
+	err := provider.config.store().Save(map[string][]byte{caChainFilename: encodeCAChain(previous)})
+	if err != nil {
+		return fmt.Errorf("could not store the ca chain: %w", err)
+	}
+
+	return nil
+}
+
+// caLineage returns the previous CAs of the chain that are kept: the CAs whose
+// overlap has not passed yet and the CAs that link the CA to the first pinned CA
+// of the chain (see verifyCAPin). The link is kept if the overlap has passed,
+// since the expiry of the overlap only ends the trust and not the descent.
+func (config *Config) caLineage(ca *x509.Certificate, chain []*trustedCA) []*trustedCA {
+	links := 0
+	if pinned, err := config.caPinned(ca); len(config.CAFingerprints) > 0 && (err != nil || !pinned) {
+		links = len(chain)
+		for i, previous := range chain {
+			if pinned, err = config.caPinned(previous.certificate); err == nil && pinned {
+				links = i + 1
+				break
+			}
+		}
+	}
+
+	var kept []*trustedCA
+	for i, previous := range chain {
+		if i < links || previous.trustedUntil.After(time.Now()) {
+			kept = append(kept, previous)
+		}
+	}
+	return kept
+}
+
+// nextCARotation returns the time until the next step of the CA rotation
+// (at most the given interval).
+func (provider *DefaultKeyMaterialProvider) nextCARotation(interval time.Duration) time.Duration {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+
+	deadlines := make([]time.Time, 0, len(provider.rotation.previous)+1)
+	if provider.rotation.next != nil {
+		deadlines = append(deadlines, provider.rotation.nextSince.Add(provider.config.caRotationOverlap()))
+	}
+	for _, previous := range provider.rotation.previous {
+		deadlines = append(deadlines, previous.trustedUntil)
+	}
+
+	for _, deadline := range deadlines {
+		if wait := time.Until(deadline); wait > 0 && wait < interval {
+			interval = wait
+		}
+	}
+	return interval
+}
+
+// withTrustedCAs returns the key material with the CAs of the rotation in
+// the Bundle (in addition to the CA). The mutex must be held.
+func (provider *DefaultKeyMaterialProvider) withTrustedCAs(material *KeyMaterial) *KeyMaterial {
+	if material == nil {
+		return nil
+	}
+
+	roots := []*x509.Certificate{material.CA}
+	if next := provider.rotation.next; next != nil && !next.Equal(material.CA) {
+		roots = append(roots, next)
+	}
+	for _, previous := range provider.rotation.previous {
+		if previous.trustedUntil.After(time.Now()) && !previous.certificate.Equal(material.CA) {
+			roots = append(roots, previous.certificate)
+		}
+	}
+
+	trusted := *material
+	trusted.Bundle = nil
+	if len(roots) > 1 {
+		trusted.Bundle = roots
+	}
+	return &trusted
+}
+
+// watchCA refreshes the CA in the configured CARefreshInterval and advances
+// the CA rotation until the context is done.
+func (provider *DefaultKeyMaterialProvider) watchCA(ctx context.Context) {
+	interval := provider.config.caRefreshInterval()
+	if interval < 0 {
+		return
+	}
+
+	refreshed := time.Time{}
+	for {
+		if time.Since(refreshed) >= interval {
+			refreshed = time.Now()
+			err := provider.RefreshCA()
+			if err != nil {
+				logrus.WithError(err).Warn("Could not refresh PKI CA certificate.")
+			}
+		}
+
+		err := provider.rotateCA()
+		if err != nil {
+			logrus.WithError(err).Warn("Could not re-enroll the certificate with the new PKI CA certificate.")
+		}
+
+		if !sleep(ctx, provider.nextCARotation(interval-time.Since(refreshed))) {
+			return
+		}
+	}
+}
+
+// parseCAChain parses the stored previous CAs. Every certificate carries the
+// time until it is trusted in the "Trusted-Until" header.
+func parseCAChain(stored []byte) ([]*trustedCA, error) {
+	var chain []*trustedCA
+	for rest := stored; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return chain, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", caChainFilename, err)
+		}
+		trustedUntil, err := time.Parse(time.RFC3339, block.Headers[trustedUntilHeader])
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid %v header: %w", caChainFilename, trustedUntilHeader, err)
+		}
+
+		chain = append(chain, &trustedCA{certificate: certificate, trustedUntil: trustedUntil})
+	}
+}
+
+// encodeCAChain encodes the previous CAs for the store (see parseCAChain).
+func encodeCAChain(chain []*trustedCA) []byte {
+	var out []byte
+	for _, previous := range chain {
+		out = append(out, pem.EncodeToMemory(&pem.Block{
+			Type:    "CERTIFICATE",
+			Headers: map[string]string{trustedUntilHeader: previous.trustedUntil.UTC().Format(time.RFC3339)},
+			Bytes:   previous.certificate.Raw,
+		})...)
+	}
+	return out
+}
@@ -0,0 +1,241 @@
+package pki
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+// trusts checks if the CA is one of the trusted roots of the key material.
+func trusts(material *KeyMaterial, ca *pkitest.CA) bool {
+	for _, root := range material.Roots() {
+		if root.Equal(ca.Certificate) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRefreshCAOverlapsCrossSignedCA(t *testing.T) {
+	oldCA := pkitest.NewCA(t, "old", nil)
+	newCA := pkitest.NewCA(t, "new", oldCA)
+	authority := pkitest.NewPKI(t, oldCA)
+	store := NewMemoryStore()
+	config := &Config{
+		Store:             store,
+		CAFingerprints:    []string{CAFingerprint(oldCA.Certificate)},
+		CARotationOverlap: time.Hour,
+	}
+	provider := newTestProvider(t, config, authority)
+	enrolled := provider.KeyMaterial().Certificate
+
+	authority.Rotate(newCA)
+	err := provider.RefreshCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new CA is trusted, but the certificate is not re-enrolled before the overlap has passed.
+	material := provider.KeyMaterial()
+	if !material.CA.Equal(oldCA.Certificate) || !material.Certificate.Equal(enrolled) {
+		t.Fatal("certificate was re-enrolled before the overlap")
+	}
+	if !trusts(material, oldCA) || !trusts(material, newCA) {
+		t.Fatal("old and new ca are not trusted during the overlap")
+	}
+
+	err = provider.rotateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !provider.KeyMaterial().CA.Equal(oldCA.Certificate) {
+		t.Fatal("certificate was re-enrolled before the overlap")
+	}
+
+	provider.mutex.Lock()
+	provider.rotation.nextSince = time.Now().Add(-2 * time.Hour)
+	provider.mutex.Unlock()
+
+	err = provider.rotateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After the overlap, the certificate is issued by the new CA and the old CA is still trusted.
+	material = provider.KeyMaterial()
+	if !material.CA.Equal(newCA.Certificate) || material.Certificate.CheckSignatureFrom(newCA.Certificate) != nil {
+		t.Fatal("certificate was not re-enrolled with the new ca")
+	}
+	if !trusts(material, oldCA) || !trusts(material, newCA) {
+		t.Fatal("old and new ca are not trusted after the re-enrollment")
+	}
+
+	// The cross-signed CA is accepted on restart, although only the old CA is pinned.
+	restarted := newTestProvider(t, &Config{
+		Store:             store,
+		CAFingerprints:    config.CAFingerprints,
+		CARotationOverlap: time.Hour,
+	}, authority)
+	if !restarted.KeyMaterial().CA.Equal(newCA.Certificate) || !trusts(restarted.KeyMaterial(), oldCA) {
+		t.Fatal("restarted provider lost the rotated ca")
+	}
+
+	// The old CA is no longer trusted when its overlap has passed.
+	provider.mutex.Lock()
+	provider.rotation.previous[0].trustedUntil = time.Now().Add(-time.Minute)
+	provider.mutex.Unlock()
+
+	err = provider.rotateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trusts(provider.KeyMaterial(), oldCA) || !trusts(provider.KeyMaterial(), newCA) {
+		t.Fatal("old ca is still trusted after the overlap")
+	}
+
+	// The old CA stays stored as link to the pinned CA, such that the new CA
+	// is accepted on restart after the overlap without trusting the old CA.
+	err = store.Save(map[string][]byte{caChainFilename: encodeCAChain(provider.rotation.previous)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted = newTestProvider(t, &Config{
+		Store:             store,
+		CAFingerprints:    config.CAFingerprints,
+		CARotationOverlap: time.Hour,
+	}, authority)
+	if !restarted.KeyMaterial().CA.Equal(newCA.Certificate) || trusts(restarted.KeyMaterial(), oldCA) {
+		t.Fatal("restarted provider did not accept the rotated ca after the overlap")
+	}
+}
+
+func TestRefreshCARejectsUnpinnedCA(t *testing.T) {
+	oldCA := pkitest.NewCA(t, "old", nil)
+	authority := pkitest.NewPKI(t, oldCA)
+	provider := newTestProvider(t, &Config{CAFingerprints: []string{CAFingerprint(oldCA.Certificate)}}, authority)
+
+	authority.Rotate(pkitest.NewCA(t, "rogue", nil))
+	err := provider.RefreshCA()
+	if err == nil {
+		t.Fatal("accepted a ca that is neither pinned nor cross-signed")
+	}
+	if len(provider.KeyMaterial().Roots()) != 1 {
+		t.Fatal("rejected ca is trusted")
+	}
+}
+
+func TestEnsureRejectsCrossSignedCAWithoutChain(t *testing.T) {
+	oldCA := pkitest.NewCA(t, "old", nil)
+	newCA := pkitest.NewCA(t, "new", oldCA)
+
+	store := NewMemoryStore()
+	err := store.Save(map[string][]byte{caFilename: encodeCertificate(newCA.Certificate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewKeyMaterialProvider(withTestPKI(&Config{
+		Store:                 store,
+		CertificateCommonName: "translator",
+		CAFingerprints:        []string{CAFingerprint(oldCA.Certificate)},
+		KeyType:               KeyTypeECDSAP256,
+	}, pkitest.NewPKI(t, newCA)))
+
+	err = provider.Ensure()
+	if err == nil {
+		t.Fatal("accepted a stored ca without the chain to the pinned ca")
+	}
+}
+
+func TestRotateCARemovesExpiredCAsFromStore(t *testing.T) {
+	oldCA := pkitest.NewCA(t, "old", nil)
+	newCA := pkitest.NewCA(t, "new", oldCA)
+	authority := pkitest.NewPKI(t, oldCA)
+	store := NewMemoryStore()
+	provider := newTestProvider(t, &Config{Store: store, CARotationOverlap: time.Hour}, authority)
+
+	authority.Rotate(newCA)
+	err := provider.RefreshCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.mutex.Lock()
+	provider.rotation.nextSince = time.Now().Add(-2 * time.Hour)
+	provider.mutex.Unlock()
+	err = provider.rotateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storedChain := func() []*trustedCA {
+		t.Helper()
+		entries, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := parseCAChain(entries[caChainFilename])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chain
+	}
+	if chain := storedChain(); len(chain) != 1 || !chain[0].certificate.Equal(oldCA.Certificate) {
+		t.Fatal("previous ca was not stored during the overlap")
+	}
+
+	provider.mutex.Lock()
+	provider.rotation.previous[0].trustedUntil = time.Now().Add(-time.Minute)
+	provider.mutex.Unlock()
+	err = provider.rotateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(storedChain()) != 0 {
+		t.Fatal("previous ca is still stored after the overlap")
+	}
+	if len(provider.rotation.previous) != 0 {
+		t.Fatal("previous ca is still kept after the overlap")
+	}
+}
+
+func TestCALineage(t *testing.T) {
+	pinned := pkitest.NewCA(t, "pinned", nil)
+	middle := pkitest.NewCA(t, "middle", pinned)
+	current := pkitest.NewCA(t, "current", middle)
+	older := pkitest.NewCA(t, "older", nil)
+
+	expired, trusted := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	chain := []*trustedCA{
+		{certificate: middle.Certificate, trustedUntil: expired},
+		{certificate: pinned.Certificate, trustedUntil: expired},
+		{certificate: older.Certificate, trustedUntil: expired},
+	}
+
+	// The expired CAs up to the pinned CA are kept as link, even across the store.
+	config := &Config{CAFingerprints: []string{CAFingerprint(pinned.Certificate)}}
+	stored, err := parseCAChain(encodeCAChain(config.caLineage(current.Certificate, chain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || !stored[0].certificate.Equal(middle.Certificate) || !stored[1].certificate.Equal(pinned.Certificate) {
+		t.Fatalf("unexpected lineage of %v cas", len(stored))
+	}
+	if config.verifyCAPin(current.Certificate, stored) != nil {
+		t.Fatal("lineage does not link the ca to the pinned ca")
+	}
+
+	// CAs whose overlap has not passed are kept regardless of the pins.
+	chain[2].trustedUntil = trusted
+	if lineage := config.caLineage(current.Certificate, chain); len(lineage) != 3 {
+		t.Fatalf("trusted ca was dropped from the lineage of %v cas", len(lineage))
+	}
+
+	// Without pins, or if the CA itself is pinned, no links are needed.
+	for _, config := range []*Config{{}, {CAFingerprints: []string{CAFingerprint(current.Certificate)}}} {
+		if lineage := config.caLineage(current.Certificate, chain); len(lineage) != 1 || !lineage[0].certificate.Equal(older.Certificate) {
+			t.Fatalf("unexpected lineage of %v cas", len(lineage))
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package pki
+
+import (
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+// withTestPKI configures the endpoints of the PKI in the config.
+func withTestPKI(config *Config, testPKI *pkitest.PKI) *Config {
+	config.BaseAddress = testPKI.URL
+	config.CAPath = pkitest.CAPath
+	config.CSRPath = pkitest.CSRPath
+	config.CRLPath = pkitest.CRLPath
+	config.RequestRetries = -1
+	return config
+}
+
+// newTestProvider creates a provider whose certificates are issued by the PKI.
+func newTestProvider(t *testing.T, config *Config, testPKI *pkitest.PKI) *DefaultKeyMaterialProvider {
+	t.Helper()
+
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+	if config.CertificateCommonName == "" {
+		config.CertificateCommonName = "translator"
+	}
+	if config.KeyType == "" {
+		config.KeyType = KeyTypeECDSAP256
+	}
+
+	provider := NewKeyMaterialProvider(withTestPKI(config, testPKI))
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
@@ -0,0 +1,226 @@
+package pki
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// KeyMaterial is a consistent snapshot of the CA certificate, the certificate
+// and the private key of the translator. A snapshot is never modified, renewed
+// key material is swapped in as a new snapshot.
+//
+// KeyMaterial implements KeyMaterialProvider with static key material.
+type KeyMaterial struct {
+	CA          *x509.Certificate
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+	KeyType     KeyType
+
+	// The intermediate CA certificates between the Certificate and the CA (if any).
+	Intermediates []*x509.Certificate
+
+	// All trusted root CA certificates of the key material (e.g. the X.509 bundle
+	// of a SPIFFE trust domain). If omitted, only the CA is trusted.
+	Bundle []*x509.Certificate
+}
+
+// KeyMaterialProvider provides the key material of a translator.
+// Implementations must be safe for concurrent use.
+type KeyMaterialProvider interface {
+	// Ensure loads the key material. It is called before the translator starts.
+	Ensure() error
+
+	// KeyMaterial returns the current snapshot of the key material.
+	// If no key material is loaded, nil is returned.
+	KeyMaterial() *KeyMaterial
+
+	// Watch keeps the key material up to date until the context is done.
+	Watch(ctx context.Context)
+}
+
+// Ensure checks that the static key material is complete.
+func (material *KeyMaterial) Ensure() error {
+	if material.CA == nil || material.Certificate == nil || material.PrivateKey == nil {
+		return errors.New("key material is incomplete")
+	}
+	return nil
+}
+
+// KeyMaterial returns the static key material itself.
+func (material *KeyMaterial) KeyMaterial() *KeyMaterial {
+	return material
+}
+
+// Watch does nothing, since static key material never changes.
+func (material *KeyMaterial) Watch(_ context.Context) {}
+
+// Chain returns the certificate chain of the key material:
+// the Certificate, the Intermediates and the CA.
+func (material *KeyMaterial) Chain() []*x509.Certificate {
+	chain := append([]*x509.Certificate{material.Certificate}, material.Intermediates...)
+	return append(chain, material.CA)
+}
+
+// Roots returns the trusted root CA certificates (the Bundle or the CA).
+func (material *KeyMaterial) Roots() []*x509.Certificate {
+	if len(material.Bundle) > 0 {
+		return material.Bundle
+	}
+	return []*x509.Certificate{material.CA}
+}
+
+// JWTCertificateHeaders returns the x5c and x5t headers for JWTs
+// of the key material (see GetJWTCertificateHeaders).
+func (material *KeyMaterial) JWTCertificateHeaders() ([]string, string) {
+	var x5c []string
+	for _, certificate := range material.Chain() {
+		x5c = append(x5c, base64.StdEncoding.EncodeToString(certificate.Raw))
+	}
+
+	signature := sha256.Sum256(material.Certificate.Raw)
+	return x5c, base64.StdEncoding.EncodeToString(signature[:])
+}
+
+// DefaultKeyMaterialProvider stores the key material in the Store (or the
+// LocalCertPath) of the config and fetches missing material from the (WirePact-)PKI.
+// The certificate is renewed before it expires (see Watch).
+type DefaultKeyMaterialProvider struct {
+	config    *Config
+	client    *Client
+	authority certificateAuthority
+
+	mutex    sync.RWMutex
+	current  *KeyMaterial
+	rotation caRotation
+
+	// Serializes the renewals and reloads of the key material.
+	renewMutex sync.Mutex
+
+	// The fingerprint of the stored key material that was last reloaded (see Reload).
+	reloaded [sha256.Size]byte
+}
+
+// NewKeyMaterialProvider creates a provider for the given config.
+// The key material is not loaded until Ensure or Load is called.
+func NewKeyMaterialProvider(config *Config) *DefaultKeyMaterialProvider {
+	provider := &DefaultKeyMaterialProvider{
+		config: config,
+		client: NewClient(config),
+	}
+
+	provider.authority = provider.client
+	if config.DevMode {
+		provider.authority = NewDevCA(config.DevCAPath)
+	}
+
+	return provider
+}
+
+// Ensure checks if the CA and a certificate/key is available in the store.
+// If not, the CA and/or the certificate are fetched from the PKI and stored.
+// The stored certificate is validated: if it does not match the private key,
+// is not signed by the CA, is not valid or does not contain the configured
+// CertificateCommonName, a new certificate is requested (re-enrollment).
+func (provider *DefaultKeyMaterialProvider) Ensure() error {
+	return provider.ensure(true)
+}
+
+// ensure loads the key material. If enroll is not set,
+// the PKI is not contacted and invalid key material is an error.
+func (provider *DefaultKeyMaterialProvider) ensure(enroll bool) error {
+	ctx := context.Background()
+	store := provider.config.store()
+
+	entries, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("could not load key material: %w", err)
+	}
+
+	previous, err := parseCAChain(entries[caChainFilename])
+	if err != nil {
+		return err
+	}
+
+	material := &KeyMaterial{}
+	created := map[string][]byte{}
+
+	material.CA, created[caFilename], err = loadCA(ctx, provider.config, provider.authority, entries[caFilename], previous)
+	if err != nil {
+		return err
+	}
+
+	material.PrivateKey, material.KeyType, created[keyFilename], err = loadLocalKey(provider.config, entries[keyFilename], enroll)
+	if err != nil {
+		return err
+	}
+
+	material.Certificate, created[certFilename], err = loadLocalCert(ctx, provider.config, provider.authority, material, entries[certFilename], enroll)
+	if err != nil {
+		return err
+	}
+
+	for name, data := range created {
+		if data == nil {
+			delete(created, name)
+		}
+	}
+	if len(created) > 0 {
+		err = store.Save(created)
+		if err != nil {
+			return fmt.Errorf("could not store key material: %w", err)
+		}
+	}
+
+	provider.set(material, previous)
+
+	return nil
+}
+
+// WithHTTPClient sets the http client that is used for the requests to the PKI.
+func (provider *DefaultKeyMaterialProvider) WithHTTPClient(httpClient *http.Client) *DefaultKeyMaterialProvider {
+	provider.client.WithHTTPClient(httpClient)
+	return provider
+}
+
+// Load loads the key material from the store without contacting the PKI.
+// An error is returned if any of the entries does not exist or is invalid.
+func (provider *DefaultKeyMaterialProvider) Load() error {
+	entries, err := provider.config.store().Load()
+	if err != nil {
+		return fmt.Errorf("could not load key material: %w", err)
+	}
+
+	for _, name := range []string{caFilename, keyFilename, certFilename} {
+		if entries[name] == nil {
+			return fmt.Errorf("key material %v does not exist", name)
+		}
+	}
+
+	return provider.ensure(false)
+}
+
+// KeyMaterial returns the current snapshot of the key material.
+func (provider *DefaultKeyMaterialProvider) KeyMaterial() *KeyMaterial {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	return provider.current
+}
+
+// set swaps in the key material and the previous CAs that were stored with it.
+func (provider *DefaultKeyMaterialProvider) set(material *KeyMaterial, previous []*trustedCA) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if next := provider.rotation.next; next != nil && next.Equal(material.CA) {
+		provider.rotation.next = nil
+	}
+	provider.rotation.previous = previous
+	provider.current = provider.withTrustedCAs(material)
+}
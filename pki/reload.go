@@ -0,0 +1,154 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// Reload loads the key material from the store (e.g. files that were rotated by a
+// secret manager) and replaces the current key material if it changed. The CA,
+// the private key and the certificate are validated as a consistent set (like in
+// Load) before they are swapped in. If the stored key material is invalid (e.g. only
+// some of the files are rotated yet), an error is returned and the current key
+// material stays active. Reload returns true if the key material was replaced.
+func (provider *DefaultKeyMaterialProvider) Reload() (bool, error) {
+	provider.renewMutex.Lock()
+	defer provider.renewMutex.Unlock()
+
+	entries, err := provider.config.store().Load()
+	if err != nil {
+		return false, err
+	}
+
+	return provider.reload(entries)
+}
+
+// reload swaps in the loaded entries if they changed. The renewMutex must be held
+// since the entries were loaded, otherwise a concurrent renewal could be reverted
+// by the stale entries.
+func (provider *DefaultKeyMaterialProvider) reload(entries map[string][]byte) (bool, error) {
+	fingerprint := storedFingerprint(entries)
+	if fingerprint == provider.reloaded {
+		return false, nil
+	}
+
+	material, previous, err := provider.parseStored(entries)
+	if err != nil {
+		return false, err
+	}
+	provider.reloaded = fingerprint
+
+	current := provider.KeyMaterial()
+	if current != nil && current.CA.Equal(material.CA) && current.Certificate.Equal(material.Certificate) {
+		return false, nil
+	}
+
+	provider.set(material, previous)
+
+	logrus.WithFields(logrus.Fields{
+		"serial":    material.Certificate.SerialNumber,
+		"not_after": material.Certificate.NotAfter,
+		"ca":        CAFingerprint(material.CA),
+	}).Info("Reloaded changed key material from the store.")
+
+	return true, nil
+}
+
+// parseStored parses and validates the stored key material without contacting the PKI.
+func (provider *DefaultKeyMaterialProvider) parseStored(entries map[string][]byte) (*KeyMaterial, []*trustedCA, error) {
+	config := provider.config
+	material := &KeyMaterial{}
+
+	previous, err := parseCAChain(entries[caChainFilename])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	material.CA, err = parseStoredCertificate(caFilename, entries[caFilename])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = config.verifyCAPin(material.CA, previous)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if entries[keyFilename] == nil {
+		return nil, nil, fmt.Errorf("key material %v does not exist", keyFilename)
+	}
+	material.PrivateKey, material.KeyType, _, err = loadLocalKey(config, entries[keyFilename], false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	material.Certificate, err = parseStoredCertificate(certFilename, entries[certFilename])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = validateStoredCertificate(config, material.Certificate, material)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return material, previous, nil
+}
+
+// watchStore polls the store in the configured ReloadInterval and reloads
+// changed key material (see Reload) until the context is done.
+func (provider *DefaultKeyMaterialProvider) watchStore(ctx context.Context) {
+	interval := provider.config.reloadInterval()
+	if interval < 0 {
+		return
+	}
+
+	// Invalid key material is only logged once, until the stored key material changes.
+	var rejected [sha256.Size]byte
+	for sleep(ctx, interval) {
+		rejected = provider.reloadChanged(rejected)
+	}
+}
+
+// reloadChanged reloads the stored key material (like Reload), unless it is the
+// rejected key material. It returns the fingerprint of the rejected key material.
+func (provider *DefaultKeyMaterialProvider) reloadChanged(rejected [sha256.Size]byte) [sha256.Size]byte {
+	provider.renewMutex.Lock()
+	defer provider.renewMutex.Unlock()
+
+	entries, err := provider.config.store().Load()
+	if err != nil {
+		logrus.WithError(err).Warn("Could not load the stored key material.")
+		return rejected
+	}
+
+	fingerprint := storedFingerprint(entries)
+	if fingerprint == rejected {
+		return rejected
+	}
+
+	_, err = provider.reload(entries)
+	if err != nil {
+		logrus.WithError(err).Warn("Stored key material changed but is invalid, keeping the current key material.")
+		return fingerprint
+	}
+
+	return rejected
+}
+
+// storedFingerprint returns a hash of the stored key material entries.
+func storedFingerprint(entries map[string][]byte) [sha256.Size]byte {
+	return sha256.Sum256(bytes.Join([][]byte{
+		entries[caFilename],
+		entries[keyFilename],
+		entries[certFilename],
+		entries[caChainFilename],
+	}, []byte{0}))
+}
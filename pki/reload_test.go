@@ -0,0 +1,96 @@
+package pki
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+// blockingStore blocks Load (once armed) until it is released.
+type blockingStore struct {
+	Store
+
+	mutex   sync.Mutex
+	armed   bool
+	loaded  chan struct{}
+	release chan struct{}
+}
+
+func (store *blockingStore) Load() (map[string][]byte, error) {
+	entries, err := store.Store.Load()
+
+	store.mutex.Lock()
+	armed := store.armed
+	store.armed = false
+	store.mutex.Unlock()
+
+	if armed {
+		close(store.loaded)
+		<-store.release
+	}
+	return entries, err
+}
+
+func TestReloadDoesNotRevertConcurrentRenewal(t *testing.T) {
+	store := &blockingStore{
+		Store:   NewMemoryStore(),
+		loaded:  make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	provider := newTestProvider(t, &Config{Store: store}, pkitest.NewPKI(t, nil))
+	initial := provider.KeyMaterial()
+
+	store.mutex.Lock()
+	store.armed = true
+	store.mutex.Unlock()
+
+	reloaded := make(chan error)
+	go func() {
+		_, err := provider.Reload()
+		reloaded <- err
+	}()
+	<-store.loaded
+
+	renewed := make(chan error)
+	go func() {
+		renewed <- provider.Renew()
+	}()
+
+	select {
+	case <-renewed:
+		t.Fatal("renewal did not wait for the reload of the stored key material")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(store.release)
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-renewed; err != nil {
+		t.Fatal(err)
+	}
+
+	current := provider.KeyMaterial()
+	if current.Certificate.Equal(initial.Certificate) {
+		t.Fatal("renewed certificate was reverted")
+	}
+
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entries[certFilename], encodeCertificate(current.Certificate)) {
+		t.Fatal("stored certificate differs from the current certificate")
+	}
+
+	changed, err := provider.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("reload replaced the renewed key material")
+	}
+}
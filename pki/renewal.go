@@ -0,0 +1,173 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRenewalRetryInterval = 10 * time.Second
+	maxRenewalRetryInterval     = 5 * time.Minute
+)
+
+// Renew generates a new private key and requests a certificate for it
+// from the PKI. The new key and certificate are stored in the store of the
+// config and replace the current key material. If any error occurs, the current
+// key material stays active.
+func (provider *DefaultKeyMaterialProvider) Renew() error {
+	return provider.renew(nil)
+}
+
+// renew replaces the key material with a new key and certificate. If a CA
+// is given, the certificate must be signed by it and the CA is replaced too.
+func (provider *DefaultKeyMaterialProvider) renew(ca *x509.Certificate) error {
+	provider.renewMutex.Lock()
+	defer provider.renewMutex.Unlock()
+
+	config := provider.config
+	current := provider.KeyMaterial()
+	if current == nil {
+		return errors.New("no key material loaded to renew")
+	}
+	if ca == nil {
+		ca = current.CA
+	}
+
+	keyType := config.KeyType
+	if keyType == "" {
+		keyType = current.KeyType
+	}
+
+	privateKey, err := keyType.generate()
+	if err != nil {
+		return err
+	}
+
+	renewed := &KeyMaterial{
+		CA:         ca,
+		PrivateKey: privateKey,
+		KeyType:    keyType,
+	}
+
+	renewed.Certificate, err = requestCertificate(context.Background(), config, provider.authority, renewed)
+	if err != nil {
+		return err
+	}
+
+	keyOut, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	entries := map[string][]byte{
+		keyFilename:  keyOut,
+		certFilename: encodeCertificate(renewed.Certificate),
+	}
+	provider.mutex.RLock()
+	previous := provider.rotation.previous
+	provider.mutex.RUnlock()
+
+	if !ca.Equal(current.CA) {
+		// The previous CA stays trusted for the overlap, since the peers may still use it.
+		previous = append([]*trustedCA{{
+			certificate:  current.CA,
+			trustedUntil: time.Now().Add(config.caRotationOverlap()),
+		}}, previous...)
+
+		entries[caFilename] = encodeCertificate(ca)
+		entries[caChainFilename] = encodeCAChain(previous)
+	}
+
+	err = config.store().Save(entries)
+	if err != nil {
+		return err
+	}
+
+	provider.set(renewed, previous)
+
+	logrus.WithFields(logrus.Fields{
+		"serial":    renewed.Certificate.SerialNumber,
+		"not_after": renewed.Certificate.NotAfter,
+	}).Info("Renewed translator certificate.")
+
+	return nil
+}
+
+// Watch renews the key material (see Renew) when the renewal time of the
+// current certificate is reached (see Config.RenewBefore) until the context
+// is done. Failed renewals are logged and retried with an exponential backoff
+// while the current key material stays active. Additionally, the CA is
+// refreshed in the configured CARefreshInterval and rotated after the
+// CARotationOverlap (see RefreshCA) and changed
+// key material in the store is reloaded in the ReloadInterval (see Reload).
+func (provider *DefaultKeyMaterialProvider) Watch(ctx context.Context) {
+	go provider.watchCA(ctx)
+	go provider.watchStore(ctx)
+
+	config := provider.config
+	retryInterval := config.renewalRetryInterval()
+
+	if provider.KeyMaterial() == nil {
+		logrus.Error("No key material loaded, the certificate is not renewed.")
+		return
+	}
+
+	for {
+		if !sleep(ctx, time.Until(config.renewalTime(provider.KeyMaterial().Certificate))) {
+			return
+		}
+		if time.Now().Before(config.renewalTime(provider.KeyMaterial().Certificate)) {
+			// The key material was reloaded in the meantime.
+			continue
+		}
+
+		err := provider.Renew()
+		if err == nil {
+			retryInterval = config.renewalRetryInterval()
+			if !time.Now().Before(config.renewalTime(provider.KeyMaterial().Certificate)) {
+				// Prevent a renewal loop when the PKI issues certificates
+				// with a shorter validity than the configured RenewBefore.
+				logrus.Warn("Renewed translator certificate is already due for renewal.")
+				if !sleep(ctx, retryInterval) {
+					return
+				}
+			}
+			continue
+		}
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"not_after": provider.KeyMaterial().Certificate.NotAfter,
+			"retry_in":  retryInterval,
+		}).Warn("Could not renew translator certificate.")
+
+		if !sleep(ctx, retryInterval) {
+			return
+		}
+
+		retryInterval *= 2
+		if retryInterval > maxRenewalRetryInterval {
+			retryInterval = maxRenewalRetryInterval
+		}
+	}
+}
+
+// sleep waits for the duration and returns false if the context is done before.
+func sleep(ctx context.Context, duration time.Duration) bool {
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,131 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+func TestRenewSwapsKeyMaterial(t *testing.T) {
+	store := NewMemoryStore()
+	provider := newTestProvider(t, &Config{Store: store}, pkitest.NewPKI(t, nil))
+	initial := provider.KeyMaterial()
+
+	err := provider.Renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed := provider.KeyMaterial()
+	if renewed.Certificate.Equal(initial.Certificate) || renewed.PrivateKey.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(initial.PrivateKey.Public()) {
+		t.Fatal("key and certificate were not renewed")
+	}
+	if !renewed.CA.Equal(initial.CA) {
+		t.Fatal("ca changed with the renewal")
+	}
+
+	// The renewed key material is stored, while the previous snapshot stays usable.
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entries[certFilename], encodeCertificate(renewed.Certificate)) {
+		t.Fatal("renewed certificate was not stored")
+	}
+	if err = initial.Certificate.CheckSignatureFrom(initial.CA); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenewKeepsKeyMaterialOnFailure(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	var failing atomic.Value
+	failing.Store(false)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if failing.Load().(bool) {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		testPKI.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+
+	store := NewMemoryStore()
+	config := withTestPKI(&Config{Store: store, CertificateCommonName: "translator", KeyType: KeyTypeECDSAP256}, testPKI)
+	config.BaseAddress = server.URL
+	provider := NewKeyMaterialProvider(config)
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := provider.KeyMaterial()
+	stored, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing.Store(true)
+	err = provider.Renew()
+	if err == nil {
+		t.Fatal("renewal succeeded without the pki")
+	}
+	if provider.KeyMaterial() != initial {
+		t.Fatal("key material was replaced by a failed renewal")
+	}
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entries[keyFilename], stored[keyFilename]) || !bytes.Equal(entries[certFilename], stored[certFilename]) {
+		t.Fatal("stored key material was replaced by a failed renewal")
+	}
+}
+
+func TestWatchRenewsDueCertificate(t *testing.T) {
+	// The certificates of the PKI are valid for an hour, so they are due immediately.
+	provider := newTestProvider(t, &Config{
+		RenewBefore:          2 * time.Hour,
+		RenewalRetryInterval: time.Hour,
+		CARefreshInterval:    -1,
+		ReloadInterval:       -1,
+	}, pkitest.NewPKI(t, nil))
+	initial := provider.KeyMaterial()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provider.Watch(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for provider.KeyMaterial() == initial {
+		if time.Now().After(deadline) {
+			t.Fatal("due certificate was not renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if provider.KeyMaterial().Certificate.Equal(initial.Certificate) {
+		t.Fatal("certificate was not renewed")
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Now()
+	certificate := pkitest.NewCA(t, "ca", nil).Certificate
+	certificate.NotBefore, certificate.NotAfter = notBefore, notBefore.Add(3*time.Hour)
+
+	if renewal := (&Config{}).renewalTime(certificate); !renewal.Equal(notBefore.Add(2 * time.Hour)) {
+		t.Fatalf("expected the renewal after two thirds of the validity, got %v", renewal.Sub(notBefore))
+	}
+	if renewal := (&Config{RenewBefore: time.Hour}).renewalTime(certificate); !renewal.Equal(notBefore.Add(2 * time.Hour)) {
+		t.Fatalf("expected the renewal an hour before the expiry, got %v", renewal.Sub(notBefore))
+	}
+	if renewal := (&Config{RenewBefore: 30 * time.Minute}).renewalTime(certificate); !renewal.Equal(notBefore.Add(150 * time.Minute)) {
+		t.Fatalf("expected the renewal 30 minutes before the expiry, got %v", renewal.Sub(notBefore))
+	}
+}
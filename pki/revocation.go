@@ -0,0 +1,294 @@
+package pki
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCRLRefreshInterval = 5 * time.Minute
+	crlStaleFactor            = 3
+)
+
+var (
+	// ErrCertificateRevoked is returned when a certificate is listed in the CRL.
+	ErrCertificateRevoked = errors.New("certificate is revoked")
+
+	// ErrRevocationStatusUnknown is returned when no up-to-date CRL is
+	// available and the revocation checker fails closed.
+	ErrRevocationStatusUnknown = errors.New("certificate revocation status unknown")
+)
+
+// RevocationChecker checks certificates against the certificate revocation lists
+// (CRLs) of the PKI. The CRLs are fetched from the configured CRLPath and cached
+// until they are refreshed. The endpoint may serve a (PEM) bundle with a CRL
+// of every CA, e.g. of the current and the previous CA during a CA rotation.
+// The signatures of the CRLs are verified when they are fetched and the CRLs
+// are indexed by the subject of their CA, such that checking a certificate
+// does not require any signature verification.
+type RevocationChecker struct {
+	config      *Config
+	keyMaterial KeyMaterialProvider
+	client      *Client
+
+	mutex     sync.RWMutex
+	crls      map[string][]*revocationList
+	fetchedAt time.Time
+}
+
+// revocationList is the verified CRL of one CA.
+type revocationList struct {
+	issuer     *x509.Certificate
+	revoked    map[string]bool
+	fetchedAt  time.Time
+	nextUpdate time.Time
+}
+
+// NewRevocationChecker creates a revocation checker for the given config.
+// The CRLs are verified with the trusted CA certificates of the key material
+// provider (the CA and, during a CA rotation, the new and the previous CAs).
+// The CRLs are not fetched until Refresh is called.
+func NewRevocationChecker(config *Config, keyMaterial KeyMaterialProvider) *RevocationChecker {
+	return &RevocationChecker{
+		config:      config,
+		keyMaterial: keyMaterial,
+		client:      NewClient(config),
+	}
+}
+
+// WithHTTPClient sets the http client that is used to fetch the CRL.
+func (checker *RevocationChecker) WithHTTPClient(httpClient *http.Client) *RevocationChecker {
+	checker.client.WithHTTPClient(httpClient)
+	return checker
+}
+
+// Refresh fetches the CRLs from the PKI and validates their signatures against
+// the trusted CA certificates. The CRL of a CA that is not contained in the
+// response stays active, as long as the CA is trusted. If any error occurs
+// (e.g. a CRL of an untrusted issuer), the previous CRLs stay active.
+func (checker *RevocationChecker) Refresh() error {
+	crlBytes, err := checker.client.FetchCRL(context.Background())
+	if err != nil {
+		return err
+	}
+
+	crls, err := parseCRLs(crlBytes)
+	if err != nil {
+		return err
+	}
+
+	material := checker.keyMaterial.KeyMaterial()
+	if material == nil || material.CA == nil {
+		return errors.New("no ca certificate loaded to verify the crl")
+	}
+	roots := material.Roots()
+
+	now := time.Now()
+	var fetched []*revocationList
+	for _, crl := range crls {
+		issuer, err := crlIssuer(crl, roots)
+		if err != nil {
+			return err
+		}
+
+		revoked := map[string]bool{}
+		for _, revokedCertificate := range crl.TBSCertList.RevokedCertificates {
+			revoked[revokedCertificate.SerialNumber.String()] = true
+		}
+
+		fetched = append(fetched, &revocationList{
+			issuer:     issuer,
+			revoked:    revoked,
+			fetchedAt:  now,
+			nextUpdate: crl.TBSCertList.NextUpdate,
+		})
+	}
+
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	index := map[string][]*revocationList{}
+	for _, crl := range fetched {
+		subject := string(crl.issuer.RawSubject)
+		index[subject] = append(index[subject], crl)
+	}
+	for subject, previousCRLs := range checker.crls {
+		for _, previous := range previousCRLs {
+			if !containsCertificate(roots, previous.issuer) || findRevocationList(fetched, previous.issuer) != nil {
+				continue
+			}
+			index[subject] = append(index[subject], previous)
+		}
+	}
+	checker.crls = index
+	checker.fetchedAt = now
+
+	logrus.WithField("crls", len(crls)).Debug("Refreshed certificate revocation lists.")
+
+	return nil
+}
+
+// Watch refreshes the CRL in the configured CRLRefreshInterval until the context is done.
+// Failed refreshes are logged and the previous CRL stays active.
+func (checker *RevocationChecker) Watch(ctx context.Context) {
+	ticker := time.NewTicker(checker.config.crlRefreshInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := checker.Refresh(); err != nil {
+				logrus.WithError(err).Warn("Could not refresh certificate revocation list.")
+			}
+		}
+	}
+}
+
+// Check returns ErrCertificateRevoked if the certificate is revoked. The certificate
+// must be part of a verified chain, since it is checked against the CRL of the CA
+// that is named by its issuer and its authority key identifier. Certificates that were not
+// issued by a trusted CA of the key material (e.g. by a CA of a trust bundle) are
+// not checked. If the CRL is stale (it was never fetched, its next update lies in
+// the past, or it was not refreshed for three refresh intervals) or if there is no
+// CRL of the issuing CA, the checker returns ErrRevocationStatusUnknown unless
+// CRLFailOpen is configured.
+func (checker *RevocationChecker) Check(certificate *x509.Certificate) error {
+	checker.mutex.RLock()
+	defer checker.mutex.RUnlock()
+
+	now := time.Now()
+	var crl *revocationList
+	for _, candidate := range checker.crls[string(certificate.RawIssuer)] {
+		if issuedBy(certificate, candidate.issuer) {
+			crl = candidate
+			break
+		}
+	}
+
+	switch {
+	case checker.fetchedAt.IsZero():
+	case crl != nil && !crl.stale(now, checker.config.crlRefreshInterval()):
+		if crl.revoked[certificate.SerialNumber.String()] {
+			return ErrCertificateRevoked
+		}
+		return nil
+	case crl == nil && !checker.issuedByTrustedCA(certificate):
+		return nil
+	}
+
+	if checker.config.CRLFailOpen {
+		logrus.WithField("serial", certificate.SerialNumber).Warn("Certificate revocation status is unknown. Fail open.")
+		return nil
+	}
+	return ErrRevocationStatusUnknown
+}
+
+func (checker *RevocationChecker) issuedByTrustedCA(certificate *x509.Certificate) bool {
+	material := checker.keyMaterial.KeyMaterial()
+	if material == nil {
+		return false
+	}
+
+	for _, root := range material.Roots() {
+		if issuedBy(certificate, root) {
+			return true
+		}
+	}
+	return false
+}
+
+func (crl *revocationList) stale(now time.Time, refreshInterval time.Duration) bool {
+	if !crl.nextUpdate.IsZero() && now.After(crl.nextUpdate) {
+		return true
+	}
+
+	return now.After(crl.fetchedAt.Add(crlStaleFactor * refreshInterval))
+}
+
+// parseCRLs parses the DER encoded CRL or all CRLs of the PEM bundle.
+func parseCRLs(data []byte) ([]*pkix.CertificateList, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseDERCRL(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*pkix.CertificateList{crl}, nil
+	}
+
+	var crls []*pkix.CertificateList
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+
+	if len(crls) == 0 {
+		return nil, errors.New("no pem encoded crl found")
+	}
+	return crls, nil
+}
+
+// crlIssuer returns the CA of the roots that signed the CRL.
+func crlIssuer(crl *pkix.CertificateList, roots []*x509.Certificate) (*x509.Certificate, error) {
+	for _, root := range roots {
+		if root.CheckCRLSignature(crl) == nil {
+			return root, nil
+		}
+	}
+	return nil, fmt.Errorf("crl of %v is not signed by a trusted ca", crl.TBSCertList.Issuer)
+}
+
+// issuedBy checks if the certificate of a verified chain was issued by the CA.
+// Comparing the issuer name is not sufficient, since the CAs of a rotation may
+// share the subject. They are distinguished by their key identifiers and only
+// certificates without a key identifier are checked against the signature.
+func issuedBy(certificate *x509.Certificate, ca *x509.Certificate) bool {
+	if !bytes.Equal(certificate.RawIssuer, ca.RawSubject) {
+		return false
+	}
+	if len(certificate.AuthorityKeyId) > 0 && len(ca.SubjectKeyId) > 0 {
+		return bytes.Equal(certificate.AuthorityKeyId, ca.SubjectKeyId)
+	}
+	return certificate.CheckSignatureFrom(ca) == nil
+}
+
+func findRevocationList(crls []*revocationList, issuer *x509.Certificate) *revocationList {
+	for _, crl := range crls {
+		if crl.issuer.Equal(issuer) {
+			return crl
+		}
+	}
+	return nil
+}
+
+func containsCertificate(certificates []*x509.Certificate, certificate *x509.Certificate) bool {
+	for _, candidate := range certificates {
+		if candidate.Equal(certificate) {
+			return true
+		}
+	}
+	return false
+}
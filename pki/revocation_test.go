@@ -0,0 +1,194 @@
+package pki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+func newRevocationChecker(t *testing.T, config *Config, testPKI *pkitest.PKI) (*RevocationChecker, *KeyMaterial) {
+	provider := newTestProvider(t, config, testPKI)
+	return NewRevocationChecker(config, provider), provider.KeyMaterial()
+}
+
+func TestRevocationCheckerRejectsRevokedCertificate(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	checker, material := newRevocationChecker(t, &Config{}, testPKI)
+
+	err := checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checker.Check(material.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPKI.Revoke(material.Certificate.SerialNumber)
+	err = checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checker.Check(material.Certificate)
+	if !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("revoked certificate was accepted: %v", err)
+	}
+
+	// Certificates of other issuers are not checked against the CRL.
+	other := pkitest.NewCA(t, "other", nil)
+	if err = checker.Check(other.Certificate); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevocationCheckerKeepsCRLOfInvalidRefresh(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	checker, material := newRevocationChecker(t, &Config{}, testPKI)
+
+	testPKI.Revoke(material.Certificate.SerialNumber)
+	err := checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A CRL that is not signed by the CA is rejected.
+	testPKI.Rotate(pkitest.NewCA(t, "rogue", nil))
+
+	err = checker.Refresh()
+	if err == nil {
+		t.Fatal("accepted a crl of another ca")
+	}
+	err = checker.Check(material.Certificate)
+	if !errors.Is(err, ErrCertificateRevoked) {
+		t.Fatalf("rejected crl replaced the previous crl: %v", err)
+	}
+}
+
+func TestRevocationCheckerStaleCRL(t *testing.T) {
+	tests := []struct {
+		name       string
+		failOpen   bool
+		refresh    bool
+		nextUpdate time.Duration
+		expected   error
+	}{
+		{name: "never fetched", expected: ErrRevocationStatusUnknown},
+		{name: "never fetched fail open", failOpen: true},
+		{name: "next update passed", refresh: true, nextUpdate: -time.Second, expected: ErrRevocationStatusUnknown},
+		{name: "next update passed fail open", failOpen: true, refresh: true, nextUpdate: -time.Second},
+		{name: "up to date", refresh: true, nextUpdate: time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testPKI := pkitest.NewPKI(t, nil)
+			testPKI.SetCRLNextUpdate(test.nextUpdate)
+			checker, material := newRevocationChecker(t, &Config{CRLFailOpen: test.failOpen}, testPKI)
+
+			if test.refresh {
+				err := checker.Refresh()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := checker.Check(material.Certificate)
+			if err != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestRevocationCheckerDuringCARotation(t *testing.T) {
+	// The new CA has the same subject as the old CA, which it is cross-signed by.
+	oldCA := pkitest.NewCA(t, "WirePact CA", nil)
+	newCA := pkitest.NewCA(t, "WirePact CA", oldCA)
+	testPKI := pkitest.NewPKI(t, oldCA)
+	config := &Config{CARotationOverlap: time.Hour}
+	checker, material := newRevocationChecker(t, config, testPKI)
+	provider := checker.keyMaterial.(*DefaultKeyMaterialProvider)
+
+	testPKI.Rotate(newCA)
+	err := provider.RefreshCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := KeyTypeECDSAP256.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := newCA.Issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "peer"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, key.Public())
+
+	// The CRLs of the old and the new CA are verified with the trusted CAs of the rotation.
+	err = checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, certificate := range []*x509.Certificate{material.Certificate, peer} {
+		if err = checker.Check(certificate); err != nil {
+			t.Fatalf("certificate %v was rejected: %v", certificate.Subject, err)
+		}
+	}
+
+	for _, certificate := range []*x509.Certificate{material.Certificate, peer} {
+		testPKI.Revoke(certificate.SerialNumber)
+		err = checker.Refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = checker.Check(certificate); !errors.Is(err, ErrCertificateRevoked) {
+			t.Fatalf("revoked certificate %v was accepted: %v", certificate.Subject, err)
+		}
+	}
+
+	// Without a CRL of the issuing CA, the revocation status is unknown.
+	newCRLOnly := NewRevocationChecker(withTestPKI(&Config{}, pkitest.NewPKI(t, newCA)), provider)
+	err = newCRLOnly.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = newCRLOnly.Check(material.Certificate); !errors.Is(err, ErrRevocationStatusUnknown) {
+		t.Fatalf("expected unknown revocation status, got %v", err)
+	}
+}
+
+func TestIssuedBy(t *testing.T) {
+	// The CAs of a rotation share the subject and are distinguished by their key identifiers.
+	oldCA := pkitest.NewCA(t, "WirePact CA", nil)
+	newCA := pkitest.NewCA(t, "WirePact CA", oldCA)
+	key, err := KeyTypeECDSAP256.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := newCA.Issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "peer"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, key.Public())
+
+	// Certificates without an authority key identifier are checked against the signature.
+	withoutKeyID := *peer
+	withoutKeyID.AuthorityKeyId = nil
+
+	for _, certificate := range []*x509.Certificate{peer, &withoutKeyID} {
+		if !issuedBy(certificate, newCA.Certificate) {
+			t.Fatal("certificate was not issued by its ca")
+		}
+		if issuedBy(certificate, oldCA.Certificate) {
+			t.Fatal("certificate was issued by the ca with the same subject")
+		}
+	}
+}
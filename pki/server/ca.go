@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/serial"
+)
+
+// LoadCA loads the PEM encoded CA certificate and private key from the files.
+func LoadCA(certPath string, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	keyPair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type %T", keyPair.PrivateKey)
+	}
+
+	return ca, key, nil
+}
+
+// LoadOrCreateCA loads the CA certificate and private key from the files (see LoadCA).
+// If both files do not exist, a self-signed CA with the common name and validity
+// is generated (see GenerateCA) and written to the files.
+func LoadOrCreateCA(certPath string, keyPath string, commonName string, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return LoadCA(certPath, keyPath)
+	}
+
+	ca, key, err := GenerateCA(commonName, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca, key, nil
+}
+
+// GenerateCA generates a self-signed CA certificate with an ECDSA P-256 key.
+func GenerateCA(commonName string, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := serial.Random()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"WirePact PKI"},
+			CommonName:   commonName,
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca, key, nil
+}
@@ -0,0 +1,397 @@
+// Package server contains a reference implementation of the PKI protocol that
+// is used by pki.Config: the CA certificate is served on the CA path (http get),
+// PKCS#10 CSRs are signed on the CSR path (http post) and the optional CRL
+// is served on the CRL path (http get).
+//
+// The server is meant for integration tests and small deployments without
+// Kubernetes (see the wirepact-pki command).
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/serial"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultCAPath  = "/ca"
+	DefaultCSRPath = "/csr"
+	DefaultCRLPath = "/crl"
+
+	defaultValidity    = 7 * 24 * time.Hour
+	defaultCRLValidity = time.Hour
+	maxCSRSize         = 64 * 1024
+
+	commonNamePlaceholder = "{cn}"
+)
+
+// Config contains the configuration of the PKI server.
+type Config struct {
+	// The CA certificate that signs the CSRs.
+	CA *x509.Certificate
+
+	// The private key of the CA certificate.
+	CAKey crypto.Signer
+
+	// The paths of the endpoints. If omitted, "/ca", "/csr" and "/crl" are used.
+	CAPath  string
+	CSRPath string
+	CRLPath string
+
+	// The validity of the issued certificates. If omitted, certificates are valid
+	// for 7 days. The validity never exceeds the validity of the CA.
+	Validity time.Duration
+
+	// If set, the common name of a CSR must match one of the patterns
+	// (see path.Match, e.g. "translator-*"). If omitted, any non-empty
+	// common name is accepted.
+	AllowedCommonNames []string
+
+	// The patterns of the accepted DNS name and URI SANs (see path.Match). The
+	// placeholder "{cn}" is replaced with the (accepted) common name of the CSR,
+	// such that a client can only request names of its own identity, e.g.
+	// "spiffe://example.org/translator/{cn}". The URIs (e.g. SPIFFE IDs) identify
+	// the workload of received JWTs (see pki.SPIFFEID). If omitted, only the
+	// common name is accepted as DNS name and URIs are rejected.
+	AllowedDNSNames []string
+	AllowedURIs     []string
+
+	// The networks of the accepted IP address SANs.
+	// If omitted, IP addresses are rejected.
+	AllowedIPNetworks []*net.IPNet
+
+	// If set, a CSR must be sent with one of the bootstrap tokens as bearer token
+	// (see pki.Config.BootstrapToken). If omitted, all CSRs are accepted.
+	BootstrapTokens []string
+
+	// An additional policy for the CSRs (e.g. based on the request). If it returns
+	// an error, the CSR is rejected with the error message.
+	Policy func(csr *x509.CertificateRequest, request *http.Request) error
+
+	// If set, the CRL of the revoked certificates (see Server.Revoke) is served.
+	ServeCRL bool
+
+	// The validity of the served CRL (next update). If omitted, 1 hour is used.
+	CRLValidity time.Duration
+}
+
+// Server is an http.Handler that implements the PKI protocol.
+type Server struct {
+	config *Config
+	mux    *http.ServeMux
+
+	mutex   sync.Mutex
+	revoked []pkix.RevokedCertificate
+}
+
+// New creates a PKI server for the given config.
+func New(config *Config) (*Server, error) {
+	if config.CA == nil || config.CAKey == nil {
+		return nil, errors.New("ca certificate and key are required")
+	}
+	if !config.CA.IsCA {
+		return nil, errors.New("certificate is not a ca")
+	}
+
+	publicKey, ok := config.CAKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(config.CA.PublicKey) {
+		return nil, errors.New("ca certificate does not match the private key")
+	}
+
+	for _, pattern := range config.AllowedCommonNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid common name pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range append(append([]string{}, config.AllowedDNSNames...), config.AllowedURIs...) {
+		if _, err := path.Match(sanPattern(pattern, ""), ""); err != nil {
+			return nil, fmt.Errorf("invalid san pattern %q: %w", pattern, err)
+		}
+	}
+
+	server := &Server{
+		config: config,
+		mux:    http.NewServeMux(),
+	}
+
+	server.mux.HandleFunc(valueOrDefault(config.CAPath, DefaultCAPath), server.handleCA)
+	server.mux.HandleFunc(valueOrDefault(config.CSRPath, DefaultCSRPath), server.handleCSR)
+	if config.ServeCRL {
+		server.mux.HandleFunc(valueOrDefault(config.CRLPath, DefaultCRLPath), server.handleCRL)
+	}
+
+	return server, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	server.mux.ServeHTTP(writer, request)
+}
+
+// Revoke adds the certificate with the given serial number to the CRL.
+func (server *Server) Revoke(serialNumber *big.Int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.revoked = append(server.revoked, pkix.RevokedCertificate{
+		SerialNumber:   serialNumber,
+		RevocationTime: time.Now(),
+	})
+
+	logrus.WithField("serial", serialNumber).Info("Revoked certificate.")
+}
+
+// Sign validates the CSR (common name and SANs) against the policies of
+// the config and issues a certificate that is signed by the CA.
+func (server *Server) Sign(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	err := csr.CheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csr signature: %w", err)
+	}
+
+	err = server.checkCommonName(csr.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.checkSANs(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := serial.Random()
+	if err != nil {
+		return nil, err
+	}
+
+	validity := server.config.Validity
+	if validity <= 0 {
+		validity = defaultValidity
+	}
+	notAfter := time.Now().Add(validity)
+	if notAfter.After(server.config.CA.NotAfter) {
+		notAfter = server.config.CA.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		URIs:         csr.URIs,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, server.config.CA, csr.PublicKey, server.config.CAKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(certDER)
+}
+
+func (server *Server) checkCommonName(commonName string) error {
+	if commonName == "" {
+		return errors.New("common name of the csr is empty")
+	}
+	if len(server.config.AllowedCommonNames) == 0 {
+		return nil
+	}
+
+	for _, pattern := range server.config.AllowedCommonNames {
+		if matched, _ := path.Match(pattern, commonName); matched {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("common name %q is not allowed", commonName)
+}
+
+func (server *Server) checkSANs(csr *x509.CertificateRequest) error {
+	commonName := csr.Subject.CommonName
+
+	dnsPatterns := server.config.AllowedDNSNames
+	if len(dnsPatterns) == 0 {
+		dnsPatterns = []string{commonNamePlaceholder}
+	}
+	for _, dnsName := range csr.DNSNames {
+		if !matchesSAN(dnsPatterns, commonName, dnsName) {
+			return fmt.Errorf("dns name %q is not allowed for common name %q", dnsName, commonName)
+		}
+	}
+
+	for _, uri := range csr.URIs {
+		if !matchesSAN(server.config.AllowedURIs, commonName, uri.String()) {
+			return fmt.Errorf("uri %q is not allowed for common name %q", uri, commonName)
+		}
+	}
+
+	for _, ipAddress := range csr.IPAddresses {
+		allowed := false
+		for _, network := range server.config.AllowedIPNetworks {
+			allowed = allowed || network.Contains(ipAddress)
+		}
+		if !allowed {
+			return fmt.Errorf("ip address %v is not allowed", ipAddress)
+		}
+	}
+
+	if len(csr.EmailAddresses) > 0 {
+		return errors.New("email addresses are not allowed")
+	}
+
+	return nil
+}
+
+func matchesSAN(patterns []string, commonName string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(sanPattern(pattern, commonName), value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sanPattern replaces the placeholder in the pattern with the (escaped) common name.
+func sanPattern(pattern string, commonName string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(commonName)
+	return strings.ReplaceAll(pattern, commonNamePlaceholder, escaped)
+}
+
+func (server *Server) checkBootstrapToken(request *http.Request) bool {
+	if len(server.config.BootstrapTokens) == 0 {
+		return true
+	}
+
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+
+	for _, allowed := range server.config.BootstrapTokens {
+		if subtle.ConstantTimeCompare(token, []byte(allowed)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (server *Server) handleCA(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/x-pem-file")
+	_ = pem.Encode(writer, &pem.Block{Type: "CERTIFICATE", Bytes: server.config.CA.Raw})
+}
+
+func (server *Server) handleCSR(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !server.checkBootstrapToken(request) {
+		logrus.WithField("remote", request.RemoteAddr).Warn("Rejected CSR without a valid bootstrap token.")
+		http.Error(writer, "invalid bootstrap token", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxCSRSize))
+	if err != nil {
+		http.Error(writer, "could not read csr", http.StatusBadRequest)
+		return
+	}
+
+	csrBytes := body
+	if block, _ := pem.Decode(body); block != nil {
+		csrBytes = block.Bytes
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		http.Error(writer, "invalid csr", http.StatusBadRequest)
+		return
+	}
+
+	if server.config.Policy != nil {
+		err = server.config.Policy(csr, request)
+		if err != nil {
+			logrus.WithError(err).WithField("common_name", csr.Subject.CommonName).Warn("Rejected CSR by policy.")
+			http.Error(writer, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	certificate, err := server.Sign(csr)
+	if err != nil {
+		logrus.WithError(err).WithField("common_name", csr.Subject.CommonName).Warn("Rejected CSR.")
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"common_name": certificate.Subject.CommonName,
+		"serial":      certificate.SerialNumber,
+		"not_after":   certificate.NotAfter,
+	}).Info("Signed CSR.")
+
+	writer.Header().Set("Content-Type", "application/x-pem-file")
+	_ = pem.Encode(writer, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+}
+
+func (server *Server) handleCRL(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	crlValidity := server.config.CRLValidity
+	if crlValidity <= 0 {
+		crlValidity = defaultCRLValidity
+	}
+
+	server.mutex.Lock()
+	revoked := append([]pkix.RevokedCertificate{}, server.revoked...)
+	server.mutex.Unlock()
+
+	now := time.Now()
+	crl, err := server.config.CA.CreateCRL(rand.Reader, server.config.CAKey, revoked, now, now.Add(crlValidity))
+	if err != nil {
+		logrus.WithError(err).Error("Could not create CRL.")
+		http.Error(writer, "could not create crl", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/pkix-crl")
+	_, _ = writer.Write(crl)
+}
+
+func valueOrDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
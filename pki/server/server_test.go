@@ -0,0 +1,271 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/pki"
+)
+
+func newTestServer(t *testing.T, config *Config) *Server {
+	var err error
+	config.CA, config.CAKey, err = GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func newCSR(t *testing.T, template *x509.CertificateRequest) *x509.CertificateRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func mustParseURL(t *testing.T, value string) *url.URL {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestSignValidatesSANs(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	server := newTestServer(t, &Config{
+		AllowedCommonNames: []string{"translator-*"},
+		AllowedURIs:        []string{"spiffe://example.org/translator/{cn}"},
+		AllowedIPNetworks:  []*net.IPNet{network},
+	})
+	defaultServer := newTestServer(t, &Config{})
+
+	tests := []struct {
+		name    string
+		server  *Server
+		csr     *x509.CertificateRequest
+		allowed bool
+	}{
+		{
+			name:   "own spiffe id",
+			server: server,
+			csr: &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "translator-a"},
+				DNSNames: []string{"translator-a"},
+				URIs:     []*url.URL{mustParseURL(t, "spiffe://example.org/translator/translator-a")},
+			},
+			allowed: true,
+		},
+		{
+			name:   "spiffe id of another workload",
+			server: server,
+			csr: &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "translator-a"},
+				URIs:    []*url.URL{mustParseURL(t, "spiffe://example.org/translator/translator-b")},
+			},
+		},
+		{
+			name:   "common name with pattern characters",
+			server: server,
+			csr: &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "translator-*"},
+				URIs:    []*url.URL{mustParseURL(t, "spiffe://example.org/translator/translator-b")},
+			},
+		},
+		{
+			name:   "dns name of another workload",
+			server: server,
+			csr: &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "translator-a"},
+				DNSNames: []string{"translator-b"},
+			},
+		},
+		{
+			name:   "ip address in the allowed network",
+			server: server,
+			csr: &x509.CertificateRequest{
+				Subject:     pkix.Name{CommonName: "translator-a"},
+				IPAddresses: []net.IP{net.ParseIP("10.1.2.3")},
+			},
+			allowed: true,
+		},
+		{
+			name:   "ip address outside the allowed network",
+			server: server,
+			csr: &x509.CertificateRequest{
+				Subject:     pkix.Name{CommonName: "translator-a"},
+				IPAddresses: []net.IP{net.ParseIP("192.168.1.1")},
+			},
+		},
+		{
+			name:   "common name as dns name by default",
+			server: defaultServer,
+			csr: &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "translator-a"},
+				DNSNames: []string{"translator-a"},
+			},
+			allowed: true,
+		},
+		{
+			name:   "uri by default",
+			server: defaultServer,
+			csr: &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "translator-a"},
+				URIs:    []*url.URL{mustParseURL(t, "spiffe://example.org/translator/translator-a")},
+			},
+		},
+		{
+			name:   "ip address by default",
+			server: defaultServer,
+			csr: &x509.CertificateRequest{
+				Subject:     pkix.Name{CommonName: "translator-a"},
+				IPAddresses: []net.IP{net.ParseIP("10.1.2.3")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certificate, err := test.server.Sign(newCSR(t, test.csr))
+			if test.allowed && err != nil {
+				t.Fatalf("csr was rejected: %v", err)
+			}
+			if !test.allowed && err == nil {
+				t.Fatalf("csr was signed with the sans %v %v %v", certificate.DNSNames, certificate.URIs, certificate.IPAddresses)
+			}
+		})
+	}
+}
+
+func TestProviderEnrollsWithServer(t *testing.T) {
+	server := newTestServer(t, &Config{
+		AllowedCommonNames: []string{"translator-*"},
+		AllowedURIs:        []string{"spiffe://example.org/translator/{cn}"},
+		BootstrapTokens:    []string{"join"},
+		ServeCRL:           true,
+	})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	config := &pki.Config{
+		BaseAddress:           httpServer.URL,
+		CAPath:                DefaultCAPath,
+		CSRPath:               DefaultCSRPath,
+		CRLPath:               DefaultCRLPath,
+		BootstrapToken:        "join",
+		RequestRetries:        -1,
+		Store:                 pki.NewMemoryStore(),
+		CertificateCommonName: "translator-a",
+		SPIFFEID:              "spiffe://example.org/translator/translator-a",
+		KeyType:               pki.KeyTypeECDSAP256,
+	}
+	provider := pki.NewKeyMaterialProvider(config)
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	material := provider.KeyMaterial()
+	if !material.CA.Equal(server.config.CA) {
+		t.Fatal("provider did not fetch the ca of the server")
+	}
+	if material.Certificate.CheckSignatureFrom(server.config.CA) != nil {
+		t.Fatal("certificate was not issued by the ca of the server")
+	}
+	if material.Certificate.Subject.CommonName != "translator-a" || pki.SPIFFEID(material.Certificate) != config.SPIFFEID {
+		t.Fatalf("unexpected identity %q %q", material.Certificate.Subject.CommonName, pki.SPIFFEID(material.Certificate))
+	}
+
+	checker := pki.NewRevocationChecker(config, provider)
+	err = checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checker.Check(material.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Revoke(material.Certificate.SerialNumber)
+	err = checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checker.Check(material.Certificate)
+	if !errors.Is(err, pki.ErrCertificateRevoked) {
+		t.Fatalf("revoked certificate was accepted: %v", err)
+	}
+}
+
+func TestServerRejectsEnrollment(t *testing.T) {
+	server := newTestServer(t, &Config{
+		AllowedCommonNames: []string{"translator-*"},
+		BootstrapTokens:    []string{"join"},
+	})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tests := []struct {
+		name   string
+		config pki.Config
+	}{
+		{
+			name:   "missing bootstrap token",
+			config: pki.Config{CertificateCommonName: "translator-a"},
+		},
+		{
+			name:   "invalid bootstrap token",
+			config: pki.Config{CertificateCommonName: "translator-a", BootstrapToken: "other"},
+		},
+		{
+			name:   "common name not allowed",
+			config: pki.Config{CertificateCommonName: "admin", BootstrapToken: "join"},
+		},
+		{
+			name:   "spiffe id not allowed",
+			config: pki.Config{CertificateCommonName: "translator-a", BootstrapToken: "join", SPIFFEID: "spiffe://example.org/admin"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := test.config
+			config.BaseAddress = httpServer.URL
+			config.CAPath = DefaultCAPath
+			config.CSRPath = DefaultCSRPath
+			config.RequestRetries = -1
+			config.Store = pki.NewMemoryStore()
+			config.KeyType = pki.KeyTypeECDSAP256
+
+			err := pki.NewKeyMaterialProvider(&config).Ensure()
+			if err == nil {
+				t.Fatal("enrollment was accepted")
+			}
+		})
+	}
+}
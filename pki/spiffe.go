@@ -0,0 +1,45 @@
+package pki
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const spiffeScheme = "spiffe"
+
+// SPIFFEIDForServiceAccount returns the SPIFFE ID of a Kubernetes workload in
+// the form "spiffe://<trust-domain>/ns/<namespace>/sa/<service-account>".
+func SPIFFEIDForServiceAccount(trustDomain string, namespace string, serviceAccount string) string {
+	return fmt.Sprintf("%v://%v/ns/%v/sa/%v", spiffeScheme, trustDomain, namespace, serviceAccount)
+}
+
+// ParseSPIFFEID parses and validates a SPIFFE ID ("spiffe://<trust-domain>/<path>").
+func ParseSPIFFEID(id string) (*url.URL, error) {
+	spiffeID, err := url.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if spiffeID.Scheme != spiffeScheme || spiffeID.Host == "" || spiffeID.User != nil ||
+		spiffeID.Port() != "" || spiffeID.RawQuery != "" || spiffeID.Fragment != "" {
+		return nil, fmt.Errorf("invalid spiffe id %q", id)
+	}
+	if strings.ToLower(spiffeID.Host) != spiffeID.Host {
+		return nil, fmt.Errorf("trust domain of spiffe id %q must be lower case", id)
+	}
+
+	return spiffeID, nil
+}
+
+// SPIFFEID returns the SPIFFE ID (URI SAN) of the certificate.
+// If the certificate contains no SPIFFE ID, an empty string is returned.
+func SPIFFEID(certificate *x509.Certificate) string {
+	for _, uri := range certificate.URIs {
+		if uri.Scheme == spiffeScheme {
+			return uri.String()
+		}
+	}
+	return ""
+}
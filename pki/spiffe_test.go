@@ -0,0 +1,126 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+func TestParseSPIFFEID(t *testing.T) {
+	valid := []string{
+		"spiffe://example.org/translator",
+		"spiffe://example.org",
+		SPIFFEIDForServiceAccount("cluster.local", "default", "app"),
+	}
+	for _, id := range valid {
+		if _, err := ParseSPIFFEID(id); err != nil {
+			t.Fatalf("rejected the valid spiffe id %q: %v", id, err)
+		}
+	}
+
+	invalid := []string{
+		"https://example.org/translator",
+		"spiffe:///translator",
+		"spiffe://user@example.org/translator",
+		"spiffe://example.org:8080/translator",
+		"spiffe://example.org/translator?query",
+		"spiffe://example.org/translator#fragment",
+		"spiffe://Example.org/translator",
+	}
+	for _, id := range invalid {
+		if _, err := ParseSPIFFEID(id); err == nil {
+			t.Fatalf("accepted the invalid spiffe id %q", id)
+		}
+	}
+
+	if id := SPIFFEIDForServiceAccount("cluster.local", "default", "app"); id != "spiffe://cluster.local/ns/default/sa/app" {
+		t.Fatalf("unexpected spiffe id %q", id)
+	}
+}
+
+func TestCSRContainsSANs(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+
+	var mutex sync.Mutex
+	var csrs [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == pkitest.CSRPath {
+			body, _ := io.ReadAll(request.Body)
+			mutex.Lock()
+			csrs = append(csrs, body)
+			mutex.Unlock()
+			request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		testPKI.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+
+	config := withTestPKI(&Config{
+		Store:                   NewMemoryStore(),
+		CertificateCommonName:   "translator",
+		CertificateOrganization: []string{"Example"},
+		CertificateDNSNames:     []string{"translator.local", "translator.default.svc"},
+		CertificateIPAddresses:  []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		SPIFFEID:                "spiffe://example.org/translator",
+		KeyType:                 KeyTypeECDSAP256,
+	}, testPKI)
+	config.BaseAddress = server.URL
+
+	provider := NewKeyMaterialProvider(config)
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(csrs) != 1 {
+		t.Fatalf("expected a single csr, got %v", len(csrs))
+	}
+
+	block, _ := pem.Decode(csrs[0])
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		t.Fatal("csr is not pem encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csr.Subject.CommonName != "translator" || !reflect.DeepEqual(csr.Subject.Organization, []string{"Example"}) {
+		t.Fatalf("unexpected subject %v", csr.Subject)
+	}
+	if !reflect.DeepEqual(csr.DNSNames, config.CertificateDNSNames) {
+		t.Fatalf("unexpected dns names %v", csr.DNSNames)
+	}
+	if len(csr.IPAddresses) != 2 || !csr.IPAddresses[0].Equal(config.CertificateIPAddresses[0]) || !csr.IPAddresses[1].Equal(config.CertificateIPAddresses[1]) {
+		t.Fatalf("unexpected ip addresses %v", csr.IPAddresses)
+	}
+	if len(csr.URIs) != 1 || csr.URIs[0].String() != config.SPIFFEID {
+		t.Fatalf("unexpected uris %v", csr.URIs)
+	}
+
+	if SPIFFEID(provider.KeyMaterial().Certificate) != config.SPIFFEID {
+		t.Fatal("certificate does not contain the spiffe id")
+	}
+}
+
+func TestEnrollmentRejectsInvalidSPIFFEID(t *testing.T) {
+	provider := NewKeyMaterialProvider(withTestPKI(&Config{
+		Store:                 NewMemoryStore(),
+		CertificateCommonName: "translator",
+		SPIFFEID:              "spiffe://Example.org/translator",
+		KeyType:               KeyTypeECDSAP256,
+	}, pkitest.NewPKI(t, nil)))
+
+	if provider.Ensure() == nil {
+		t.Fatal("enrolled with an invalid spiffe id")
+	}
+}
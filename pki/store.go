@@ -0,0 +1,227 @@
+package pki
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Store persists the key material of a translator as named entries
+// ("ca.crt", "cert.crt", "cert.key" and "ca-chain.crt" after a CA rotation).
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Load returns all stored entries. Missing entries are omitted.
+	Load() (map[string][]byte, error)
+
+	// Save stores the given entries and keeps all other entries. The entries
+	// of a single call are written atomically where the backend supports it.
+	Save(entries map[string][]byte) error
+}
+
+// FileStore stores the entries as files in a directory. All entries are written
+// into a new version directory, which is swapped in by renaming the "..data"
+// symlink. Therefore, readers (e.g. multiple sidecars sharing a volume) always see
+// a consistent set of entries, even if a writer crashes. The entries are linked
+// into the directory (e.g. "cert.crt" -> "..data/cert.crt") for other consumers.
+type FileStore struct {
+	// The relative or absolute path to the directory. If omitted,
+	// the current application execution directory is used.
+	Dir string
+}
+
+const (
+	fileStoreDataLink      = "..data"
+	fileStoreVersionPrefix = "..version-"
+	maxFileStoreLoadTries  = 3
+)
+
+// Load reads the entries of the current version directory. If the directory
+// was not written by a FileStore with version directories yet, the key material
+// files of the directory itself are read.
+func (store *FileStore) Load() (map[string][]byte, error) {
+	for try := 1; ; try++ {
+		version, err := os.Readlink(store.path(fileStoreDataLink))
+		if errors.Is(err, os.ErrNotExist) {
+			return store.loadFiles("", []string{caFilename, certFilename, keyFilename})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err := store.loadVersion(version)
+		// A concurrent Save removes the previous version directory after the swap.
+		if errors.Is(err, os.ErrNotExist) && try < maxFileStoreLoadTries {
+			continue
+		}
+		return entries, err
+	}
+}
+
+func (store *FileStore) loadVersion(version string) (map[string][]byte, error) {
+	files, err := os.ReadDir(store.path(version))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.Type().IsRegular() {
+			names = append(names, file.Name())
+		}
+	}
+
+	entries, err := store.loadFiles(version, names)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != len(names) {
+		return nil, fmt.Errorf("version %v of the key material was removed: %w", version, os.ErrNotExist)
+	}
+	return entries, nil
+}
+
+func (store *FileStore) loadFiles(version string, names []string) (map[string][]byte, error) {
+	entries := map[string][]byte{}
+	for _, name := range names {
+		data, err := os.ReadFile(store.path(filepath.Join(version, name)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[name] = data
+	}
+
+	return entries, nil
+}
+
+// Save writes the entries (merged with the stored entries) into a new version
+// directory and swaps it in. Private keys are only readable by the owner.
+func (store *FileStore) Save(entries map[string][]byte) error {
+	previous, _ := os.Readlink(store.path(fileStoreDataLink))
+
+	merged, err := store.Load()
+	if err != nil {
+		return err
+	}
+	for name, data := range entries {
+		merged[name] = data
+	}
+
+	dir := store.Dir
+	if dir == "" {
+		dir = "."
+	}
+	versionDir, err := os.MkdirTemp(dir, fileStoreVersionPrefix)
+	if err != nil {
+		return err
+	}
+	version := filepath.Base(versionDir)
+
+	err = store.writeVersion(versionDir, merged)
+	if err == nil {
+		err = store.replaceSymlink(version, fileStoreDataLink, version)
+	}
+	if err != nil {
+		_ = os.RemoveAll(versionDir)
+		return err
+	}
+
+	for name := range merged {
+		err = store.replaceSymlink(filepath.Join(fileStoreDataLink, name), name, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.HasPrefix(previous, fileStoreVersionPrefix) && previous != version {
+		_ = os.RemoveAll(store.path(previous))
+	}
+
+	return nil
+}
+
+func (store *FileStore) writeVersion(versionDir string, entries map[string][]byte) error {
+	err := os.Chmod(versionDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for name, data := range entries {
+		perm := os.FileMode(0644)
+		if strings.HasSuffix(name, ".key") {
+			perm = 0600
+		}
+
+		err = os.WriteFile(filepath.Join(versionDir, name), data, perm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceSymlink atomically replaces the file with a symlink to the target.
+func (store *FileStore) replaceSymlink(target string, name string, version string) error {
+	if existing, err := os.Readlink(store.path(name)); err == nil && existing == target {
+		return nil
+	}
+
+	temp := store.path(name + "." + strings.TrimPrefix(version, fileStoreVersionPrefix) + ".tmp")
+	err := os.Symlink(target, temp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temp, store.path(name))
+	if err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+func (store *FileStore) path(name string) string {
+	return filepath.Join(store.Dir, name)
+}
+
+// MemoryStore keeps the entries in memory. The key material is lost when the
+// process stops, which requires a new certificate for every start (e.g. for
+// pods with a read-only root filesystem and no persistent volume).
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	entries map[string][]byte
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string][]byte{}}
+}
+
+// Load returns a copy of the stored entries.
+func (store *MemoryStore) Load() (map[string][]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	entries := make(map[string][]byte, len(store.entries))
+	for name, data := range store.entries {
+		entries[name] = append([]byte(nil), data...)
+	}
+	return entries, nil
+}
+
+// Save stores a copy of the entries.
+func (store *MemoryStore) Save(entries map[string][]byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for name, data := range entries {
+		store.entries[name] = append([]byte(nil), data...)
+	}
+	return nil
+}
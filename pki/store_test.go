@@ -0,0 +1,129 @@
+package pki
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileStoreMigratesLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{caFilename: "ca", certFilename: "cert-1", keyFilename: "key-1"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &FileStore{Dir: dir}
+	err := store.Save(map[string][]byte{certFilename: []byte("cert-2"), keyFilename: []byte("key-2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entries[caFilename]) != "ca" || string(entries[certFilename]) != "cert-2" || string(entries[keyFilename]) != "key-2" {
+		t.Fatalf("unexpected entries: %q", entries)
+	}
+
+	// The files in the directory are linked to the current version.
+	data, err := os.ReadFile(filepath.Join(dir, certFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "cert-2" {
+		t.Fatalf("unexpected linked certificate: %q", data)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, keyFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("private key is not private: %v", info.Mode())
+	}
+}
+
+func TestFileStoreRemovesPreviousVersion(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileStore{Dir: dir}
+
+	for i := 0; i < 3; i++ {
+		err := store.Save(map[string][]byte{certFilename: []byte(fmt.Sprint(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := 0
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), fileStoreVersionPrefix) {
+			versions++
+		}
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			t.Fatalf("temporary file %v was not removed", file.Name())
+		}
+	}
+	if versions != 1 {
+		t.Fatalf("expected one version directory, found %v", versions)
+	}
+}
+
+func TestFileStoreSavesConsistentSets(t *testing.T) {
+	dir := t.TempDir()
+	writers := []*FileStore{{Dir: dir}, {Dir: dir}}
+	reader := &FileStore{Dir: dir}
+
+	err := writers[0].Save(map[string][]byte{certFilename: []byte("initial"), keyFilename: []byte("initial")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w, writer := range writers {
+		wg.Add(1)
+		go func(w int, writer *FileStore) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				enrollment := []byte(fmt.Sprintf("%v-%v", w, i))
+				err := writer.Save(map[string][]byte{certFilename: enrollment, keyFilename: enrollment})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w, writer)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		entries, err := reader.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entries[certFilename]) != string(entries[keyFilename]) {
+			t.Fatalf("certificate %q and key %q of different enrollments", entries[certFilename], entries[keyFilename])
+		}
+	}
+}
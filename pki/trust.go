@@ -0,0 +1,276 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TrustAnchor is a trusted root CA certificate. If AllowedIssuers is set,
+// only JWTs with one of the given issuers are accepted when they are signed
+// by a certificate that chains to this anchor.
+type TrustAnchor struct {
+	Certificate    *x509.Certificate
+	AllowedIssuers []string
+}
+
+// AllowsIssuer checks if the anchor accepts JWTs from the given issuer.
+func (anchor *TrustAnchor) AllowsIssuer(issuer string) bool {
+	if len(anchor.AllowedIssuers) == 0 {
+		return true
+	}
+
+	for _, allowed := range anchor.AllowedIssuers {
+		if allowed == issuer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TrustRoots is an immutable set of trust anchors.
+type TrustRoots struct {
+	pool    *x509.CertPool
+	anchors map[string]*TrustAnchor
+}
+
+// NewTrustRoots creates an immutable set of the given trust anchors.
+func NewTrustRoots(anchors ...*TrustAnchor) *TrustRoots {
+	roots := &TrustRoots{
+		pool:    x509.NewCertPool(),
+		anchors: map[string]*TrustAnchor{},
+	}
+
+	for _, anchor := range anchors {
+		if anchor == nil || anchor.Certificate == nil {
+			continue
+		}
+
+		key := string(anchor.Certificate.Raw)
+		if existing, ok := roots.anchors[key]; ok {
+			roots.anchors[key] = mergeAnchors(existing, anchor)
+			continue
+		}
+
+		roots.pool.AddCert(anchor.Certificate)
+		roots.anchors[key] = anchor
+	}
+
+	return roots
+}
+
+// mergeAnchors combines two anchors of the same certificate. An anchor
+// without allowed issuers allows all issuers and therefore wins.
+func mergeAnchors(a *TrustAnchor, b *TrustAnchor) *TrustAnchor {
+	if len(a.AllowedIssuers) == 0 || len(b.AllowedIssuers) == 0 {
+		return &TrustAnchor{Certificate: a.Certificate}
+	}
+
+	issuers := append(append([]string{}, a.AllowedIssuers...), b.AllowedIssuers...)
+	return &TrustAnchor{Certificate: a.Certificate, AllowedIssuers: issuers}
+}
+
+// CertPool returns the certificate pool that contains all anchors.
+// The returned pool must not be modified.
+func (roots *TrustRoots) CertPool() *x509.CertPool {
+	return roots.pool
+}
+
+// Anchor returns the trust anchor for the given root certificate
+// (the last certificate of a verified chain) or nil if the root is not trusted.
+func (roots *TrustRoots) Anchor(root *x509.Certificate) *TrustAnchor {
+	return roots.anchors[string(root.Raw)]
+}
+
+// Anchors returns all anchors of the set.
+func (roots *TrustRoots) Anchors() []*TrustAnchor {
+	anchors := make([]*TrustAnchor, 0, len(roots.anchors))
+	for _, anchor := range roots.anchors {
+		anchors = append(anchors, anchor)
+	}
+	return anchors
+}
+
+// TrustSource loads trust anchors for a TrustBundle.
+type TrustSource interface {
+	Load() ([]*TrustAnchor, error)
+}
+
+// TrustSourceFunc is an adapter to use a function as TrustSource.
+type TrustSourceFunc func() ([]*TrustAnchor, error)
+
+// Load implements TrustSource.
+func (f TrustSourceFunc) Load() ([]*TrustAnchor, error) {
+	return f()
+}
+
+// FileTrustSource loads all PEM encoded certificates of the given path.
+// If the path is a directory, all "*.crt" and "*.pem" files in the
+// directory are loaded. The allowed issuers are set for all loaded anchors.
+func FileTrustSource(path string, allowedIssuers ...string) TrustSource {
+	return TrustSourceFunc(func() ([]*TrustAnchor, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files := []string{path}
+		if info.IsDir() {
+			files = nil
+			for _, pattern := range []string{"*.crt", "*.pem"} {
+				matches, err := filepath.Glob(filepath.Join(path, pattern))
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, matches...)
+			}
+		}
+
+		var anchors []*TrustAnchor
+		for _, file := range files {
+			certPEMBlock, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			fileAnchors, err := parseTrustAnchors(certPEMBlock, allowedIssuers)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", file, err)
+			}
+			anchors = append(anchors, fileAnchors...)
+		}
+
+		return anchors, nil
+	})
+}
+
+// PKITrustSource loads the CA certificate(s) from the CA endpoint of the
+// configured PKI. The allowed issuers are set for all loaded anchors.
+func PKITrustSource(config *Config, allowedIssuers ...string) TrustSource {
+	return TrustSourceFunc(func() ([]*TrustAnchor, error) {
+		certPEMBlock, err := NewClient(config).FetchCABundle(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		return parseTrustAnchors(certPEMBlock, allowedIssuers)
+	})
+}
+
+// LocalCATrustSource uses the CA certificate (or the bundle, see KeyMaterial.Roots)
+// of the key material of the provider.
+func LocalCATrustSource(provider KeyMaterialProvider, allowedIssuers ...string) TrustSource {
+	return TrustSourceFunc(func() ([]*TrustAnchor, error) {
+		material := provider.KeyMaterial()
+		if material == nil || material.CA == nil {
+			return nil, errors.New("no ca certificate loaded")
+		}
+
+		var anchors []*TrustAnchor
+		for _, root := range material.Roots() {
+			anchors = append(anchors, &TrustAnchor{Certificate: root, AllowedIssuers: allowedIssuers})
+		}
+		return anchors, nil
+	})
+}
+
+func parseTrustAnchors(certPEMBlock []byte, allowedIssuers []string) ([]*TrustAnchor, error) {
+	var anchors []*TrustAnchor
+	for {
+		var block *pem.Block
+		block, certPEMBlock = pem.Decode(certPEMBlock)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, &TrustAnchor{Certificate: certificate, AllowedIssuers: allowedIssuers})
+	}
+
+	if len(anchors) == 0 {
+		return nil, errors.New("no pem encoded certificate found")
+	}
+
+	return anchors, nil
+}
+
+// TrustBundle holds multiple trusted root CAs that are loaded from
+// the configured sources. The bundle can be reloaded at runtime.
+type TrustBundle struct {
+	mutex   sync.RWMutex
+	sources []TrustSource
+	roots   *TrustRoots
+}
+
+// NewTrustBundle creates a trust bundle with the given sources.
+// The bundle is empty until Reload is called.
+func NewTrustBundle(sources ...TrustSource) *TrustBundle {
+	return &TrustBundle{
+		sources: sources,
+		roots:   NewTrustRoots(),
+	}
+}
+
+// Roots returns the currently trusted roots.
+func (bundle *TrustBundle) Roots() *TrustRoots {
+	bundle.mutex.RLock()
+	defer bundle.mutex.RUnlock()
+
+	return bundle.roots
+}
+
+// Reload loads the anchors of all sources. The trusted roots are only
+// replaced if all sources could be loaded.
+func (bundle *TrustBundle) Reload() error {
+	var anchors []*TrustAnchor
+	for _, source := range bundle.sources {
+		sourceAnchors, err := source.Load()
+		if err != nil {
+			return err
+		}
+		anchors = append(anchors, sourceAnchors...)
+	}
+
+	roots := NewTrustRoots(anchors...)
+
+	bundle.mutex.Lock()
+	bundle.roots = roots
+	bundle.mutex.Unlock()
+
+	logrus.WithField("anchors", len(roots.anchors)).Debug("Reloaded trust bundle.")
+
+	return nil
+}
+
+// Watch reloads the bundle in the given interval until the context is done.
+// Failed reloads are logged and the previous roots stay active.
+func (bundle *TrustBundle) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := bundle.Reload(); err != nil {
+				logrus.WithError(err).Warn("Could not reload trust bundle. Keep previous roots.")
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package pki
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+func TestTrustRootsMergesAnchorsOfTheSameCA(t *testing.T) {
+	ca := pkitest.NewCA(t, "ca", nil)
+
+	roots := NewTrustRoots(
+		&TrustAnchor{Certificate: ca.Certificate, AllowedIssuers: []string{"a"}},
+		&TrustAnchor{Certificate: ca.Certificate, AllowedIssuers: []string{"b"}},
+		nil,
+	)
+	anchor := roots.Anchor(ca.Certificate)
+	if len(roots.Anchors()) != 1 || anchor == nil {
+		t.Fatal("anchors of the same ca were not merged")
+	}
+	if !anchor.AllowsIssuer("a") || !anchor.AllowsIssuer("b") || anchor.AllowsIssuer("c") {
+		t.Fatalf("unexpected allowed issuers %v", anchor.AllowedIssuers)
+	}
+
+	// An anchor without allowed issuers allows all issuers.
+	roots = NewTrustRoots(
+		&TrustAnchor{Certificate: ca.Certificate, AllowedIssuers: []string{"a"}},
+		&TrustAnchor{Certificate: ca.Certificate},
+	)
+	if !roots.Anchor(ca.Certificate).AllowsIssuer("c") {
+		t.Fatal("unrestricted anchor was restricted by the merge")
+	}
+
+	if roots.Anchor(pkitest.NewCA(t, "other", nil).Certificate) != nil {
+		t.Fatal("returned an anchor for an untrusted ca")
+	}
+}
+
+func TestFileTrustSourceLoadsDirectory(t *testing.T) {
+	a, b, c, ignored := pkitest.NewCA(t, "a", nil), pkitest.NewCA(t, "b", nil), pkitest.NewCA(t, "c", nil), pkitest.NewCA(t, "ignored", nil)
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"bundle.crt":  append(a.PEM(), b.PEM()...),
+		"c.pem":       c.PEM(),
+		"ignored.txt": ignored.PEM(),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	anchors, err := FileTrustSource(dir, "partner").Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := NewTrustRoots(anchors...)
+	for _, ca := range []*pkitest.CA{a, b, c} {
+		anchor := roots.Anchor(ca.Certificate)
+		if anchor == nil {
+			t.Fatalf("ca %v was not loaded", ca.Certificate.Subject)
+		}
+		if anchor.AllowsIssuer("other") || !anchor.AllowsIssuer("partner") {
+			t.Fatal("allowed issuers were not set")
+		}
+	}
+	if len(anchors) != 3 {
+		t.Fatalf("expected 3 anchors, got %v", len(anchors))
+	}
+
+	_, err = FileTrustSource(filepath.Join(dir, "ignored.txt")).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = FileTrustSource(filepath.Join(dir, "missing.pem")).Load()
+	if err == nil {
+		t.Fatal("loaded a missing file")
+	}
+}
+
+func TestPKITrustSource(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+
+	anchors, err := PKITrustSource(withTestPKI(&Config{}, testPKI)).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != 1 || !anchors[0].Certificate.Equal(testPKI.CA().Certificate) {
+		t.Fatal("ca of the pki was not loaded")
+	}
+}
+
+func TestTrustBundleKeepsRootsOfFailedReload(t *testing.T) {
+	current, federated := pkitest.NewCA(t, "current", nil), pkitest.NewCA(t, "federated", nil)
+
+	var federatedErr error
+	bundle := NewTrustBundle(
+		TrustSourceFunc(func() ([]*TrustAnchor, error) {
+			return []*TrustAnchor{{Certificate: current.Certificate}}, nil
+		}),
+		TrustSourceFunc(func() ([]*TrustAnchor, error) {
+			return []*TrustAnchor{{Certificate: federated.Certificate}}, federatedErr
+		}),
+	)
+	if len(bundle.Roots().Anchors()) != 0 {
+		t.Fatal("bundle is not empty before the first reload")
+	}
+
+	err := bundle.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Roots().Anchor(current.Certificate) == nil || bundle.Roots().Anchor(federated.Certificate) == nil {
+		t.Fatal("anchors of all sources are not trusted")
+	}
+
+	federatedErr = errors.New("unavailable")
+	roots := bundle.Roots()
+	if bundle.Reload() == nil {
+		t.Fatal("reload with a failed source succeeded")
+	}
+	if bundle.Roots() != roots {
+		t.Fatal("roots were replaced by a failed reload")
+	}
+}
@@ -0,0 +1,501 @@
+package pki
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// WorkloadAPIEndpointEnv is the environment variable that contains the
+	// address of the SPIFFE Workload API (e.g. "unix:///run/spire/sockets/agent.sock").
+	WorkloadAPIEndpointEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+	// WorkloadAPIFetchX509SVIDMethod is the (server streaming) gRPC method of the
+	// SPIFFE Workload API that delivers the X.509-SVIDs and bundles of the workload.
+	WorkloadAPIFetchX509SVIDMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+	workloadAPIHeader = "workload.spiffe.io"
+
+	defaultWorkloadAPITimeout       = 30 * time.Second
+	defaultWorkloadAPIRetryInterval = time.Second
+)
+
+// WorkloadAPIConfig contains the information about the SPIFFE Workload API
+// (e.g. of a SPIRE agent) that provides the key material.
+type WorkloadAPIConfig struct {
+	// The address of the Workload API (gRPC target, e.g. "unix:///run/spire/sockets/agent.sock").
+	// If omitted, the SPIFFE_ENDPOINT_SOCKET environment variable is used.
+	Address string
+
+	// If set, the X.509-SVID with the given SPIFFE ID is used.
+	// If omitted, the first (default) X.509-SVID of the workload is used.
+	SPIFFEID string
+
+	// The timeout for the first X.509-SVID in Ensure. If omitted, 30 seconds are used.
+	Timeout time.Duration
+
+	// The interval after the first failed connection to the Workload API in Watch.
+	// The interval is doubled for every further failure (up to 5 minutes).
+	// If omitted, 1 second is used.
+	RetryInterval time.Duration
+
+	// Additional options for the gRPC connection to the Workload API.
+	DialOptions []grpc.DialOption
+}
+
+func (config *WorkloadAPIConfig) address() string {
+	if config.Address == "" {
+		return os.Getenv(WorkloadAPIEndpointEnv)
+	}
+	return config.Address
+}
+
+func (config *WorkloadAPIConfig) timeout() time.Duration {
+	if config.Timeout == 0 {
+		return defaultWorkloadAPITimeout
+	}
+	return config.Timeout
+}
+
+func (config *WorkloadAPIConfig) retryInterval() time.Duration {
+	if config.RetryInterval == 0 {
+		return defaultWorkloadAPIRetryInterval
+	}
+	return config.RetryInterval
+}
+
+// WorkloadAPIKeyMaterialProvider fetches the key material (X.509-SVID and trust
+// bundle) from a SPIFFE Workload API instead of the (WirePact-)PKI. The Workload
+// API pushes rotated SVIDs and bundles, which are swapped in by Watch.
+// The key material is never stored, since the Workload API manages it.
+type WorkloadAPIKeyMaterialProvider struct {
+	config *WorkloadAPIConfig
+
+	mutex     sync.RWMutex
+	current   *KeyMaterial
+	federated map[string][]*x509.Certificate
+	callbacks []func()
+}
+
+// NewWorkloadAPIKeyMaterialProvider creates a provider for the given config.
+// The key material is not loaded until Ensure is called.
+func NewWorkloadAPIKeyMaterialProvider(config *WorkloadAPIConfig) *WorkloadAPIKeyMaterialProvider {
+	return &WorkloadAPIKeyMaterialProvider{config: config}
+}
+
+// Ensure fetches the X.509-SVID and the bundle from the Workload API.
+func (provider *WorkloadAPIKeyMaterialProvider) Ensure() error {
+	ctx, cancel := context.WithTimeout(context.Background(), provider.config.timeout())
+	defer cancel()
+
+	_, err := provider.fetch(ctx, true)
+	return err
+}
+
+// KeyMaterial returns the current snapshot of the key material.
+func (provider *WorkloadAPIKeyMaterialProvider) KeyMaterial() *KeyMaterial {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	return provider.current
+}
+
+// TrustSource returns a TrustSource with the bundle of the own trust domain
+// and the federated bundles of the Workload API.
+func (provider *WorkloadAPIKeyMaterialProvider) TrustSource(allowedIssuers ...string) TrustSource {
+	return TrustSourceFunc(func() ([]*TrustAnchor, error) {
+		provider.mutex.RLock()
+		defer provider.mutex.RUnlock()
+
+		if provider.current == nil {
+			return nil, errors.New("no spiffe bundle loaded")
+		}
+
+		var anchors []*TrustAnchor
+		for _, root := range provider.current.Roots() {
+			anchors = append(anchors, &TrustAnchor{Certificate: root, AllowedIssuers: allowedIssuers})
+		}
+		for _, bundle := range provider.federated {
+			for _, root := range bundle {
+				anchors = append(anchors, &TrustAnchor{Certificate: root, AllowedIssuers: allowedIssuers})
+			}
+		}
+		return anchors, nil
+	})
+}
+
+// OnUpdate registers a callback that is called whenever the Workload API pushed
+// new key material or bundles, e.g. to reload a TrustBundle that contains the
+// TrustSource of the provider without waiting for its reload interval.
+func (provider *WorkloadAPIKeyMaterialProvider) OnUpdate(callback func()) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.callbacks = append(provider.callbacks, callback)
+}
+
+// Watch receives the rotated X.509-SVIDs and bundles from the Workload API until
+// the context is done. If the connection fails, it is re-established with an
+// exponential backoff while the current key material stays active. The backoff
+// starts over once a connection delivered valid key material.
+func (provider *WorkloadAPIKeyMaterialProvider) Watch(ctx context.Context) {
+	retryInterval := provider.config.retryInterval()
+
+	for {
+		applied, err := provider.fetch(ctx, false)
+		if ctx.Err() != nil {
+			return
+		}
+		if applied {
+			// The connection worked, the backoff starts over.
+			retryInterval = provider.config.retryInterval()
+		}
+
+		logrus.WithError(err).WithField("retry_in", retryInterval).Warn("Lost connection to the SPIFFE Workload API.")
+
+		if !sleep(ctx, retryInterval) {
+			return
+		}
+
+		retryInterval *= 2
+		if retryInterval > maxRenewalRetryInterval {
+			retryInterval = maxRenewalRetryInterval
+		}
+	}
+}
+
+// fetch streams the X.509-SVID responses of the Workload API and applies them.
+// If once is set, fetch returns after the first valid response. The returned
+// bool defines if at least one response was applied.
+func (provider *WorkloadAPIKeyMaterialProvider) fetch(ctx context.Context, once bool) (bool, error) {
+	address := provider.config.address()
+	if address == "" {
+		return false, fmt.Errorf("spiffe workload api address not set (%v)", WorkloadAPIEndpointEnv)
+	}
+
+	options := append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, provider.config.DialOptions...)
+	conn, err := grpc.DialContext(ctx, address, options...)
+	if err != nil {
+		return false, fmt.Errorf("could not connect to the spiffe workload api: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(ctx, workloadAPIHeader, "true"))
+	defer cancel()
+
+	stream, err := conn.NewStream(
+		ctx,
+		&grpc.StreamDesc{StreamName: "FetchX509SVID", ServerStreams: true},
+		WorkloadAPIFetchX509SVIDMethod,
+		grpc.ForceCodec(workloadAPICodec{}))
+	if err != nil {
+		return false, err
+	}
+
+	err = stream.SendMsg(&workloadAPIMessage{})
+	if err != nil {
+		return false, err
+	}
+	err = stream.CloseSend()
+	if err != nil {
+		return false, err
+	}
+
+	applied := false
+	for {
+		response := &workloadAPIMessage{}
+		err = stream.RecvMsg(response)
+		if err != nil {
+			return applied, err
+		}
+
+		err = provider.apply(response.data)
+		if err != nil {
+			if once {
+				return false, err
+			}
+			logrus.WithError(err).Error("Received invalid X.509-SVID from the SPIFFE Workload API.")
+			continue
+		}
+
+		applied = true
+		if once {
+			return true, nil
+		}
+	}
+}
+
+// apply parses an X509SVIDResponse and swaps in the new key material.
+func (provider *WorkloadAPIKeyMaterialProvider) apply(data []byte) error {
+	response, err := parseX509SVIDResponse(data)
+	if err != nil {
+		return err
+	}
+
+	var svid *x509SVID
+	for _, candidate := range response.svids {
+		if provider.config.SPIFFEID == "" || candidate.spiffeID == provider.config.SPIFFEID {
+			svid = candidate
+			break
+		}
+	}
+	if svid == nil {
+		return fmt.Errorf("no x509-svid for spiffe id %q received", provider.config.SPIFFEID)
+	}
+
+	material, err := svid.keyMaterial()
+	if err != nil {
+		return fmt.Errorf("invalid x509-svid %q: %w", svid.spiffeID, err)
+	}
+
+	federated := map[string][]*x509.Certificate{}
+	for trustDomain, bundle := range response.federatedBundles {
+		federated[trustDomain], err = x509.ParseCertificates(bundle)
+		if err != nil {
+			return fmt.Errorf("invalid federated bundle %q: %w", trustDomain, err)
+		}
+	}
+
+	provider.mutex.Lock()
+	provider.current = material
+	provider.federated = federated
+	callbacks := provider.callbacks
+	provider.mutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"spiffe_id": svid.spiffeID,
+		"serial":    material.Certificate.SerialNumber,
+		"not_after": material.Certificate.NotAfter,
+	}).Info("Loaded X.509-SVID from the SPIFFE Workload API.")
+
+	for _, callback := range callbacks {
+		callback()
+	}
+
+	return nil
+}
+
+type x509SVIDResponse struct {
+	svids            []*x509SVID
+	federatedBundles map[string][]byte
+}
+
+type x509SVID struct {
+	spiffeID string
+	svid     []byte
+	key      []byte
+	bundle   []byte
+}
+
+// keyMaterial validates the SVID and converts it into key material. The CA
+// is the root certificate of the bundle that issued the SVID.
+func (svid *x509SVID) keyMaterial() (*KeyMaterial, error) {
+	chain, err := x509.ParseCertificates(svid.svid)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate")
+	}
+
+	bundle, err := x509.ParseCertificates(svid.bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(svid.key)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	keyType, err := keyTypeOf(privateKey, "")
+	if err != nil {
+		return nil, err
+	}
+
+	material := &KeyMaterial{
+		Certificate:   chain[0],
+		Intermediates: chain[1:],
+		PrivateKey:    privateKey,
+		KeyType:       keyType,
+		Bundle:        bundle,
+	}
+
+	if SPIFFEID(material.Certificate) != svid.spiffeID {
+		return nil, fmt.Errorf("certificate does not contain the spiffe id %q", svid.spiffeID)
+	}
+
+	roots := x509.NewCertPool()
+	for _, root := range bundle {
+		roots.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range material.Intermediates {
+		intermediates.AddCert(intermediate)
+	}
+
+	chains, err := material.Certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	verified := chains[0]
+	issuer := verified[0]
+	if len(verified) > 1 {
+		issuer = verified[1]
+		material.Intermediates = verified[1 : len(verified)-1]
+	}
+	material.CA = verified[len(verified)-1]
+
+	err = validateCertificate(material.Certificate, privateKey, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return material, nil
+}
+
+// parseX509SVIDResponse decodes the protobuf encoded X509SVIDResponse message
+// of the Workload API (svids = 1, federated_bundles = 3).
+func parseX509SVIDResponse(data []byte) (*x509SVIDResponse, error) {
+	response := &x509SVIDResponse{federatedBundles: map[string][]byte{}}
+
+	err := parseProtoMessage(data, func(number protowire.Number, value []byte) error {
+		switch number {
+		case 1:
+			svid, err := parseX509SVID(value)
+			if err != nil {
+				return err
+			}
+			response.svids = append(response.svids, svid)
+		case 3:
+			var trustDomain string
+			var bundle []byte
+			err := parseProtoMessage(value, func(number protowire.Number, value []byte) error {
+				switch number {
+				case 1:
+					trustDomain = string(value)
+				case 2:
+					bundle = value
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			response.federatedBundles[trustDomain] = bundle
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// parseX509SVID decodes the protobuf encoded X509SVID message of the Workload API
+// (spiffe_id = 1, x509_svid = 2, x509_svid_key = 3, bundle = 4).
+func parseX509SVID(data []byte) (*x509SVID, error) {
+	svid := &x509SVID{}
+
+	err := parseProtoMessage(data, func(number protowire.Number, value []byte) error {
+		switch number {
+		case 1:
+			svid.spiffeID = string(value)
+		case 2:
+			svid.svid = value
+		case 3:
+			svid.key = value
+		case 4:
+			svid.bundle = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return svid, nil
+}
+
+// parseProtoMessage calls the function for every length delimited field
+// of the protobuf encoded message. Other fields are skipped.
+func parseProtoMessage(data []byte, field func(number protowire.Number, value []byte) error) error {
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if wireType != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(number, wireType, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		err := field(number, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// workloadAPIMessage is a raw protobuf message of the Workload API.
+type workloadAPIMessage struct {
+	data []byte
+}
+
+// workloadAPICodec transfers raw protobuf messages, such that
+// no generated code of the Workload API is needed.
+type workloadAPICodec struct{}
+
+func (workloadAPICodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(*workloadAPIMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return message.data, nil
+}
+
+func (workloadAPICodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(*workloadAPIMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	message.data = append([]byte{}, data...)
+	return nil
+}
+
+func (workloadAPICodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,326 @@
+package pki
+
+import (
+	"context"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeWorkloadAPI sends the current X509SVIDResponse to every new stream of a
+// workload. Further responses are pushed with the channels of the streams,
+// pushing nil ends the stream with an error.
+type fakeWorkloadAPI struct {
+	address string
+	streams chan chan<- []byte
+
+	mutex   sync.Mutex
+	current []byte
+}
+
+func newFakeWorkloadAPI(t *testing.T) *fakeWorkloadAPI {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := &fakeWorkloadAPI{address: "unix://" + socket, streams: make(chan chan<- []byte, 8)}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(workloadAPICodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "SpiffeWorkloadAPI",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "FetchX509SVID",
+			ServerStreams: true,
+			Handler:       api.fetchX509SVID,
+		}},
+	}, nil)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	return api
+}
+
+func (api *fakeWorkloadAPI) fetchX509SVID(_ interface{}, stream grpc.ServerStream) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if len(md.Get(workloadAPIHeader)) == 0 {
+		return status.Error(codes.InvalidArgument, "security header missing")
+	}
+
+	err := stream.RecvMsg(&workloadAPIMessage{})
+	if err != nil {
+		return err
+	}
+
+	api.mutex.Lock()
+	current := api.current
+	api.mutex.Unlock()
+
+	err = stream.SendMsg(&workloadAPIMessage{data: current})
+	if err != nil {
+		return err
+	}
+
+	push := make(chan []byte, 8)
+	api.streams <- push
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case data := <-push:
+			if data == nil {
+				return status.Error(codes.Unavailable, "agent restarted")
+			}
+			err = stream.SendMsg(&workloadAPIMessage{data: data})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (api *fakeWorkloadAPI) setCurrent(data []byte) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.current = data
+}
+
+// nextStream returns the push channel of the next stream that was opened.
+func (api *fakeWorkloadAPI) nextStream(t *testing.T) chan<- []byte {
+	select {
+	case push := <-api.streams:
+		return push
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream was opened")
+		return nil
+	}
+}
+
+// encodeX509SVIDResponse encodes an X509SVIDResponse with an X.509-SVID (issued by the
+// issuer, with the root as bundle) and the federated bundles.
+func encodeX509SVIDResponse(t *testing.T, spiffeID string, issuer *pkitest.CA, root *pkitest.CA, federated map[string]*pkitest.CA) []byte {
+	key, err := KeyTypeECDSAP256.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := url.Parse(spiffeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := issuer.Issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         []*url.URL{id},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, key.Public())
+
+	chain := append([]byte{}, certificate.Raw...)
+	if issuer != root {
+		chain = append(chain, issuer.Certificate.Raw...)
+	}
+
+	var svid []byte
+	svid = protowire.AppendTag(svid, 1, protowire.BytesType)
+	svid = protowire.AppendString(svid, spiffeID)
+	svid = protowire.AppendTag(svid, 2, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, chain)
+	svid = protowire.AppendTag(svid, 3, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, keyDER)
+	svid = protowire.AppendTag(svid, 4, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, root.Certificate.Raw)
+
+	var response []byte
+	response = protowire.AppendTag(response, 1, protowire.BytesType)
+	response = protowire.AppendBytes(response, svid)
+
+	for trustDomain, ca := range federated {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, trustDomain)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, ca.Certificate.Raw)
+
+		response = protowire.AppendTag(response, 3, protowire.BytesType)
+		response = protowire.AppendBytes(response, entry)
+	}
+
+	return response
+}
+
+func rootsContain(roots *TrustRoots, ca *pkitest.CA) bool {
+	for _, anchor := range roots.Anchors() {
+		if anchor.Certificate.Equal(ca.Certificate) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWorkloadAPIProviderFetchesSVID(t *testing.T) {
+	root := pkitest.NewCA(t, "root", nil)
+	intermediate := pkitest.NewCA(t, "intermediate", root)
+	federated := pkitest.NewCA(t, "federated", nil)
+
+	api := newFakeWorkloadAPI(t)
+	api.setCurrent(encodeX509SVIDResponse(t, "spiffe://example.org/translator", intermediate, root, map[string]*pkitest.CA{"other.org": federated}))
+
+	provider := NewWorkloadAPIKeyMaterialProvider(&WorkloadAPIConfig{Address: api.address, Timeout: 5 * time.Second})
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	material := provider.KeyMaterial()
+	if SPIFFEID(material.Certificate) != "spiffe://example.org/translator" {
+		t.Fatalf("unexpected spiffe id %q", SPIFFEID(material.Certificate))
+	}
+	if !material.CA.Equal(root.Certificate) || len(material.Intermediates) != 1 || !material.Intermediates[0].Equal(intermediate.Certificate) {
+		t.Fatal("chain of the x509-svid was not loaded")
+	}
+
+	x5c, _ := material.JWTCertificateHeaders()
+	if len(x5c) != 3 {
+		t.Fatalf("expected the certificate, intermediate and root in x5c, got %v certificates", len(x5c))
+	}
+
+	bundle := NewTrustBundle(provider.TrustSource())
+	err = bundle.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rootsContain(bundle.Roots(), root) || !rootsContain(bundle.Roots(), federated) {
+		t.Fatal("bundle and federated bundle are not trusted")
+	}
+}
+
+func TestWorkloadAPIProviderAppliesPushedUpdates(t *testing.T) {
+	root := pkitest.NewCA(t, "root", nil)
+	federated := pkitest.NewCA(t, "federated", nil)
+
+	api := newFakeWorkloadAPI(t)
+	api.setCurrent(encodeX509SVIDResponse(t, "spiffe://example.org/translator", root, root, nil))
+
+	provider := NewWorkloadAPIKeyMaterialProvider(&WorkloadAPIConfig{Address: api.address, Timeout: 5 * time.Second})
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.nextStream(t)
+	initial := provider.KeyMaterial().Certificate
+
+	bundle := NewTrustBundle(provider.TrustSource())
+	err = bundle.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated := make(chan struct{}, 1)
+	provider.OnUpdate(func() {
+		if err := bundle.Reload(); err != nil {
+			t.Error(err)
+		}
+		updated <- struct{}{}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provider.Watch(ctx)
+
+	push := api.nextStream(t)
+	<-updated
+
+	// Invalid responses are skipped and the current key material stays active.
+	push <- []byte{0xff}
+	push <- encodeX509SVIDResponse(t, "spiffe://example.org/translator", root, root, map[string]*pkitest.CA{"other.org": federated})
+
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pushed update was not applied")
+	}
+
+	if provider.KeyMaterial().Certificate.Equal(initial) {
+		t.Fatal("rotated x509-svid was not swapped in")
+	}
+	if !rootsContain(bundle.Roots(), federated) {
+		t.Fatal("pushed federated bundle is not trusted")
+	}
+}
+
+func TestWorkloadAPIProviderRejectsOtherSPIFFEID(t *testing.T) {
+	root := pkitest.NewCA(t, "root", nil)
+
+	api := newFakeWorkloadAPI(t)
+	api.setCurrent(encodeX509SVIDResponse(t, "spiffe://example.org/other", root, root, nil))
+
+	provider := NewWorkloadAPIKeyMaterialProvider(&WorkloadAPIConfig{
+		Address:  api.address,
+		SPIFFEID: "spiffe://example.org/translator",
+		Timeout:  5 * time.Second,
+	})
+	err := provider.Ensure()
+	if err == nil {
+		t.Fatal("accepted the x509-svid of another spiffe id")
+	}
+	if provider.KeyMaterial() != nil {
+		t.Fatal("key material of another spiffe id was loaded")
+	}
+}
+
+func TestWorkloadAPIProviderResetsBackoffAfterReconnect(t *testing.T) {
+	root := pkitest.NewCA(t, "root", nil)
+
+	api := newFakeWorkloadAPI(t)
+	api.setCurrent(encodeX509SVIDResponse(t, "spiffe://example.org/translator", root, root, nil))
+
+	provider := NewWorkloadAPIKeyMaterialProvider(&WorkloadAPIConfig{
+		Address:       api.address,
+		Timeout:       5 * time.Second,
+		RetryInterval: 100 * time.Millisecond,
+	})
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.nextStream(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provider.Watch(ctx)
+
+	// Every stream delivers key material before it fails, such that the reconnect
+	// always waits the retry interval. Without the reset, the last reconnect would
+	// wait 1.6 seconds.
+	push := api.nextStream(t)
+	for i := 0; i < 5; i++ {
+		push <- nil
+		lost := time.Now()
+		push = api.nextStream(t)
+		if waited := time.Since(lost); waited > time.Second {
+			t.Fatalf("reconnect %v waited %v, the backoff was not reset", i+1, waited)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package go_translator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/WirePact/go-translator/internal"
 	"github.com/WirePact/go-translator/pki"
+	"github.com/WirePact/go-translator/wirepact"
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
@@ -25,14 +30,67 @@ type Translator struct {
 
 	egressServer *grpc.Server
 	egressListen *net.Listener
+
+	trustServer *http.Server
+	trustListen *net.Listener
+
+	tokenCache *wirepact.TokenCache
 }
 
 // NewTranslator creates a new translator that adheres to the given config.
 func NewTranslator(config *TranslatorConfig) (*Translator, error) {
+	if config.JWTConfig.Audience == "" {
+		config.JWTConfig.Audience = config.CertificateCommonName
+	}
+
+	if len(config.AudienceAliases) == 0 {
+		config.AudienceAliases = config.CertificateDNSNames
+	}
+
+	if len(config.AudienceAliases) == 0 && !config.AcceptLegacyAudience {
+		logrus.WithField("audience", config.JWTConfig.Audience).Warn(
+			"No audience aliases are configured. Received JWTs are only accepted for the common name, " +
+				"while the egress of the callers uses the host of the request as audience by default. " +
+				"Configure the host names of the service as AUDIENCE_ALIASES (or CERTIFICATE_DNS_NAMES) " +
+				"if they differ from the common name.")
+	}
+
+	if config.KeyMaterialProvider == nil {
+		config.KeyMaterialProvider = pki.NewKeyMaterialProvider(&config.Config)
+	}
+
+	if config.TrustBundle == nil && config.TrustBundlePath != "" {
+		config.TrustBundle = pki.NewTrustBundle(
+			pki.LocalCATrustSource(config.KeyMaterialProvider),
+			pki.FileTrustSource(config.TrustBundlePath))
+	}
+
+	if config.RevocationChecker == nil && config.CRLPath != "" {
+		config.RevocationChecker = pki.NewRevocationChecker(&config.Config, config.KeyMaterialProvider)
+	}
+
+	if config.TokenCacheSize > 0 && config.ReplayPolicy == wirepact.ReplayPolicyReject {
+		err := errors.New("the token cache cannot be combined with the reject replay policy")
+		logrus.WithError(err).Error("Invalid translator config.")
+		return nil, err
+	}
+
+	if config.ReplayPolicy != wirepact.ReplayPolicyDisabled && config.ReplayStore == nil {
+		config.ReplayStore = wirepact.NewMemoryReplayStore(0)
+	}
+
+	ingressTransports := config.IngressTransports
+	if len(ingressTransports) == 0 {
+		ingressTransports = []wirepact.Transport{wirepact.DefaultTransport}
+	}
+
 	var ingressOpts []grpc.ServerOption
 	ingressServer := grpc.NewServer(ingressOpts...)
 	auth.RegisterAuthorizationServer(ingressServer, &internal.IngressServer{
 		IngressTranslator: config.IngressTranslator,
+		JWTConfig:         &config.JWTConfig,
+		Transports:        ingressTransports,
+		Delegation:        config.Delegation,
 	})
 
 	ingressListen, err := net.Listen("tcp", fmt.Sprintf(":%v", config.IngressPort))
@@ -41,11 +99,17 @@ func NewTranslator(config *TranslatorConfig) (*Translator, error) {
 		return nil, err
 	}
 
+	tokenCache := wirepact.NewTokenCache(&config.JWTConfig)
+
 	var egressOpts []grpc.ServerOption
 	egressServer := grpc.NewServer(egressOpts...)
 	auth.RegisterAuthorizationServer(egressServer, &internal.EgressServer{
 		EgressTranslator: config.EgressTranslator,
 		JWTConfig:        &config.JWTConfig,
+		TokenCache:       tokenCache,
+
+		Transport:  config.EgressTransport,
+		Delegation: config.Delegation,
 	})
 
 	egressListen, err := net.Listen("tcp", fmt.Sprintf(":%v", config.EgressPort))
@@ -54,23 +118,68 @@ func NewTranslator(config *TranslatorConfig) (*Translator, error) {
 		return nil, err
 	}
 
-	return &Translator{
+	translator := &Translator{
 		config:        config,
 		ingressServer: ingressServer,
 		ingressListen: &ingressListen,
 		egressServer:  egressServer,
 		egressListen:  &egressListen,
-	}, nil
+		tokenCache:    tokenCache,
+	}
+
+	if config.TrustEndpointPort != 0 {
+		trustListen, err := net.Listen("tcp", fmt.Sprintf(":%v", config.TrustEndpointPort))
+		if err != nil {
+			logrus.WithError(err).Errorf("Could not listen on trust endpoint port %v", config.TrustEndpointPort)
+			return nil, err
+		}
+
+		translator.trustServer = &http.Server{
+			Handler:           wirepact.NewTrustHandler(&config.JWTConfig),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		translator.trustListen = &trustListen
+	}
+
+	return translator, nil
 }
 
 // Start runs the server by ensuring the PKI key material and then starting the grpc servers.
+// The key material is kept up to date in the background (e.g. renewed before it expires).
 // When a system interrupt is received the server stops.
 func (translator *Translator) Start() {
-	err := pki.EnsureKeyMaterial(&translator.config.Config)
+	keyMaterial := translator.config.KeyMaterialProvider
+	err := keyMaterial.Ensure()
 	if err != nil {
 		logrus.WithError(err).Fatal("Could not ensure key material.")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go keyMaterial.Watch(ctx)
+
+	if trustBundle := translator.config.TrustBundle; trustBundle != nil {
+		err = trustBundle.Reload()
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not load trust bundle.")
+		}
+
+		interval := translator.config.TrustBundleReloadInterval
+		if interval == 0 {
+			interval = TranslatorDefaultTrustBundleReloadInterval
+		}
+		go trustBundle.Watch(ctx, interval)
+	}
+
+	if revocationChecker := translator.config.RevocationChecker; revocationChecker != nil {
+		err = revocationChecker.Refresh()
+		if err != nil {
+			logrus.WithError(err).Warn("Could not fetch certificate revocation list.")
+		}
+		go revocationChecker.Watch(ctx)
+	}
+
 	translator.close = make(chan bool)
 
 	go func() {
@@ -89,6 +198,16 @@ func (translator *Translator) Start() {
 		}
 	}()
 
+	if translator.trustServer != nil {
+		go func() {
+			logrus.Info("Serving trust endpoint")
+			err := translator.trustServer.Serve(*translator.trustListen)
+			if err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Fatal("Could not serve trust endpoint.")
+			}
+		}()
+	}
+
 	go func() {
 		signalChannel := make(chan os.Signal, 1)
 		signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
@@ -101,6 +220,20 @@ func (translator *Translator) Start() {
 
 	translator.ingressServer.GracefulStop()
 	translator.egressServer.GracefulStop()
+	if translator.trustServer != nil {
+		err = translator.trustServer.Shutdown(context.Background())
+		if err != nil {
+			logrus.WithError(err).Warn("Could not stop trust endpoint.")
+		}
+	}
+
+	stats := translator.TokenCacheStats()
+	logrus.WithFields(logrus.Fields{
+		"hits":      stats.Hits,
+		"misses":    stats.Misses,
+		"evictions": stats.Evictions,
+		"hit_rate":  stats.HitRate(),
+	}).Info("Egress token cache statistics.")
 }
 
 // Stop closes the server and returns the "start" function.
@@ -108,3 +241,8 @@ func (translator *Translator) Stop() {
 	logrus.Infoln("Stop function called. Closing translator.")
 	translator.close <- true
 }
+
+// TokenCacheStats returns the metrics of the egress token cache.
+func (translator *Translator) TokenCacheStats() wirepact.TokenCacheStats {
+	return translator.tokenCache.Stats()
+}
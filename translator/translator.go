@@ -1,6 +1,7 @@
 package translator
 
 import (
+	"github.com/WirePact/go-translator/wirepact"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 )
@@ -23,10 +24,10 @@ type IngressResult struct {
 }
 
 // IngressTranslation acts as the translator for incoming communication.
-// The function receives the parsed JWT subject (if possible) and the full request.
+// The function receives the verified identity of the WirePact JWT and the full request.
 // It shall return a list of headers to add for the downstream and a list of headers that shall be removed.
 // By default, the WirePact JWT header is removed.
-type IngressTranslation func(subject string, req *auth.CheckRequest) (IngressResult, error)
+type IngressTranslation func(identity *wirepact.Identity, req *auth.CheckRequest) (IngressResult, error)
 
 // EgressResult helps to return the correct request to the upstream of a translator.
 type EgressResult struct {
@@ -42,6 +43,14 @@ type EgressResult struct {
 	// request will be denied.
 	UserID string
 
+	// If set, defines the full identity that should be encoded into the JWT.
+	// If the subject of the identity is empty, the UserID is used as subject.
+	Identity *wirepact.Identity
+
+	// If set, defines the audience of the JWT (the identity of the destination
+	// translator). If omitted, the host of the request authority is used.
+	Audience string
+
 	// Defines a list of headers that should be removed from the request
 	// (typically the consumed authentication header).
 	HeadersToRemove []string
@@ -0,0 +1,53 @@
+package wirepact
+
+import (
+	"fmt"
+
+	"github.com/WirePact/go-translator/pki"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// SupportedAlgorithms contains all JWS algorithms that can be used
+// to sign and verify WirePact JWTs.
+var SupportedAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256,
+	jose.PS256,
+	jose.ES256,
+	jose.ES384,
+	jose.EdDSA,
+}
+
+// SignatureAlgorithm returns the JWS algorithm that is used to sign
+// WirePact JWTs with a private key of the given type.
+func SignatureAlgorithm(keyType pki.KeyType) (jose.SignatureAlgorithm, error) {
+	switch keyType {
+	case pki.KeyTypeRSA:
+		return jose.RS256, nil
+	case pki.KeyTypeRSAPSS:
+		return jose.PS256, nil
+	case pki.KeyTypeECDSAP256:
+		return jose.ES256, nil
+	case pki.KeyTypeECDSAP384:
+		return jose.ES384, nil
+	case pki.KeyTypeEd25519:
+		return jose.EdDSA, nil
+	default:
+		return "", fmt.Errorf("no signature algorithm for key type %q", keyType)
+	}
+}
+
+func (config *JWTConfig) acceptedAlgorithms() []jose.SignatureAlgorithm {
+	if len(config.AcceptedAlgorithms) == 0 {
+		return SupportedAlgorithms
+	}
+	return config.AcceptedAlgorithms
+}
+
+func (config *JWTConfig) algorithmAccepted(algorithm string) bool {
+	for _, accepted := range config.acceptedAlgorithms() {
+		if string(accepted) == algorithm {
+			return true
+		}
+	}
+	return false
+}
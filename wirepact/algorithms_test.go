@@ -0,0 +1,62 @@
+package wirepact
+
+import (
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"github.com/WirePact/go-translator/pki"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestJWTRoundTripWithAllKeyTypes(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	receiver := newTestJWTConfig(t, testPKI, "translator-b")
+
+	keyTypes := []pki.KeyType{pki.KeyTypeRSA, pki.KeyTypeRSAPSS, pki.KeyTypeECDSAP256, pki.KeyTypeECDSAP384, pki.KeyTypeEd25519}
+	for _, keyType := range keyTypes {
+		t.Run(string(keyType), func(t *testing.T) {
+			pkiConfig := newTestPKIConfig(testPKI, "translator-a")
+			pkiConfig.KeyType = keyType
+			sender := &JWTConfig{Issuer: "translator-a", KeyMaterialProvider: enroll(t, pkiConfig)}
+
+			token, err := CreateSignedJWTForUser(sender, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signature, err := jose.ParseSigned(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := SignatureAlgorithm(keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if algorithm := signature.Signatures[0].Header.Algorithm; algorithm != string(expected) {
+				t.Fatalf("expected algorithm %v, got %v", expected, algorithm)
+			}
+
+			identity, err := GetJWTIdentity(receiver, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Subject != "alice" {
+				t.Fatalf("unexpected subject %q", identity.Subject)
+			}
+
+			// The algorithm of the key type is rejected if it is not in the allowlist.
+			_, err = GetJWTIdentity(&JWTConfig{
+				KeyMaterialProvider: receiver.KeyMaterialProvider,
+				AcceptedAlgorithms:  []jose.SignatureAlgorithm{jose.HS256},
+			}, token)
+			expectReason(t, err, ErrInvalidSignature)
+		})
+	}
+}
+
+func TestSignatureAlgorithmOfUnknownKeyType(t *testing.T) {
+	_, err := SignatureAlgorithm("dsa")
+	if err == nil {
+		t.Fatal("returned an algorithm for an unknown key type")
+	}
+}
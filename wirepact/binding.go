@@ -0,0 +1,140 @@
+package wirepact
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// BindingStrength defines which parts of an HTTP request are bound to a WirePact JWT.
+type BindingStrength string
+
+const (
+	// BindingNone does not bind the JWT to the request.
+	BindingNone BindingStrength = ""
+
+	// BindingRequest binds the JWT to the method, the authority and the path (including the query).
+	BindingRequest BindingStrength = "request"
+
+	// BindingRequestBody binds the JWT to the method, the authority, the path and
+	// the body of the request. Envoy must be configured to send the request body
+	// to the external authorization (with_request_body).
+	BindingRequestBody BindingStrength = "request-body"
+)
+
+// RequestBindingRule defines the binding strength for all
+// requests whose path starts with the PathPrefix.
+type RequestBindingRule struct {
+	PathPrefix string
+	Strength   BindingStrength
+}
+
+// ParseRequestBindingRules parses a comma separated list of rules in the form
+// "prefix=strength" (e.g. "/api/payments=request-body,/api=request").
+func ParseRequestBindingRules(value string) ([]RequestBindingRule, error) {
+	var rules []RequestBindingRule
+	for _, definition := range strings.Split(value, ",") {
+		if strings.TrimSpace(definition) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(definition, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("request binding rule %q is not in the form prefix=strength", definition)
+		}
+
+		rule := RequestBindingRule{
+			PathPrefix: strings.TrimSpace(parts[0]),
+			Strength:   BindingStrength(strings.TrimSpace(parts[1])),
+		}
+		switch rule.Strength {
+		case BindingRequest, BindingRequestBody:
+		case "none":
+			rule.Strength = BindingNone
+		default:
+			return nil, fmt.Errorf("unknown request binding strength %q", rule.Strength)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// BoundRequest contains the parts of an HTTP request that can be bound to a JWT.
+type BoundRequest struct {
+	Method    string
+	Authority string
+	Path      string
+	Body      []byte
+}
+
+type requestBinding struct {
+	Strength BindingStrength `json:"lvl"`
+	Hash     string          `json:"h"`
+}
+
+type bindingClaims struct {
+	Binding *requestBinding `json:"wpb,omitempty"`
+}
+
+func (strength BindingStrength) level() int {
+	switch strength {
+	case BindingRequest:
+		return 1
+	case BindingRequestBody:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// bindingStrengthFor returns the strength of the first rule that matches the path.
+func (config *JWTConfig) bindingStrengthFor(path string) BindingStrength {
+	for _, rule := range config.RequestBindingRules {
+		if strings.HasPrefix(path, rule.PathPrefix) {
+			return rule.Strength
+		}
+	}
+	return BindingNone
+}
+
+func newRequestBinding(strength BindingStrength, request *BoundRequest) *requestBinding {
+	if strength == BindingNone || request == nil {
+		return nil
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(strings.ToUpper(request.Method)))
+	hash.Write([]byte{'\n'})
+	hash.Write([]byte(strings.ToLower(request.Authority)))
+	hash.Write([]byte{'\n'})
+	hash.Write([]byte(request.Path))
+	if strength == BindingRequestBody {
+		bodyHash := sha256.Sum256(request.Body)
+		hash.Write([]byte{'\n'})
+		hash.Write(bodyHash[:])
+	}
+
+	return &requestBinding{
+		Strength: strength,
+		Hash:     base64.RawURLEncoding.EncodeToString(hash.Sum(nil)),
+	}
+}
+
+// verifyRequestBinding checks that the binding of the JWT is at least as strong
+// as the configured strength for the request path and that it matches the request.
+func verifyRequestBinding(config *JWTConfig, binding *requestBinding, request *BoundRequest) bool {
+	required := config.bindingStrengthFor(request.Path)
+	if binding == nil {
+		return required == BindingNone
+	}
+
+	if binding.Strength.level() < required.level() || binding.Strength.level() == 0 {
+		return false
+	}
+
+	expected := newRequestBinding(binding.Strength, request)
+	return subtle.ConstantTimeCompare([]byte(expected.Hash), []byte(binding.Hash)) == 1
+}
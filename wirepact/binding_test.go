@@ -0,0 +1,97 @@
+package wirepact
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+func TestParseRequestBindingRules(t *testing.T) {
+	rules, err := ParseRequestBindingRules("/api/payments=request-body, /api=request,/health=none,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RequestBindingRule{
+		{PathPrefix: "/api/payments", Strength: BindingRequestBody},
+		{PathPrefix: "/api", Strength: BindingRequest},
+		{PathPrefix: "/health", Strength: BindingNone},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+
+	for _, value := range []string{"/api", "/api=strong"} {
+		if _, err = ParseRequestBindingRules(value); err == nil {
+			t.Fatalf("accepted the invalid rules %q", value)
+		}
+	}
+}
+
+func TestJWTRequestBinding(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	sender := newTestJWTConfig(t, testPKI, "translator-a")
+	sender.RequestBindingRules = []RequestBindingRule{
+		{PathPrefix: "/api/payments", Strength: BindingRequestBody},
+		{PathPrefix: "/api", Strength: BindingRequest},
+	}
+	receiver := newTestJWTConfig(t, testPKI, "translator-b")
+	receiver.Audience = "translator-b"
+	receiver.RequestBindingRules = sender.RequestBindingRules
+
+	// A sender whose rules are weaker respectively stronger than the rules of the receiver.
+	weakSender := newTestJWTConfig(t, testPKI, "translator-weak")
+	weakSender.RequestBindingRules = []RequestBindingRule{{PathPrefix: "/api", Strength: BindingRequest}}
+	strongSender := newTestJWTConfig(t, testPKI, "translator-strong")
+	strongSender.RequestBindingRules = []RequestBindingRule{{PathPrefix: "/api", Strength: BindingRequestBody}}
+
+	orders := &BoundRequest{Method: "GET", Authority: "translator-b", Path: "/api/orders?page=1"}
+	payment := &BoundRequest{Method: "POST", Authority: "translator-b", Path: "/api/payments", Body: []byte(`{"amount":10}`)}
+	health := &BoundRequest{Method: "GET", Authority: "translator-b", Path: "/health"}
+
+	signWith := func(config *JWTConfig, request *BoundRequest) string {
+		t.Helper()
+		token, err := CreateSignedJWT(config, &Identity{Subject: "alice"}, &TokenOptions{Audience: "translator-b", Request: request})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	sign := func(request *BoundRequest) string {
+		t.Helper()
+		return signWith(sender, request)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		request  *BoundRequest
+		accepted bool
+	}{
+		{name: "same request", token: sign(orders), request: orders, accepted: true},
+		{name: "case insensitive method and authority", token: sign(orders), request: &BoundRequest{Method: "get", Authority: "Translator-B", Path: "/api/orders?page=1"}, accepted: true},
+		{name: "other method", token: sign(orders), request: &BoundRequest{Method: "DELETE", Authority: "translator-b", Path: "/api/orders?page=1"}},
+		{name: "other path", token: sign(orders), request: &BoundRequest{Method: "GET", Authority: "translator-b", Path: "/api/users?page=1"}},
+		{name: "other query", token: sign(orders), request: &BoundRequest{Method: "GET", Authority: "translator-b", Path: "/api/orders?page=2"}},
+		{name: "other authority", token: sign(orders), request: &BoundRequest{Method: "GET", Authority: "translator-c", Path: "/api/orders?page=1"}},
+		{name: "same body", token: sign(payment), request: payment, accepted: true},
+		{name: "other body", token: sign(payment), request: &BoundRequest{Method: "POST", Authority: "translator-b", Path: "/api/payments", Body: []byte(`{"amount":1000}`)}},
+		{name: "unbound token for a bound path", token: sign(health), request: &BoundRequest{Method: "GET", Authority: "translator-b", Path: "/api/orders"}},
+		{name: "weaker binding than required", token: signWith(weakSender, payment), request: payment},
+		{name: "stronger binding than required", token: signWith(strongSender, orders), request: orders, accepted: true},
+		{name: "unbound path", token: sign(health), request: health, accepted: true},
+		{name: "bound token for an unbound path", token: sign(orders), request: health},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := GetJWTIdentityForRequest(receiver, test.token, test.request)
+			if test.accepted && err != nil {
+				t.Fatal(err)
+			}
+			if !test.accepted {
+				expectReason(t, err, ErrRequestBindingMismatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package wirepact
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/WirePact/go-translator/pki"
+)
+
+const defaultTokenCacheRefreshFraction = 0.5
+
+// TokenCache is a bounded, concurrency-safe cache for signed WirePact JWTs.
+// Tokens are cached per identity and reused until the configured fraction
+// of their lifetime has passed. When the cache is full, the least recently
+// used token is evicted. A nil *TokenCache is valid and signs a new token
+// on every call.
+//
+// Like every JWT, a cached token carries a unique token ID ("jti"). With
+// ReplayPolicyAllowRetries, a cached token is sent at most ReplayMaxUses
+// times, such that receivers with the same policy accept all of its uses.
+// With ReplayPolicyReject, a token is never reused.
+type TokenCache struct {
+	mutex sync.Mutex
+
+	size            int
+	refreshFraction float64
+	maxUses         int
+
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// TokenCacheStats contains the metrics of a TokenCache.
+type TokenCacheStats struct {
+	// Number of requests that were served with a cached token.
+	Hits uint64
+
+	// Number of requests that required a new signed token.
+	Misses uint64
+
+	// Number of tokens that were removed because the cache was full.
+	Evictions uint64
+
+	// Number of tokens that are currently cached.
+	Size int
+}
+
+// HitRate returns the ratio of cache hits to all requests (0 to 1).
+func (stats TokenCacheStats) HitRate() float64 {
+	total := stats.Hits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(total)
+}
+
+type tokenCacheEntry struct {
+	key       string
+	token     string
+	refreshAt time.Time
+	uses      int
+}
+
+// NewTokenCache creates a token cache according to the TokenCacheSize and
+// TokenCacheRefreshFraction of the given config. The cache is opt-in: if no
+// positive size is configured, nil is returned.
+func NewTokenCache(config *JWTConfig) *TokenCache {
+	size := config.TokenCacheSize
+	if size <= 0 {
+		return nil
+	}
+
+	refreshFraction := config.TokenCacheRefreshFraction
+	if refreshFraction <= 0 || refreshFraction > 1 {
+		refreshFraction = defaultTokenCacheRefreshFraction
+	}
+
+	return &TokenCache{
+		size:            size,
+		refreshFraction: refreshFraction,
+		maxUses:         config.replayMaxUses(),
+		entries:         map[string]*list.Element{},
+		order:           list.New(),
+	}
+}
+
+// GetOrCreate returns a cached signed JWT for the given identity and options
+// or creates (and caches) a new one with CreateSignedJWT.
+func (cache *TokenCache) GetOrCreate(config *JWTConfig, identity *Identity, options *TokenOptions) (string, error) {
+	if cache == nil {
+		return CreateSignedJWT(config, identity, options)
+	}
+
+	keyMaterial, err := config.keyMaterial()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := tokenCacheKey(config, keyMaterial, identity, options)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if token, ok := cache.get(key, now); ok {
+		return token, nil
+	}
+
+	token, err := createSignedJWT(config, keyMaterial, identity, options)
+	if err != nil {
+		return "", err
+	}
+
+	refreshAfter := time.Duration(float64(config.lifetime()) * cache.refreshFraction)
+	cache.put(&tokenCacheEntry{key: key, token: token, refreshAt: now.Add(refreshAfter), uses: 1})
+
+	return token, nil
+}
+
+// Stats returns the current metrics of the cache.
+func (cache *TokenCache) Stats() TokenCacheStats {
+	if cache == nil {
+		return TokenCacheStats{}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return TokenCacheStats{
+		Hits:      cache.hits,
+		Misses:    cache.misses,
+		Evictions: cache.evictions,
+		Size:      cache.order.Len(),
+	}
+}
+
+func (cache *TokenCache) get(key string, now time.Time) (string, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.misses++
+		return "", false
+	}
+
+	entry := element.Value.(*tokenCacheEntry)
+	if !now.Before(entry.refreshAt) || (cache.maxUses > 0 && entry.uses >= cache.maxUses) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		cache.misses++
+		return "", false
+	}
+
+	cache.order.MoveToFront(element)
+	entry.uses++
+	cache.hits++
+	return entry.token, true
+}
+
+func (cache *TokenCache) put(entry *tokenCacheEntry) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[entry.key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[entry.key] = cache.order.PushFront(entry)
+
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*tokenCacheEntry).key)
+		cache.evictions++
+	}
+}
+
+// tokenCacheKey calculates the key for the identity and options. The key contains the
+// hash of the signer certificate, such that rotated key material never
+// serves tokens that were signed with the old key.
+func tokenCacheKey(config *JWTConfig, keyMaterial *pki.KeyMaterial, identity *Identity, options *TokenOptions) (string, error) {
+	identityJSON, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+
+	_, x5t := keyMaterial.JWTCertificateHeaders()
+
+	hash := sha256.New()
+	hash.Write([]byte(x5t))
+	hash.Write([]byte{0})
+	hash.Write([]byte(config.Issuer))
+	hash.Write([]byte{0})
+	hash.Write([]byte(config.audienceFor(options)))
+	hash.Write([]byte{0})
+	if binding := options.binding(config); binding != nil {
+		hash.Write([]byte(binding.Strength))
+		hash.Write([]byte(binding.Hash))
+	}
+	hash.Write([]byte{0})
+	hash.Write(identityJSON)
+
+	return base64.RawStdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,141 @@
+package wirepact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+)
+
+func TestTokenCacheIsOptIn(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+
+	cache := NewTokenCache(config)
+	if cache != nil {
+		t.Fatal("token cache is enabled without a size")
+	}
+
+	first, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("disabled cache reused a token")
+	}
+}
+
+func TestTokenCacheHitsAndMisses(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+	config.TokenCacheSize = 1
+	cache := NewTokenCache(config)
+
+	first, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("cached token was not reused")
+	}
+
+	other, err := cache.GetOrCreate(config, &Identity{Subject: "bob"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == first {
+		t.Fatal("token of another identity was reused")
+	}
+
+	// The token of alice was evicted, since the cache holds a single token.
+	third, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Fatal("evicted token was reused")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 2 || stats.Size != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.HitRate() != 0.25 {
+		t.Fatalf("unexpected hit rate %v", stats.HitRate())
+	}
+}
+
+func TestTokenCacheRefreshFraction(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+	config.TokenCacheSize = 10
+	config.Lifetime = 400 * time.Millisecond
+	config.TokenCacheRefreshFraction = 0.25
+	cache := NewTokenCache(config)
+
+	first, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("token was refreshed before the refresh fraction of its lifetime")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	refreshed, err := cache.GetOrCreate(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed == first {
+		t.Fatal("token was not refreshed after the refresh fraction of its lifetime")
+	}
+}
+
+func TestTokenCacheKeyContainsAudienceAndBinding(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+	config.TokenCacheSize = 10
+	config.RequestBindingRules = []RequestBindingRule{{PathPrefix: "/api", Strength: BindingRequest}}
+	cache := NewTokenCache(config)
+	identity := &Identity{Subject: "alice"}
+
+	token := func(options *TokenOptions) string {
+		t.Helper()
+		token, err := cache.GetOrCreate(config, identity, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	serviceB := token(&TokenOptions{Audience: "service-b"})
+	if token(&TokenOptions{Audience: "service-c"}) == serviceB {
+		t.Fatal("token of another audience was reused")
+	}
+
+	// Requests that are not bound share the token of the audience.
+	unbound := token(&TokenOptions{Audience: "service-b", Request: &BoundRequest{Method: "GET", Authority: "service-b", Path: "/health"}})
+	if unbound != serviceB || token(&TokenOptions{Audience: "service-b", Request: &BoundRequest{Method: "GET", Authority: "service-b", Path: "/ready"}}) != serviceB {
+		t.Fatal("token of an unbound request was not reused")
+	}
+
+	bound := token(&TokenOptions{Audience: "service-b", Request: &BoundRequest{Method: "GET", Authority: "service-b", Path: "/api/orders"}})
+	if bound == serviceB {
+		t.Fatal("unbound token was reused for a bound request")
+	}
+	if token(&TokenOptions{Audience: "service-b", Request: &BoundRequest{Method: "DELETE", Authority: "service-b", Path: "/api/orders"}}) == bound {
+		t.Fatal("token bound to another request was reused")
+	}
+	if token(&TokenOptions{Audience: "service-b", Request: &BoundRequest{Method: "GET", Authority: "service-b", Path: "/api/orders"}}) != bound {
+		t.Fatal("token bound to the same request was not reused")
+	}
+}
@@ -1,14 +1,195 @@
 package wirepact
 
-import "time"
+import (
+	"errors"
+	"time"
+
+	"github.com/WirePact/go-translator/pki"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const defaultMaxDelegationDepth = 5
 
 // JWTConfig contains specialized configuration for
-// the CreateSignedJWTForUser method.
+// the CreateSignedJWTForUser and GetJWTUserSubjectWithConfig methods.
 type JWTConfig struct {
 	// The issuer that is inserted into the JWT.
 	Issuer string
 
+	// The provider of the key material that signs the created JWTs (required).
+	// Each config carries its own provider, such that multiple translators
+	// can run in the same process.
+	KeyMaterialProvider pki.KeyMaterialProvider
+
 	// The lifetime of the token in a go duration.
 	// If omitted, 60 seconds are used.
 	Lifetime time.Duration
+
+	// The allowed clock skew when the "exp", "nbf" and "iat" claims
+	// of a received JWT are validated. If omitted, 60 seconds are used.
+	ClockLeeway time.Duration
+
+	// The audience that is expected in received JWTs. This is the identity
+	// of the translator itself as it is addressed by the callers.
+	// The Translator uses the CertificateCommonName if omitted. Without an
+	// Audience (and AudienceAliases), only the LegacyAudience is accepted.
+	Audience string
+
+	// Additional audiences that are accepted for received JWTs, e.g. the host
+	// names of the service under which callers address the translator
+	// (see AuthorityAudience). The authority of the received request itself
+	// is never trusted as audience, since the caller controls it.
+	// The Translator uses the CertificateDNSNames if omitted.
+	AudienceAliases []string
+
+	// If set, received JWTs with the LegacyAudience ("WirePact") are accepted
+	// in addition to JWTs for the configured Audience.
+	AcceptLegacyAudience bool
+
+	// If set, all created JWTs use the LegacyAudience instead of the
+	// audience of the destination. This allows communication with
+	// translators that do not support audience scoped tokens.
+	EmitLegacyAudience bool
+
+	// If set, received JWTs are verified against the roots of the trust bundle.
+	// If omitted, the CA certificate of the PKI is the only trusted root.
+	TrustBundle *pki.TrustBundle
+
+	// If set, the certificates of received JWTs are checked against
+	// the certificate revocation list of the PKI.
+	RevocationChecker *pki.RevocationChecker
+
+	// If set, defines the list of issuers that are accepted for received JWTs.
+	// If omitted, the issuer of a received JWT must match the common name
+	// or the SPIFFE ID of the certificate that signed the JWT.
+	AllowedIssuers []string
+
+	// If set, defines the list of JWS algorithms that are accepted for received JWTs.
+	// If omitted, all SupportedAlgorithms are accepted.
+	AcceptedAlgorithms []jose.SignatureAlgorithm
+
+	// Defines which requests are bound to the JWT. The first rule whose
+	// PathPrefix matches the request path defines the binding strength.
+	// If no rule matches, JWTs are not bound to the request.
+	// Received JWTs must be bound with at least the configured strength.
+	RequestBindingRules []RequestBindingRule
+
+	// The maximum number of actors in the delegation chain ("act" claim) of
+	// received and created JWTs. If omitted, 5 actors are allowed.
+	MaxDelegationDepth int
+
+	// The maximum number of signed JWTs that are cached for outgoing requests.
+	// If omitted (or not positive), the cache is disabled and every request
+	// gets a newly signed JWT. A cached JWT keeps its "jti", so it is reused
+	// at most ReplayMaxUses times with ReplayPolicyAllowRetries. The cache
+	// cannot be combined with ReplayPolicyReject (see TokenCache).
+	TokenCacheSize int
+
+	// The fraction (0 to 1) of the Lifetime after which a cached JWT is
+	// replaced by a newly signed one. If omitted, 0.5 is used.
+	TokenCacheRefreshFraction float64
+
+	// Defines how received JWTs with an already seen "jti" are handled.
+	// If omitted, no replay protection is active.
+	ReplayPolicy ReplayPolicy
+
+	// The number of times a JWT may be used with ReplayPolicyAllowRetries.
+	// If omitted, 3 usages are allowed.
+	ReplayMaxUses int
+
+	// The store for the seen token IDs. It is required when a ReplayPolicy
+	// is configured. The Translator uses a MemoryReplayStore if omitted.
+	ReplayStore ReplayStore
+}
+
+func (config *JWTConfig) lifetime() time.Duration {
+	if config.Lifetime == 0 {
+		return 60 * time.Second
+	}
+	return config.Lifetime
+}
+
+func (config *JWTConfig) clockLeeway() time.Duration {
+	if config.ClockLeeway == 0 {
+		return 60 * time.Second
+	}
+	return config.ClockLeeway
+}
+
+func (config *JWTConfig) replayMaxUses() int {
+	switch config.ReplayPolicy {
+	case ReplayPolicyReject:
+		return 1
+	case ReplayPolicyAllowRetries:
+		if config.ReplayMaxUses <= 0 {
+			return defaultReplayMaxUses
+		}
+		return config.ReplayMaxUses
+	default:
+		return 0
+	}
+}
+
+func (config *JWTConfig) audienceFor(options *TokenOptions) string {
+	if config.EmitLegacyAudience || options == nil || options.Audience == "" {
+		return LegacyAudience
+	}
+	return options.Audience
+}
+
+func (config *JWTConfig) audienceAccepted(audience jwt.Audience) bool {
+	if config.Audience == "" && len(config.AudienceAliases) == 0 {
+		return audience.Contains(LegacyAudience)
+	}
+
+	if config.Audience != "" && audience.Contains(config.Audience) {
+		return true
+	}
+
+	for _, alias := range config.AudienceAliases {
+		if alias != "" && audience.Contains(alias) {
+			return true
+		}
+	}
+
+	return config.AcceptLegacyAudience && audience.Contains(LegacyAudience)
+}
+
+// keyMaterial returns the current key material of the KeyMaterialProvider.
+func (config *JWTConfig) keyMaterial() (*pki.KeyMaterial, error) {
+	if config.KeyMaterialProvider == nil {
+		return nil, errors.New("no key material provider configured")
+	}
+
+	material := config.KeyMaterialProvider.KeyMaterial()
+	if material == nil || material.CA == nil || material.Certificate == nil || material.PrivateKey == nil {
+		return nil, errors.New("no key material loaded")
+	}
+
+	return material, nil
+}
+
+func (config *JWTConfig) trustRoots() *pki.TrustRoots {
+	if config.TrustBundle != nil {
+		return config.TrustBundle.Roots()
+	}
+
+	material, err := config.keyMaterial()
+	if err != nil {
+		return pki.NewTrustRoots()
+	}
+
+	var anchors []*pki.TrustAnchor
+	for _, root := range material.Roots() {
+		anchors = append(anchors, &pki.TrustAnchor{Certificate: root})
+	}
+	return pki.NewTrustRoots(anchors...)
+}
+
+func (config *JWTConfig) maxDelegationDepth() int {
+	if config.MaxDelegationDepth == 0 {
+		return defaultMaxDelegationDepth
+	}
+	return config.MaxDelegationDepth
 }
@@ -0,0 +1,83 @@
+package wirepact
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMalformedToken is returned when the presented token cannot be parsed as a signed JWT.
+	ErrMalformedToken = errors.New("malformed wirepact jwt")
+
+	// ErrMissingCertificateHeaders is returned when the "x5c" or "x5t" header is missing.
+	ErrMissingCertificateHeaders = errors.New("missing jwt certificate headers")
+
+	// ErrUntrustedCertificate is returned when the "x5c" chain does not verify against the CA.
+	ErrUntrustedCertificate = errors.New("signer certificate is not trusted")
+
+	// ErrCertificateRevoked is returned when a certificate of the "x5c" chain
+	// is revoked or its revocation status is unknown.
+	ErrCertificateRevoked = errors.New("signer certificate is revoked")
+
+	// ErrSignerHashMismatch is returned when the "x5t" header does not match the signer certificate.
+	ErrSignerHashMismatch = errors.New("transported hash (x5t) does not match signer certificate hash")
+
+	// ErrInvalidSignature is returned when the JWS signature does not verify
+	// against the public key of the signer certificate.
+	ErrInvalidSignature = errors.New("invalid jwt signature")
+
+	// ErrTokenExpired is returned when the "exp" claim is missing or in the past.
+	ErrTokenExpired = errors.New("jwt is expired")
+
+	// ErrTokenNotYetValid is returned when the "nbf" or "iat" claim lies in the future.
+	ErrTokenNotYetValid = errors.New("jwt is not valid yet")
+
+	// ErrInvalidAudience is returned when the "aud" claim does not contain the expected audience.
+	ErrInvalidAudience = errors.New("invalid jwt audience")
+
+	// ErrInvalidIssuer is returned when the "iss" claim is missing or not accepted.
+	ErrInvalidIssuer = errors.New("invalid jwt issuer")
+
+	// ErrDelegationTooDeep is returned when the "act" chain contains
+	// more actors than allowed.
+	ErrDelegationTooDeep = errors.New("jwt delegation chain is too deep")
+
+	// ErrRequestBindingMismatch is returned when the request binding ("wpb") of
+	// the JWT is missing, too weak or does not match the request.
+	ErrRequestBindingMismatch = errors.New("jwt is not bound to the request")
+
+	// ErrTokenReplayed is returned when the "jti" claim was already seen
+	// more often than the replay policy allows or when it cannot be recorded
+	// (e.g. ErrReplayStoreFull).
+	ErrTokenReplayed = errors.New("jwt was replayed")
+)
+
+// VerificationError is returned by the verification functions when a WirePact JWT
+// is rejected. Reason contains one of the Err* values of this package, which allows
+// callers to use errors.Is to find out why the token was rejected. Err contains
+// the underlying error (if any).
+type VerificationError struct {
+	Reason error
+	Err    error
+}
+
+func (e *VerificationError) Error() string {
+	if e.Err == nil {
+		return e.Reason.Error()
+	}
+	return fmt.Sprintf("%v: %v", e.Reason, e.Err)
+}
+
+// Is reports whether the target is the reason of the verification error.
+func (e *VerificationError) Is(target error) bool {
+	return target == e.Reason
+}
+
+// Unwrap returns the underlying error.
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+func verificationError(reason error, err error) error {
+	return &VerificationError{Reason: reason, Err: err}
+}
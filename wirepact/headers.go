@@ -1,10 +1,17 @@
 package wirepact
 
 const (
-	// IdentityHeader defines the header that is transmitted
-	// as the WirePact identity. This is a RSA256 signed JSONWebToken (JWT).
+	// IdentityHeader defines the default header that is transmitted
+	// as the WirePact identity. This is a signed JSONWebToken (JWT).
+	// Other transports can be configured with a Transport.
 	IdentityHeader = "x-wirepact-identity"
 
 	// AuthorizationHeader is the default HTTP header for authorization.
 	AuthorizationHeader = "authorization"
+
+	// DelegationHeader carries the verified WirePact JWT of an incoming request
+	// to the application (if delegation is enabled). The application propagates
+	// the header to its outgoing requests, such that the egress can delegate
+	// the received identity.
+	DelegationHeader = "x-wirepact-delegation"
 )
@@ -0,0 +1,150 @@
+package wirepact
+
+import (
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Identity is the user identity that is transported within a WirePact JWT.
+// The standard fields are encoded as dedicated claims while the Claims map
+// can be used to transport arbitrary additional (JSON serializable) values.
+type Identity struct {
+	// The unique ID of the user (encoded as "sub").
+	Subject string
+
+	// The roles of the user (encoded as "roles").
+	Roles []string
+
+	// The tenant the user belongs to (encoded as "tenant").
+	Tenant string
+
+	// The email address of the user (encoded as "email").
+	Email string
+
+	// The display name of the user (encoded as "name").
+	Name string
+
+	// Additional claims that are transported with the identity.
+	// The keys must not collide with registered or WirePact claims.
+	Claims map[string]interface{}
+
+	// The chain of translators that acted on behalf of the user when the
+	// request was delegated over multiple hops (encoded as "act", RFC 8693).
+	// The outermost actor is the most recent one.
+	Actor *Actor
+
+	// The issuer (calling translator) of a received JWT.
+	// It is ignored when a JWT is created.
+	Issuer string `json:"-"`
+
+	// The SPIFFE ID of the signer certificate (the calling translator) of a
+	// received JWT, if the certificate contains one (see pki.SPIFFEID).
+	// It is ignored when a JWT is created.
+	Workload string `json:"-"`
+}
+
+// Actor is an entry of a delegation chain (RFC 8693 "act" claim).
+type Actor struct {
+	// The identity of the acting translator.
+	Subject string `json:"sub"`
+
+	// The actor that delegated the request to this actor.
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Depth returns the number of actors in the chain.
+func (actor *Actor) Depth() int {
+	depth := 0
+	for ; actor != nil; actor = actor.Actor {
+		depth++
+	}
+	return depth
+}
+
+type identityClaims struct {
+	Roles  []string `json:"roles,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+	Email  string   `json:"email,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Actor  *Actor   `json:"act,omitempty"`
+}
+
+var reservedClaims = map[string]bool{
+	"iss":    true,
+	"sub":    true,
+	"aud":    true,
+	"exp":    true,
+	"nbf":    true,
+	"iat":    true,
+	"jti":    true,
+	"roles":  true,
+	"tenant": true,
+	"email":  true,
+	"name":   true,
+	"act":    true,
+	"wpb":    true,
+}
+
+func (identity *Identity) customClaims() (map[string]interface{}, error) {
+	claims := make(map[string]interface{}, len(identity.Claims))
+	for key, value := range identity.Claims {
+		if reservedClaims[key] {
+			return nil, fmt.Errorf("claim %q is reserved and cannot be set as custom claim", key)
+		}
+		claims[key] = value
+	}
+
+	return claims, nil
+}
+
+func newIdentity(claims *jwt.Claims, identityClaims *identityClaims, allClaims map[string]interface{}) *Identity {
+	identity := &Identity{
+		Subject: claims.Subject,
+		Roles:   identityClaims.Roles,
+		Tenant:  identityClaims.Tenant,
+		Email:   identityClaims.Email,
+		Name:    identityClaims.Name,
+		Actor:   identityClaims.Actor,
+		Issuer:  claims.Issuer,
+	}
+
+	for key, value := range allClaims {
+		if reservedClaims[key] {
+			continue
+		}
+		if identity.Claims == nil {
+			identity.Claims = map[string]interface{}{}
+		}
+		identity.Claims[key] = value
+	}
+
+	return identity
+}
+
+// ActorChain returns the subjects of the delegation chain,
+// starting with the most recent actor.
+func (identity *Identity) ActorChain() []string {
+	var chain []string
+	for actor := identity.Actor; actor != nil; actor = actor.Actor {
+		chain = append(chain, actor.Subject)
+	}
+	return chain
+}
+
+// Delegate creates a copy of the received identity that is delegated by the
+// given actor (the issuer of the new JWT). The caller (issuer) of the received
+// identity is added to the delegation chain if the chain is empty.
+func (identity *Identity) Delegate(actor string) *Identity {
+	delegated := *identity
+	delegated.Issuer = ""
+	delegated.Workload = ""
+
+	previous := identity.Actor
+	if previous == nil && identity.Issuer != "" {
+		previous = &Actor{Subject: identity.Issuer}
+	}
+	delegated.Actor = &Actor{Subject: actor, Actor: previous}
+
+	return &delegated
+}
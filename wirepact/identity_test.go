@@ -0,0 +1,147 @@
+package wirepact
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"github.com/WirePact/go-translator/pki"
+)
+
+func TestIdentityRoundTrip(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+
+	token, err := CreateSignedJWTForIdentity(config, &Identity{
+		Subject: "alice",
+		Roles:   []string{"admin", "auditor"},
+		Tenant:  "acme",
+		Email:   "alice@acme.org",
+		Name:    "Alice",
+		Claims: map[string]interface{}{
+			"department": "it",
+			"level":      3,
+			"groups":     []string{"a", "b"},
+		},
+		Issuer:   "ignored",
+		Workload: "ignored",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := GetJWTIdentity(config, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Identity{
+		Subject: "alice",
+		Roles:   []string{"admin", "auditor"},
+		Tenant:  "acme",
+		Email:   "alice@acme.org",
+		Name:    "Alice",
+		Claims: map[string]interface{}{
+			"department": "it",
+			"level":      float64(3),
+			"groups":     []interface{}{"a", "b"},
+		},
+		Issuer: "translator-a",
+	}
+	if !reflect.DeepEqual(identity, expected) {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestIdentityWithSubjectOnly(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+
+	token, err := CreateSignedJWTForUser(config, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := GetJWTIdentity(config, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(identity, &Identity{Subject: "alice", Issuer: "translator-a"}) {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	subject, err := GetJWTUserSubjectWithConfig(config, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "alice" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+}
+
+func TestDeprecatedGetJWTUserSubject(t *testing.T) {
+	err := pki.EnsureKeyMaterial(newTestPKIConfig(pkitest.NewPKI(t, nil), "translator-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := CreateSignedJWTForUser(&JWTConfig{Issuer: "translator-a", KeyMaterialProvider: pki.GetKeyMaterial()}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key material of EnsureKeyMaterial is used without a config.
+	subject, err := GetJWTUserSubject(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "alice" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+
+	_, err = GetJWTUserSubject(token[:len(token)-4] + "AAAA")
+	expectReason(t, err, ErrInvalidSignature)
+}
+
+func TestIdentityRejectsReservedClaims(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+
+	for claim := range reservedClaims {
+		_, err := CreateSignedJWTForIdentity(config, &Identity{
+			Subject: "alice",
+			Claims:  map[string]interface{}{claim: "forged"},
+		})
+		if err == nil {
+			t.Fatalf("reserved claim %q was accepted as custom claim", claim)
+		}
+	}
+}
+
+func TestIdentityDelegate(t *testing.T) {
+	received := &Identity{Subject: "alice", Roles: []string{"admin"}, Issuer: "translator-a", Workload: "spiffe://example.org/a"}
+
+	delegated := received.Delegate("translator-b")
+	if delegated.Issuer != "" || delegated.Workload != "" {
+		t.Fatal("issuer and workload of the received identity were kept")
+	}
+	if delegated.Subject != "alice" || len(delegated.Roles) != 1 {
+		t.Fatalf("user of the identity was not kept: %+v", delegated)
+	}
+	if chain := delegated.ActorChain(); !reflect.DeepEqual(chain, []string{"translator-b", "translator-a"}) {
+		t.Fatalf("unexpected actor chain %v", chain)
+	}
+	if received.Actor != nil {
+		t.Fatal("received identity was modified")
+	}
+
+	// An existing chain is extended instead of adding the issuer again.
+	delegated.Issuer = "translator-b"
+	if chain := delegated.Delegate("translator-c").ActorChain(); !reflect.DeepEqual(chain, []string{"translator-c", "translator-b", "translator-a"}) {
+		t.Fatalf("unexpected actor chain %v", chain)
+	}
+	if depth := delegated.Delegate("translator-c").Actor.Depth(); depth != 3 {
+		t.Fatalf("unexpected depth %v", depth)
+	}
+
+	if chain := (&Identity{Subject: "alice"}).Delegate("translator-a").ActorChain(); !reflect.DeepEqual(chain, []string{"translator-a"}) {
+		t.Fatalf("unexpected actor chain %v", chain)
+	}
+}
@@ -0,0 +1,89 @@
+package wirepact
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// JWKSPath is the path of the JWKS endpoint of the TrustHandler.
+	JWKSPath = "/.well-known/jwks.json"
+
+	// TrustBundlePath is the path of the PEM encoded CA bundle of the TrustHandler.
+	TrustBundlePath = "/trust-bundle.pem"
+)
+
+// JWKS returns a JSON web key set that contains the current signing key
+// of the KeyMaterialProvider of the config. The key contains the certificate
+// chain ("x5c") and uses the same key ID as the "x5t" header of the created
+// WirePact JWTs.
+func JWKS(config *JWTConfig) (*jose.JSONWebKeySet, error) {
+	keyMaterial, err := config.keyMaterial()
+	if err != nil {
+		return nil, err
+	}
+	certificate := keyMaterial.Certificate
+
+	algorithm, err := SignatureAlgorithm(keyMaterial.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	_, x5t := keyMaterial.JWTCertificateHeaders()
+	thumbprint := sha256.Sum256(certificate.Raw)
+
+	return &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{
+			{
+				Key:                         certificate.PublicKey,
+				KeyID:                       x5t,
+				Algorithm:                   string(algorithm),
+				Use:                         "sig",
+				Certificates:                keyMaterial.Chain(),
+				CertificateThumbprintSHA256: thumbprint[:],
+			},
+		},
+	}, nil
+}
+
+// NewTrustHandler creates an http handler that publishes the current key
+// material, such that other systems can verify WirePact JWTs. The handler
+// serves the JWKS (JWKSPath) and the PEM encoded trusted CA certificates
+// (TrustBundlePath) of the given config. Since the data is read on every
+// request, rotated key material is published automatically.
+func NewTrustHandler(config *JWTConfig) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(JWKSPath, func(writer http.ResponseWriter, _ *http.Request) {
+		jwks, err := JWKS(config)
+		if err != nil {
+			logrus.WithError(err).Error("Could not create JWKS.")
+			http.Error(writer, "key material not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/jwk-set+json")
+		err = json.NewEncoder(writer).Encode(jwks)
+		if err != nil {
+			logrus.WithError(err).Error("Could not write JWKS.")
+		}
+	})
+
+	mux.HandleFunc(TrustBundlePath, func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("Content-Type", "application/x-pem-file")
+		for _, anchor := range config.trustRoots().Anchors() {
+			err := pem.Encode(writer, &pem.Block{Type: "CERTIFICATE", Bytes: anchor.Certificate.Raw})
+			if err != nil {
+				logrus.WithError(err).Error("Could not write trust bundle.")
+				return
+			}
+		}
+	})
+
+	return mux
+}
@@ -0,0 +1,103 @@
+package wirepact
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"github.com/WirePact/go-translator/pki"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func get(t *testing.T, handler http.Handler, path string) *http.Response {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Result()
+}
+
+func TestTrustHandlerPublishesJWKS(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	config := newTestJWTConfig(t, testPKI, "translator-a")
+	handler := NewTrustHandler(config)
+
+	response := get(t, handler, JWKSPath)
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/jwk-set+json" {
+		t.Fatalf("unexpected response %v (%v)", response.Status, response.Header.Get("Content-Type"))
+	}
+	var jwks jose.JSONWebKeySet
+	err := json.NewDecoder(response.Body).Decode(&jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := CreateSignedJWTForUser(config, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := jose.ParseSigned(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A JWT can be verified with the key of its "x5t" header.
+	keys := jwks.Key(signature.Signatures[0].Header.ExtraHeaders["x5t"].(string))
+	if len(keys) != 1 {
+		t.Fatalf("expected a key for the x5t header, got %v", len(keys))
+	}
+	if keys[0].Algorithm != signature.Signatures[0].Header.Algorithm || keys[0].Use != "sig" ||
+		!keys[0].Certificates[0].Equal(config.KeyMaterialProvider.KeyMaterial().Certificate) {
+		t.Fatalf("unexpected key %+v", keys[0])
+	}
+	_, err = signature.Verify(keys[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustHandlerPublishesTrustBundle(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	config := newTestJWTConfig(t, testPKI, "translator-a")
+	federated := pkitest.NewCA(t, "federated", nil)
+	config.TrustBundle = pki.NewTrustBundle(
+		pki.LocalCATrustSource(config.KeyMaterialProvider),
+		pki.TrustSourceFunc(func() ([]*pki.TrustAnchor, error) {
+			return []*pki.TrustAnchor{{Certificate: federated.Certificate}}, nil
+		}),
+	)
+	err := config.TrustBundle.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := get(t, NewTrustHandler(config), TrustBundlePath)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", response.Status)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := map[string]bool{}
+	for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+		published[string(block.Bytes)] = true
+	}
+	if len(published) != 2 || !published[string(testPKI.CA().Certificate.Raw)] || !published[string(federated.Certificate.Raw)] {
+		t.Fatalf("unexpected trust bundle with %v certificates", len(published))
+	}
+}
+
+func TestTrustHandlerWithoutKeyMaterial(t *testing.T) {
+	config := &JWTConfig{KeyMaterialProvider: pki.NewKeyMaterialProvider(newTestPKIConfig(pkitest.NewPKI(t, nil), "translator-a"))}
+
+	response := get(t, NewTrustHandler(config), JWKSPath)
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %v", response.Status)
+	}
+}
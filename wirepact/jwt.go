@@ -4,27 +4,109 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/WirePact/go-translator/pki"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
+// LegacyAudience is the fixed audience that was used for all WirePact JWTs
+// before tokens were bound to the destination translator.
+const LegacyAudience = "WirePact"
+
+// AuthorityAudience returns the audience for a request to the given authority
+// (the host without the port). The egress uses it for the destination, unless
+// the egress translator returns an explicit audience.
+func AuthorityAudience(authority string) string {
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		return host
+	}
+	return authority
+}
+
+// TokenOptions contains optional, per request values for a WirePact JWT.
+type TokenOptions struct {
+	// The audience of the JWT. This should be the identity of the destination
+	// translator (e.g. the AuthorityAudience of the request). If omitted or if EmitLegacyAudience is set
+	// in the JWTConfig, the LegacyAudience is used.
+	Audience string
+
+	// The request the JWT is sent with. If a RequestBindingRule of the
+	// JWTConfig matches the path, the JWT is bound to the request.
+	Request *BoundRequest
+}
+
+func (options *TokenOptions) binding(config *JWTConfig) *requestBinding {
+	if options == nil || options.Request == nil {
+		return nil
+	}
+	return newRequestBinding(config.bindingStrengthFor(options.Request.Path), options.Request)
+}
+
 // CreateSignedJWTForUser creates a valid signed JWT for the given userID.
-// The JWT is signed with the private key (RSA256) from the key material.
+// It is a shorthand for CreateSignedJWTForIdentity with an identity that
+// only contains the subject.
+func CreateSignedJWTForUser(config *JWTConfig, userID string) (string, error) {
+	return CreateSignedJWTForIdentity(config, &Identity{Subject: userID})
+}
+
+// CreateSignedJWTForIdentity creates a valid signed JWT for the given identity.
+// It is a shorthand for CreateSignedJWT without any options.
+func CreateSignedJWTForIdentity(config *JWTConfig, identity *Identity) (string, error) {
+	return CreateSignedJWT(config, identity, nil)
+}
+
+// CreateSignedJWT creates a valid signed JWT for the given identity and options.
+// The JWT is signed with the private key from the KeyMaterialProvider of the config. The JWS algorithm
+// is derived from the key type (see SignatureAlgorithm).
 // Additionally, the optional headers "x5c" and "x5t"
 // (https://datatracker.ietf.org/doc/html/rfc7515#section-4.1.6)
 // are added - as they are required by WirePact - to enable the receiver to validate
-// the presented signature. The audience is always set to "WirePact".
-func CreateSignedJWTForUser(config *JWTConfig, userID string) (string, error) {
+// the presented signature.
+func CreateSignedJWT(config *JWTConfig, identity *Identity, options *TokenOptions) (string, error) {
+	keyMaterial, err := config.keyMaterial()
+	if err != nil {
+		return "", err
+	}
+
+	return createSignedJWT(config, keyMaterial, identity, options)
+}
+
+// createSignedJWT signs the JWT with the given snapshot of the key material,
+// since the key material of the provider may be renewed concurrently.
+// Every JWT gets a unique token ID ("jti").
+func createSignedJWT(config *JWTConfig, keyMaterial *pki.KeyMaterial, identity *Identity, options *TokenOptions) (string, error) {
+	if identity == nil || identity.Subject == "" {
+		return "", errors.New("empty subject")
+	}
+
+	customClaims, err := identity.customClaims()
+	if err != nil {
+		return "", err
+	}
+
+	if depth := identity.Actor.Depth(); depth > config.maxDelegationDepth() {
+		return "", fmt.Errorf("%w: %v actors", ErrDelegationTooDeep, depth)
+	}
+
+	algorithm, err := SignatureAlgorithm(keyMaterial.KeyType)
+	if err != nil {
+		return "", err
+	}
+
 	signingKey := jose.SigningKey{
-		Algorithm: jose.RS256,
-		Key:       pki.GetPrivateKey(),
+		Algorithm: algorithm,
+		Key:       keyMaterial.PrivateKey,
 	}
 
-	x5c, x5t := pki.GetJWTCertificateHeaders()
+	x5c, x5t := keyMaterial.JWTCertificateHeaders()
 
 	var signerOpts = jose.SignerOptions{}
 	signerOpts.
@@ -32,31 +114,45 @@ func CreateSignedJWTForUser(config *JWTConfig, userID string) (string, error) {
 		WithHeader("x5c", x5c).
 		WithHeader("x5t", x5t)
 
-	rsaSigner, err := jose.NewSigner(signingKey, &signerOpts)
+	signer, err := jose.NewSigner(signingKey, &signerOpts)
 	if err != nil {
 		return "", err
 	}
 
-	builder := jwt.Signed(rsaSigner)
+	builder := jwt.Signed(signer)
 
-	lifetime := config.Lifetime
-	if lifetime == 0 {
-		lifetime = 60 * time.Second
-	}
+	lifetime := config.lifetime()
 
 	if config.Issuer == "" {
 		return "", errors.New("empty issuer")
 	}
 
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
 	claims := &jwt.Claims{
-		Subject:  userID,
+		ID:       tokenID,
+		Subject:  identity.Subject,
 		Issuer:   config.Issuer,
-		Audience: jwt.Audience{"WirePact"},
+		Audience: jwt.Audience{config.audienceFor(options)},
 		IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
 		Expiry:   jwt.NewNumericDate(time.Now().UTC().Add(lifetime)),
 	}
 
-	signedToken, err := builder.Claims(claims).CompactSerialize()
+	signedToken, err := builder.
+		Claims(claims).
+		Claims(&identityClaims{
+			Roles:  identity.Roles,
+			Tenant: identity.Tenant,
+			Email:  identity.Email,
+			Name:   identity.Name,
+			Actor:  identity.Actor,
+		}).
+		Claims(&bindingClaims{Binding: options.binding(config)}).
+		Claims(customClaims).
+		CompactSerialize()
 	if err != nil {
 		return "", err
 	}
@@ -65,51 +161,274 @@ func CreateSignedJWTForUser(config *JWTConfig, userID string) (string, error) {
 }
 
 // GetJWTUserSubject takes the WirePact encoded JWT and extracts the user subject.
-// First, the function checks the x5c and x5t headers and validates the
-// JWT signature against its own CA certificate. Then, if the JWT is valid
-// the subject is extracted. If any error occurs (missing certificate headers,
-// wrong certificate or other errors) the error is returned with an empty string.
+// The JWT is verified with the default JWTConfig against the key material that
+// was loaded with pki.EnsureKeyMaterial.
+//
+// Deprecated: Use GetJWTUserSubjectWithConfig or GetJWTIdentity.
 func GetJWTUserSubject(wirePactJWT string) (string, error) {
-	parsedJWT, err := jwt.ParseSigned(wirePactJWT)
+	return GetJWTUserSubjectWithConfig(&JWTConfig{KeyMaterialProvider: pki.GetKeyMaterial()}, wirePactJWT)
+}
+
+// GetJWTUserSubjectWithConfig takes the WirePact encoded JWT and extracts the user subject.
+// It is a shorthand for GetJWTIdentity that only returns the subject.
+func GetJWTUserSubjectWithConfig(config *JWTConfig, wirePactJWT string) (string, error) {
+	identity, err := GetJWTIdentity(config, wirePactJWT)
 	if err != nil {
 		return "", err
 	}
 
-	if len(parsedJWT.Headers) < 1 {
-		return "", errors.New("missing jwt headers")
+	return identity.Subject, nil
+}
+
+// GetJWTIdentity takes the WirePact encoded JWT and extracts the user identity.
+// First, the function checks the x5c and x5t headers and validates the
+// certificate chain against the configured TrustBundle (or its own CA certificate)
+// and the optional RevocationChecker. Then the JWS signature is
+// verified with the public key of the signer certificate and the standard
+// claims ("exp", "nbf", "iat", "aud" and "iss") are validated with the
+// configured clock leeway. The audience must match the configured Audience
+// or one of the AudienceAliases (or the LegacyAudience, if accepted or if no
+// Audience is configured). If the JWT is valid, the identity is extracted.
+// If any error occurs, a *VerificationError that contains the reason is
+// returned with a nil identity.
+//
+// GetJWTIdentity does not verify request bound JWTs against the request,
+// use GetJWTIdentityForRequest to do so.
+func GetJWTIdentity(config *JWTConfig, wirePactJWT string) (*Identity, error) {
+	return verifyJWT(config, wirePactJWT, nil, false)
+}
+
+// GetJWTIdentityForRequest verifies the WirePact JWT like GetJWTIdentity.
+// Additionally, the request binding of the JWT is verified against the given
+// request. If a RequestBindingRule of the config matches the request path,
+// the JWT must be bound with at least the configured strength.
+func GetJWTIdentityForRequest(config *JWTConfig, wirePactJWT string, request *BoundRequest) (*Identity, error) {
+	return verifyJWT(config, wirePactJWT, request, false)
+}
+
+// GetPropagatedJWTIdentity verifies a WirePact JWT that was received by the
+// ingress and then propagated by the application to an outgoing request.
+// The verification is the same as in GetJWTIdentity, except that the token
+// ID is not recorded in the replay store (since the ingress already did so).
+func GetPropagatedJWTIdentity(config *JWTConfig, wirePactJWT string) (*Identity, error) {
+	return verifyJWT(config, wirePactJWT, nil, true)
+}
+
+func verifyJWT(config *JWTConfig, wirePactJWT string, request *BoundRequest, propagated bool) (*Identity, error) {
+	parsedJWT, err := jwt.ParseSigned(wirePactJWT)
+	if err != nil {
+		return nil, verificationError(ErrMalformedToken, err)
+	}
+
+	if len(parsedJWT.Headers) != 1 {
+		return nil, verificationError(ErrMalformedToken, errors.New("expected exactly one jwt signature"))
 	}
 
 	header := parsedJWT.Headers[0]
+	if !config.algorithmAccepted(header.Algorithm) {
+		return nil, verificationError(ErrInvalidSignature, fmt.Errorf("algorithm %q is not accepted", header.Algorithm))
+	}
 
-	roots := x509.NewCertPool()
-	roots.AddCert(pki.GetCA())
+	if !protectedHeaderContains(wirePactJWT, "x5c") {
+		return nil, verificationError(ErrMissingCertificateHeaders, errors.New("x5c certificate chain missing"))
+	}
+
+	signerCertificateHash, ok := header.ExtraHeaders["x5t"].(string)
+	if !ok {
+		return nil, verificationError(ErrMissingCertificateHeaders, errors.New("x5t signer hash missing"))
+	}
 
-	certificateChain, err := header.Certificates(x509.VerifyOptions{
-		Roots: roots,
+	roots := config.trustRoots()
+
+	certificateChains, err := header.Certificates(x509.VerifyOptions{
+		Roots: roots.CertPool(),
 	})
 	if err != nil {
-		return "", err
+		return nil, verificationError(ErrUntrustedCertificate, err)
 	}
 
-	signerCertificateHash, ok := header.ExtraHeaders["x5t"]
-	if !ok {
-		return "", errors.New("x5t signer hash missing")
+	err = checkRevocation(config, certificateChains[0])
+	if err != nil {
+		return nil, err
 	}
 
-	signerCertificate := certificateChain[0][0]
+	signerCertificate := certificateChains[0][0]
 
 	calculatedSignerHash := sha256.Sum256(signerCertificate.Raw)
 	calculatedSignerHashString := base64.StdEncoding.EncodeToString(calculatedSignerHash[:])
 
 	if calculatedSignerHashString != signerCertificateHash {
-		return "", errors.New("transported hash (x5t) does not match signer certificate hash")
+		return nil, verificationError(ErrSignerHashMismatch, nil)
 	}
 
 	claims := &jwt.Claims{}
-	err = parsedJWT.UnsafeClaimsWithoutVerification(claims)
+	identityClaims := &identityClaims{}
+	bindingClaims := &bindingClaims{}
+	allClaims := map[string]interface{}{}
+	err = parsedJWT.Claims(signerCertificate.PublicKey, claims, identityClaims, bindingClaims, &allClaims)
 	if err != nil {
-		return "", err
+		return nil, verificationError(ErrInvalidSignature, err)
+	}
+
+	err = validateClaims(config, claims, signerCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	if !anchorAllowsIssuer(roots, certificateChains, claims.Issuer) {
+		return nil, verificationError(ErrInvalidIssuer, fmt.Errorf("issuer %q is not allowed by the trust anchor", claims.Issuer))
+	}
+
+	if claims.Subject == "" {
+		return nil, verificationError(ErrMalformedToken, errors.New("sub claim missing"))
+	}
+
+	if request != nil && !verifyRequestBinding(config, bindingClaims.Binding, request) {
+		return nil, verificationError(ErrRequestBindingMismatch, nil)
+	}
+
+	identity := newIdentity(claims, identityClaims, allClaims)
+	identity.Workload = pki.SPIFFEID(signerCertificate)
+	if depth := identity.Actor.Depth(); depth > config.maxDelegationDepth() {
+		return nil, verificationError(ErrDelegationTooDeep, fmt.Errorf("delegation chain has %v actors", depth))
+	}
+
+	if !propagated {
+		err = checkReplay(config, claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return identity, nil
+}
+
+// protectedHeaderContains checks if the protected header of the compact
+// serialized JWT contains the given key. The parsed header of go-jose does
+// not expose whether the "x5c" header is present.
+func protectedHeaderContains(compactJWT string, key string) bool {
+	encoded := strings.SplitN(compactJWT, ".", 2)[0]
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+
+	var header map[string]json.RawMessage
+	err = json.Unmarshal(decoded, &header)
+	if err != nil {
+		return false
+	}
+
+	_, ok := header[key]
+	return ok
+}
+
+// checkRevocation checks all certificates of the chain (except the root)
+// with the configured revocation checker.
+func checkRevocation(config *JWTConfig, certificateChain []*x509.Certificate) error {
+	if config.RevocationChecker == nil {
+		return nil
+	}
+
+	for _, certificate := range certificateChain[:len(certificateChain)-1] {
+		err := config.RevocationChecker.Check(certificate)
+		if err != nil {
+			return verificationError(ErrCertificateRevoked, err)
+		}
+	}
+
+	return nil
+}
+
+func validateClaims(config *JWTConfig, claims *jwt.Claims, signerCertificate *x509.Certificate) error {
+	if claims.Expiry == nil {
+		return verificationError(ErrTokenExpired, errors.New("exp claim missing"))
+	}
+
+	err := claims.ValidateWithLeeway(jwt.Expected{
+		Time: time.Now().UTC(),
+	}, config.clockLeeway())
+	switch err {
+	case nil:
+	case jwt.ErrExpired:
+		return verificationError(ErrTokenExpired, err)
+	case jwt.ErrNotValidYet, jwt.ErrIssuedInTheFuture:
+		return verificationError(ErrTokenNotYetValid, err)
+	default:
+		return verificationError(ErrMalformedToken, err)
+	}
+
+	if !config.audienceAccepted(claims.Audience) {
+		return verificationError(ErrInvalidAudience, fmt.Errorf("audience %v is not accepted", claims.Audience))
+	}
+
+	if !issuerAllowed(config, claims.Issuer, signerCertificate) {
+		return verificationError(ErrInvalidIssuer, fmt.Errorf("issuer %q is not accepted", claims.Issuer))
+	}
+
+	return nil
+}
+
+func checkReplay(config *JWTConfig, claims *jwt.Claims) error {
+	maxUses := config.replayMaxUses()
+	if maxUses == 0 {
+		return nil
+	}
+
+	if claims.ID == "" {
+		return verificationError(ErrMalformedToken, errors.New("jti claim missing"))
+	}
+
+	if config.ReplayStore == nil {
+		return errors.New("replay policy configured without replay store")
+	}
+
+	uses, err := config.ReplayStore.Record(claims.ID, claims.Expiry.Time().Add(config.clockLeeway()))
+	if errors.Is(err, ErrReplayStoreFull) {
+		logrus.WithError(err).Warn("Rejected WirePact JWT, since its jti cannot be recorded.")
+		return verificationError(ErrTokenReplayed, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if uses > maxUses {
+		return verificationError(ErrTokenReplayed, fmt.Errorf("jti %q was used %v times", claims.ID, uses))
+	}
+
+	return nil
+}
+
+// anchorAllowsIssuer checks if any trust anchor of the verified
+// certificate chains accepts the issuer.
+func anchorAllowsIssuer(roots *pki.TrustRoots, certificateChains [][]*x509.Certificate, issuer string) bool {
+	for _, chain := range certificateChains {
+		anchor := roots.Anchor(chain[len(chain)-1])
+		if anchor != nil && anchor.AllowsIssuer(issuer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func issuerAllowed(config *JWTConfig, issuer string, signerCertificate *x509.Certificate) bool {
+	if issuer == "" {
+		return false
+	}
+
+	if len(config.AllowedIssuers) == 0 {
+		if spiffeID := pki.SPIFFEID(signerCertificate); spiffeID != "" && issuer == spiffeID {
+			return true
+		}
+		return issuer == signerCertificate.Subject.CommonName
+	}
+
+	for _, allowed := range config.AllowedIssuers {
+		if issuer == allowed {
+			return true
+		}
 	}
 
-	return claims.Subject, nil
+	return false
 }
@@ -0,0 +1,495 @@
+package wirepact
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"github.com/WirePact/go-translator/pki"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func newTestPKIConfig(testPKI *pkitest.PKI, commonName string) *pki.Config {
+	return &pki.Config{
+		BaseAddress:           testPKI.URL,
+		CAPath:                pkitest.CAPath,
+		CSRPath:               pkitest.CSRPath,
+		CRLPath:               pkitest.CRLPath,
+		RequestRetries:        -1,
+		Store:                 pki.NewMemoryStore(),
+		CertificateCommonName: commonName,
+		KeyType:               pki.KeyTypeECDSAP256,
+	}
+}
+
+// enroll creates a key material provider with a certificate of the PKI.
+func enroll(t *testing.T, config *pki.Config) *pki.DefaultKeyMaterialProvider {
+	t.Helper()
+
+	provider := pki.NewKeyMaterialProvider(config)
+	err := provider.Ensure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func newTestJWTConfig(t *testing.T, testPKI *pkitest.PKI, commonName string) *JWTConfig {
+	return &JWTConfig{
+		Issuer:              commonName,
+		KeyMaterialProvider: enroll(t, newTestPKIConfig(testPKI, commonName)),
+	}
+}
+
+func expectReason(t *testing.T, err error, reason error) {
+	t.Helper()
+	if !errors.Is(err, reason) {
+		t.Fatalf("expected %v, got %v", reason, err)
+	}
+}
+
+func TestJWTRoundTrip(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+
+	token, err := CreateSignedJWTForIdentity(config, &Identity{
+		Subject: "alice",
+		Roles:   []string{"admin"},
+		Claims:  map[string]interface{}{"department": "it"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := GetJWTIdentity(config, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "alice" || len(identity.Roles) != 1 || identity.Roles[0] != "admin" || identity.Claims["department"] != "it" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+	if identity.Issuer != "translator-a" {
+		t.Fatalf("unexpected issuer %q", identity.Issuer)
+	}
+
+	_, err = GetJWTIdentity(config, token[:len(token)-4]+"AAAA")
+	expectReason(t, err, ErrInvalidSignature)
+}
+
+func TestJWTRejectsInvalidTokens(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	config := newTestJWTConfig(t, testPKI, "translator-a")
+
+	expired, err := CreateSignedJWTForUser(&JWTConfig{
+		Issuer:              config.Issuer,
+		KeyMaterialProvider: config.KeyMaterialProvider,
+		Lifetime:            -time.Hour,
+	}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, expired)
+	expectReason(t, err, ErrTokenExpired)
+
+	// The issuer must match the common name of the signer certificate.
+	spoofed, err := CreateSignedJWTForUser(&JWTConfig{
+		Issuer:              "translator-b",
+		KeyMaterialProvider: config.KeyMaterialProvider,
+	}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, spoofed)
+	expectReason(t, err, ErrInvalidIssuer)
+
+	// A certificate of another PKI is not trusted.
+	foreign, err := CreateSignedJWTForUser(newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, foreign)
+	expectReason(t, err, ErrUntrustedCertificate)
+
+	_, err = GetJWTIdentity(config, "not-a-jwt")
+	expectReason(t, err, ErrMalformedToken)
+}
+
+// signTestJWT signs the claims with the key material, the algorithm and the headers
+// (instead of the "x5c" and "x5t" headers of CreateSignedJWT).
+func signTestJWT(t *testing.T, material *pki.KeyMaterial, algorithm jose.SignatureAlgorithm, key interface{}, headers map[jose.HeaderKey]interface{}, claims interface{}) string {
+	t.Helper()
+
+	if key == nil {
+		key = material.PrivateKey
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key}, &jose.SignerOptions{ExtraHeaders: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTClockLeeway(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+
+	expired, err := CreateSignedJWTForUser(&JWTConfig{
+		Issuer:              config.Issuer,
+		KeyMaterialProvider: config.KeyMaterialProvider,
+		Lifetime:            -30 * time.Second,
+	}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default leeway of 60 seconds accepts the token.
+	_, err = GetJWTIdentity(config, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = GetJWTIdentity(&JWTConfig{
+		KeyMaterialProvider: config.KeyMaterialProvider,
+		ClockLeeway:         10 * time.Second,
+	}, expired)
+	expectReason(t, err, ErrTokenExpired)
+}
+
+func TestJWTAlgorithmAllowlist(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+	material := config.KeyMaterialProvider.KeyMaterial()
+	x5c, x5t := material.JWTCertificateHeaders()
+
+	token, err := CreateSignedJWTForUser(config, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = GetJWTIdentity(&JWTConfig{
+		KeyMaterialProvider: config.KeyMaterialProvider,
+		AcceptedAlgorithms:  []jose.SignatureAlgorithm{jose.ES384},
+	}, token)
+	expectReason(t, err, ErrInvalidSignature)
+
+	_, err = GetJWTIdentity(&JWTConfig{
+		KeyMaterialProvider: config.KeyMaterialProvider,
+		AcceptedAlgorithms:  []jose.SignatureAlgorithm{jose.ES384, jose.ES256},
+	}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Symmetric algorithms are never supported (e.g. with the public key as secret).
+	hmac := signTestJWT(t, material, jose.HS256, []byte("public key"), map[jose.HeaderKey]interface{}{"x5c": x5c, "x5t": x5t}, &jwt.Claims{
+		Subject: "alice",
+		Issuer:  "translator-a",
+		Expiry:  jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	})
+	_, err = GetJWTIdentity(config, hmac)
+	expectReason(t, err, ErrInvalidSignature)
+}
+
+func TestJWTVerificationErrorReasons(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+	material := config.KeyMaterialProvider.KeyMaterial()
+	x5c, x5t := material.JWTCertificateHeaders()
+	otherX5C, otherX5T := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a").KeyMaterialProvider.KeyMaterial().JWTCertificateHeaders()
+
+	valid := &jwt.Claims{
+		Subject:  "alice",
+		Issuer:   "translator-a",
+		Audience: jwt.Audience{LegacyAudience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+
+	tests := []struct {
+		name    string
+		headers map[jose.HeaderKey]interface{}
+		claims  *jwt.Claims
+		reason  error
+	}{
+		{name: "valid", headers: map[jose.HeaderKey]interface{}{"x5c": x5c, "x5t": x5t}, claims: valid},
+		{name: "missing x5c", headers: map[jose.HeaderKey]interface{}{"x5t": x5t}, claims: valid, reason: ErrMissingCertificateHeaders},
+		{name: "missing x5t", headers: map[jose.HeaderKey]interface{}{"x5c": x5c}, claims: valid, reason: ErrMissingCertificateHeaders},
+		{name: "x5t of another certificate", headers: map[jose.HeaderKey]interface{}{"x5c": x5c, "x5t": otherX5T}, claims: valid, reason: ErrSignerHashMismatch},
+		{name: "x5c of another pki", headers: map[jose.HeaderKey]interface{}{"x5c": otherX5C, "x5t": otherX5T}, claims: valid, reason: ErrUntrustedCertificate},
+		{
+			name:    "missing exp",
+			headers: map[jose.HeaderKey]interface{}{"x5c": x5c, "x5t": x5t},
+			claims:  &jwt.Claims{Subject: "alice", Issuer: "translator-a", Audience: jwt.Audience{LegacyAudience}},
+			reason:  ErrTokenExpired,
+		},
+		{
+			name:    "issued in the future",
+			headers: map[jose.HeaderKey]interface{}{"x5c": x5c, "x5t": x5t},
+			claims: &jwt.Claims{
+				Subject:  "alice",
+				Issuer:   "translator-a",
+				Audience: jwt.Audience{LegacyAudience},
+				IssuedAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+				Expiry:   jwt.NewNumericDate(time.Now().Add(10 * time.Minute)),
+			},
+			reason: ErrTokenNotYetValid,
+		},
+		{
+			name:    "missing sub",
+			headers: map[jose.HeaderKey]interface{}{"x5c": x5c, "x5t": x5t},
+			claims:  &jwt.Claims{Issuer: "translator-a", Audience: jwt.Audience{LegacyAudience}, Expiry: valid.Expiry},
+			reason:  ErrMalformedToken,
+		},
+		{
+			name:    "missing iss",
+			headers: map[jose.HeaderKey]interface{}{"x5c": x5c, "x5t": x5t},
+			claims:  &jwt.Claims{Subject: "alice", Audience: jwt.Audience{LegacyAudience}, Expiry: valid.Expiry},
+			reason:  ErrInvalidIssuer,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := signTestJWT(t, material, jose.ES256, nil, test.headers, test.claims)
+
+			_, err := GetJWTIdentity(config, token)
+			if test.reason == nil && err != nil {
+				t.Fatal(err)
+			}
+			if test.reason != nil {
+				expectReason(t, err, test.reason)
+
+				var verificationError *VerificationError
+				if !errors.As(err, &verificationError) {
+					t.Fatalf("expected a verification error, got %T", err)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTAudience(t *testing.T) {
+	config := newTestJWTConfig(t, pkitest.NewPKI(t, nil), "translator-a")
+
+	token, err := CreateSignedJWT(config, &Identity{Subject: "alice"}, &TokenOptions{Audience: AuthorityAudience("service-b:8080")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := CreateSignedJWT(config, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		config   JWTConfig
+		token    string
+		request  *BoundRequest
+		accepted bool
+	}{
+		{name: "configured audience", config: JWTConfig{Audience: "service-b"}, token: token, request: &BoundRequest{Authority: "service-c"}, accepted: true},
+		{name: "audience alias", config: JWTConfig{Audience: "translator-b", AudienceAliases: []string{"service-b"}}, token: token, accepted: true},
+		{name: "other configured audience", config: JWTConfig{Audience: "service-c"}, token: token, request: &BoundRequest{Authority: "service-b"}},
+		{name: "authority of the request is not trusted", token: token, request: &BoundRequest{Authority: "service-b"}},
+		{name: "legacy audience", config: JWTConfig{Audience: "service-b"}, token: legacy},
+		{name: "accepted legacy audience", config: JWTConfig{Audience: "service-b", AcceptLegacyAudience: true}, token: legacy, accepted: true},
+		{name: "legacy audience without configured audience", token: legacy, accepted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := test.config
+			verifier.KeyMaterialProvider = config.KeyMaterialProvider
+
+			_, err := GetJWTIdentityForRequest(&verifier, test.token, test.request)
+			if test.accepted && err != nil {
+				t.Fatal(err)
+			}
+			if !test.accepted {
+				expectReason(t, err, ErrInvalidAudience)
+			}
+		})
+	}
+}
+
+func TestJWTRejectsTokenForOtherService(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	configA := newTestJWTConfig(t, testPKI, "translator-a")
+	configA.Audience = "translator-a"
+	configB := newTestJWTConfig(t, testPKI, "translator-b")
+	configB.Audience = "translator-b"
+
+	// A token that was minted for A is presented to B with the authority of A.
+	token, err := CreateSignedJWT(configB, &Identity{Subject: "alice"}, &TokenOptions{Audience: "translator-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentityForRequest(configB, token, &BoundRequest{Method: "GET", Authority: "translator-a", Path: "/"})
+	expectReason(t, err, ErrInvalidAudience)
+	_, err = GetPropagatedJWTIdentity(configB, token)
+	expectReason(t, err, ErrInvalidAudience)
+
+	_, err = GetJWTIdentityForRequest(configA, token, &BoundRequest{Method: "GET", Authority: "translator-a", Path: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTAcceptsSPIFFEIDIssuer(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	pkiConfig := newTestPKIConfig(testPKI, "translator-a")
+	pkiConfig.SPIFFEID = "spiffe://example.org/translator-a"
+	config := &JWTConfig{
+		Issuer:              pkiConfig.SPIFFEID,
+		KeyMaterialProvider: enroll(t, pkiConfig),
+	}
+
+	token, err := CreateSignedJWTForUser(config, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := GetJWTIdentity(config, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Issuer != pkiConfig.SPIFFEID || identity.Workload != pkiConfig.SPIFFEID {
+		t.Fatalf("unexpected issuer %q and workload %q", identity.Issuer, identity.Workload)
+	}
+
+	spoofed, err := CreateSignedJWTForUser(&JWTConfig{
+		Issuer:              "spiffe://example.org/translator-b",
+		KeyMaterialProvider: config.KeyMaterialProvider,
+	}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, spoofed)
+	expectReason(t, err, ErrInvalidIssuer)
+}
+
+func TestJWTTrustBundleWithFederatedPKI(t *testing.T) {
+	testPKI, partnerPKI := pkitest.NewPKI(t, nil), pkitest.NewPKI(t, nil)
+	config := newTestJWTConfig(t, testPKI, "translator-a")
+	partner := newTestJWTConfig(t, partnerPKI, "partner")
+
+	config.TrustBundle = pki.NewTrustBundle(
+		pki.LocalCATrustSource(config.KeyMaterialProvider),
+		pki.TrustSourceFunc(func() ([]*pki.TrustAnchor, error) {
+			return []*pki.TrustAnchor{{Certificate: partnerPKI.CA().Certificate, AllowedIssuers: []string{"partner"}}}, nil
+		}),
+	)
+	err := config.TrustBundle.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sender := range []*JWTConfig{config, partner} {
+		token, err := CreateSignedJWTForUser(sender, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity, err := GetJWTIdentity(config, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity.Issuer != sender.Issuer {
+			t.Fatalf("unexpected issuer %q", identity.Issuer)
+		}
+	}
+
+	// The partner PKI may only issue certificates for the allowed issuers.
+	impostor, err := CreateSignedJWTForUser(newTestJWTConfig(t, partnerPKI, "translator-b"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, impostor)
+	expectReason(t, err, ErrInvalidIssuer)
+
+	// A PKI that is not in the bundle is not trusted.
+	foreign, err := CreateSignedJWTForUser(newTestJWTConfig(t, pkitest.NewPKI(t, nil), "partner"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, foreign)
+	expectReason(t, err, ErrUntrustedCertificate)
+}
+
+func TestJWTRejectsRevokedSigner(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	pkiConfig := newTestPKIConfig(testPKI, "translator-a")
+	provider := enroll(t, pkiConfig)
+	checker := pki.NewRevocationChecker(pkiConfig, provider)
+	config := &JWTConfig{
+		Issuer:              "translator-a",
+		KeyMaterialProvider: provider,
+		RevocationChecker:   checker,
+	}
+
+	token, err := CreateSignedJWTForUser(config, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The revocation status is unknown until the CRL was fetched (fail closed).
+	_, err = GetJWTIdentity(config, token)
+	expectReason(t, err, ErrCertificateRevoked)
+	if !errors.Is(errors.Unwrap(err), pki.ErrRevocationStatusUnknown) {
+		t.Fatalf("expected unknown revocation status, got %v", err)
+	}
+
+	err = checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPKI.Revoke(provider.KeyMaterial().Certificate.SerialNumber)
+	err = checker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetJWTIdentity(config, token)
+	expectReason(t, err, ErrCertificateRevoked)
+	if !errors.Is(errors.Unwrap(err), pki.ErrCertificateRevoked) {
+		t.Fatalf("expected revoked certificate, got %v", err)
+	}
+}
+
+func TestJWTDelegationChain(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	configA := newTestJWTConfig(t, testPKI, "translator-a")
+	configB := newTestJWTConfig(t, testPKI, "translator-b")
+	configB.MaxDelegationDepth = 2
+
+	token, err := CreateSignedJWTForUser(configA, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := GetJWTIdentity(configB, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err = CreateSignedJWTForIdentity(configB, identity.Delegate("translator-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err = GetJWTIdentity(configA, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := identity.ActorChain()
+	if identity.Subject != "alice" || len(chain) != 2 || chain[0] != "translator-b" || chain[1] != "translator-a" {
+		t.Fatalf("unexpected delegation of %q by %v", identity.Subject, chain)
+	}
+
+	_, err = CreateSignedJWTForIdentity(configB, identity.Delegate("translator-b"))
+	expectReason(t, err, ErrDelegationTooDeep)
+}
@@ -0,0 +1,128 @@
+package wirepact
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ReplayPolicy defines how received JWTs with an already seen "jti" are handled.
+type ReplayPolicy string
+
+const (
+	// ReplayPolicyDisabled does not check the "jti" of received JWTs.
+	ReplayPolicyDisabled ReplayPolicy = ""
+
+	// ReplayPolicyReject rejects every JWT whose "jti" was already seen.
+	ReplayPolicyReject ReplayPolicy = "reject"
+
+	// ReplayPolicyAllowRetries accepts a JWT up to ReplayMaxUses times.
+	// This allows envoy to retry requests with the same JWT while still
+	// limiting the usage of captured tokens.
+	ReplayPolicyAllowRetries ReplayPolicy = "allow-retries"
+)
+
+const (
+	defaultReplayMaxUses        = 3
+	defaultReplayStoreMaxTokens = 100000
+)
+
+// ErrReplayStoreFull is returned by the MemoryReplayStore when it holds the maximum
+// number of token IDs that are not expired yet. The token is rejected, since
+// evicting a valid token ID would allow to replay that token.
+var ErrReplayStoreFull = errors.New("replay store is full")
+
+// ReplayStore keeps track of the token IDs ("jti") of received JWTs.
+type ReplayStore interface {
+	// Record registers a usage of the given token ID which is relevant until
+	// expiresAt. It returns how often the ID was used (including this usage).
+	Record(id string, expiresAt time.Time) (int, error)
+}
+
+// MemoryReplayStore is a bounded in-memory ReplayStore. Expired token IDs are
+// removed automatically. When the store is full, new token IDs are not recorded
+// and ErrReplayStoreFull is returned (fail closed).
+type MemoryReplayStore struct {
+	mutex sync.Mutex
+
+	maxTokens int
+	tokens    map[string]*replayEntry
+	expiries  replayHeap
+}
+
+type replayEntry struct {
+	id        string
+	expiresAt time.Time
+	uses      int
+}
+
+// NewMemoryReplayStore creates an in-memory replay store that holds at
+// most maxTokens token IDs. If maxTokens is zero or negative, 100000 is used.
+func NewMemoryReplayStore(maxTokens int) *MemoryReplayStore {
+	if maxTokens <= 0 {
+		maxTokens = defaultReplayStoreMaxTokens
+	}
+
+	return &MemoryReplayStore{
+		maxTokens: maxTokens,
+		tokens:    map[string]*replayEntry{},
+	}
+}
+
+// Record implements ReplayStore.
+func (store *MemoryReplayStore) Record(id string, expiresAt time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for len(store.expiries) > 0 && !store.expiries[0].expiresAt.After(now) {
+		expired := heap.Pop(&store.expiries).(*replayEntry)
+		delete(store.tokens, expired.id)
+	}
+
+	if entry, ok := store.tokens[id]; ok {
+		entry.uses++
+		return entry.uses, nil
+	}
+
+	if len(store.expiries) >= store.maxTokens {
+		return 0, ErrReplayStoreFull
+	}
+
+	entry := &replayEntry{id: id, expiresAt: expiresAt, uses: 1}
+	heap.Push(&store.expiries, entry)
+	store.tokens[id] = entry
+
+	return entry.uses, nil
+}
+
+type replayHeap []*replayEntry
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h replayHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *replayHeap) Push(x interface{}) {
+	*h = append(*h, x.(*replayEntry))
+}
+
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
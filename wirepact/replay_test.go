@@ -0,0 +1,155 @@
+package wirepact
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WirePact/go-translator/internal/pkitest"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func tokenID(t *testing.T, token string) string {
+	t.Helper()
+
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &jwt.Claims{}
+	err = parsed.UnsafeClaimsWithoutVerification(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.ID
+}
+
+func TestReplayPolicyWithCachingSender(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	sender := newTestJWTConfig(t, testPKI, "translator-a")
+	receiver := newTestJWTConfig(t, testPKI, "translator-b")
+	receiver.ReplayPolicy = ReplayPolicyReject
+	receiver.ReplayStore = NewMemoryReplayStore(0)
+
+	// Without the cache, every request gets a JWT with a unique jti.
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		token, err := NewTokenCache(sender).GetOrCreate(sender, &Identity{Subject: "alice"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := tokenID(t, token); id == "" || seen[id] {
+			t.Fatalf("jti %q is not unique", id)
+		} else {
+			seen[id] = true
+		}
+
+		_, err = GetJWTIdentity(receiver, token)
+		if err != nil {
+			t.Fatalf("request %v was rejected: %v", i+1, err)
+		}
+	}
+
+	// A cached JWT carries a jti as well and is reused at most ReplayMaxUses times,
+	// such that a receiver that allows retries accepts all of its uses.
+	sender.TokenCacheSize = 10
+	sender.ReplayPolicy, receiver.ReplayPolicy = ReplayPolicyAllowRetries, ReplayPolicyAllowRetries
+	sender.ReplayMaxUses, receiver.ReplayMaxUses = 2, 2
+	cache := NewTokenCache(sender)
+	uses := map[string]int{}
+	for i := 0; i < 6; i++ {
+		token, err := cache.GetOrCreate(sender, &Identity{Subject: "alice"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := tokenID(t, token)
+		if id == "" {
+			t.Fatal("cached token carries no jti")
+		}
+		uses[id]++
+
+		_, err = GetJWTIdentity(receiver, token)
+		if err != nil {
+			t.Fatalf("request %v was rejected: %v", i+1, err)
+		}
+	}
+	if len(uses) != 3 {
+		t.Fatalf("expected 3 tokens that are used twice, got %v", uses)
+	}
+	if stats := cache.Stats(); stats.Hits != 3 || stats.Misses != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// With the reject policy, a cached JWT is never reused.
+	sender.ReplayPolicy = ReplayPolicyReject
+	cache = NewTokenCache(sender)
+	first, err := cache.GetOrCreate(sender, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.GetOrCreate(sender, &Identity{Subject: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("cached token was reused with the reject policy")
+	}
+}
+
+func TestMemoryReplayStoreFailsClosedWhenFull(t *testing.T) {
+	store := NewMemoryReplayStore(2)
+	now := time.Now()
+
+	for _, id := range []string{"a", "b"} {
+		uses, err := store.Record(id, now.Add(time.Hour))
+		if err != nil || uses != 1 {
+			t.Fatalf("unexpected %v uses of %q: %v", uses, id, err)
+		}
+	}
+
+	// The valid token IDs are not evicted for a new token ID.
+	_, err := store.Record("c", now.Add(time.Minute))
+	if !errors.Is(err, ErrReplayStoreFull) {
+		t.Fatalf("expected a full store, got %v", err)
+	}
+	uses, err := store.Record("a", now.Add(time.Hour))
+	if err != nil || uses != 2 {
+		t.Fatalf("replay of a valid token id was not detected: %v uses, %v", uses, err)
+	}
+
+	// Expired token IDs make room for new ones.
+	store = NewMemoryReplayStore(2)
+	_, _ = store.Record("expired", now.Add(50*time.Millisecond))
+	_, _ = store.Record("b", now.Add(time.Hour))
+	time.Sleep(100 * time.Millisecond)
+	uses, err = store.Record("c", now.Add(time.Hour))
+	if err != nil || uses != 1 {
+		t.Fatalf("expired token id was not removed: %v uses, %v", uses, err)
+	}
+}
+
+func TestJWTRejectedWhenReplayStoreIsFull(t *testing.T) {
+	testPKI := pkitest.NewPKI(t, nil)
+	sender := newTestJWTConfig(t, testPKI, "translator-a")
+	receiver := newTestJWTConfig(t, testPKI, "translator-b")
+	receiver.ReplayPolicy = ReplayPolicyReject
+	receiver.ReplayStore = NewMemoryReplayStore(1)
+
+	for i, expected := range []error{nil, ErrTokenReplayed} {
+		token, err := CreateSignedJWTForUser(sender, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = GetJWTIdentity(receiver, token)
+		if expected == nil && err != nil {
+			t.Fatalf("request %v was rejected: %v", i+1, err)
+		}
+		if expected != nil {
+			expectReason(t, err, expected)
+			if !errors.Is(errors.Unwrap(err), ErrReplayStoreFull) {
+				t.Fatalf("expected a full replay store, got %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package wirepact
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TransportKind defines how a WirePact JWT is transported in an HTTP request.
+type TransportKind string
+
+const (
+	// TransportHeader transports the JWT in a dedicated header.
+	TransportHeader TransportKind = "header"
+
+	// TransportAuthorization transports the JWT in the authorization header
+	// with the "WirePact" scheme ("Authorization: WirePact <token>").
+	TransportAuthorization TransportKind = "authorization"
+
+	// TransportCookie transports the JWT in a cookie.
+	TransportCookie TransportKind = "cookie"
+)
+
+const (
+	// AuthorizationScheme is the scheme of the authorization header
+	// that is used by TransportAuthorization.
+	AuthorizationScheme = "WirePact"
+
+	// IdentityCookie is the default cookie name for TransportCookie.
+	IdentityCookie = "wirepact-identity"
+)
+
+// DefaultTransport transports the JWT in the IdentityHeader.
+var DefaultTransport = Transport{Kind: TransportHeader, Name: IdentityHeader}
+
+// Transport defines where a WirePact JWT is placed in an HTTP request.
+// The zero value is equal to the DefaultTransport.
+type Transport struct {
+	// The kind of the transport. If omitted, TransportHeader is used.
+	Kind TransportKind
+
+	// The name of the header (TransportHeader) or the cookie (TransportCookie).
+	// If omitted, IdentityHeader or IdentityCookie is used.
+	Name string
+}
+
+// HeaderUpdate describes how a request header must be changed.
+// If Remove is set, the header is removed. Otherwise, the header
+// is set to the value (replacing existing values).
+type HeaderUpdate struct {
+	Name   string
+	Value  string
+	Remove bool
+}
+
+// ParseTransport parses a transport definition in the form "kind[:name]"
+// (e.g. "header:x-identity", "authorization" or "cookie:identity").
+func ParseTransport(value string) (Transport, error) {
+	parts := strings.SplitN(value, ":", 2)
+	transport := Transport{Kind: TransportKind(strings.TrimSpace(parts[0]))}
+	if len(parts) == 2 {
+		transport.Name = strings.TrimSpace(parts[1])
+	}
+
+	switch transport.Kind {
+	case TransportHeader, TransportCookie:
+	case TransportAuthorization:
+		if transport.Name != "" {
+			return Transport{}, fmt.Errorf("transport %q does not support a name", transport.Kind)
+		}
+	default:
+		return Transport{}, fmt.Errorf("unknown transport %q", transport.Kind)
+	}
+
+	return transport, nil
+}
+
+// ParseTransports parses a comma separated list of transport definitions (see ParseTransport).
+func ParseTransports(value string) ([]Transport, error) {
+	var transports []Transport
+	for _, definition := range strings.Split(value, ",") {
+		if strings.TrimSpace(definition) == "" {
+			continue
+		}
+
+		transport, err := ParseTransport(definition)
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, transport)
+	}
+
+	return transports, nil
+}
+
+func (transport Transport) String() string {
+	if transport.kind() == TransportAuthorization {
+		return string(TransportAuthorization)
+	}
+	return fmt.Sprintf("%v:%v", transport.kind(), transport.name())
+}
+
+// Extract returns the JWT from the given request headers (with lowercase names, as sent by envoy).
+func (transport Transport) Extract(headers map[string]string) (string, bool) {
+	switch transport.kind() {
+	case TransportAuthorization:
+		scheme, token, ok := cutAuthorization(headers[AuthorizationHeader])
+		if !ok || !strings.EqualFold(scheme, AuthorizationScheme) || token == "" {
+			return "", false
+		}
+		return token, true
+	case TransportCookie:
+		for _, cookie := range parseCookies(headers["cookie"]) {
+			if cookie.Name == transport.name() && cookie.Value != "" {
+				return cookie.Value, true
+			}
+		}
+		return "", false
+	default:
+		token, ok := headers[transport.name()]
+		return token, ok && token != ""
+	}
+}
+
+// Set returns the header update that places the JWT in a request with the given headers.
+func (transport Transport) Set(token string, headers map[string]string) HeaderUpdate {
+	switch transport.kind() {
+	case TransportAuthorization:
+		return HeaderUpdate{Name: AuthorizationHeader, Value: fmt.Sprintf("%v %v", AuthorizationScheme, token)}
+	case TransportCookie:
+		cookies := []string{fmt.Sprintf("%v=%v", transport.name(), token)}
+		for _, cookie := range parseCookies(headers["cookie"]) {
+			if cookie.Name != transport.name() {
+				cookies = append(cookies, cookie.String())
+			}
+		}
+		return HeaderUpdate{Name: "cookie", Value: strings.Join(cookies, "; ")}
+	default:
+		return HeaderUpdate{Name: transport.name(), Value: token}
+	}
+}
+
+// Unset returns the header update that removes the JWT from a request with the given headers.
+func (transport Transport) Unset(headers map[string]string) HeaderUpdate {
+	switch transport.kind() {
+	case TransportAuthorization:
+		return HeaderUpdate{Name: AuthorizationHeader, Remove: true}
+	case TransportCookie:
+		var cookies []string
+		for _, cookie := range parseCookies(headers["cookie"]) {
+			if cookie.Name != transport.name() {
+				cookies = append(cookies, cookie.String())
+			}
+		}
+		if len(cookies) == 0 {
+			return HeaderUpdate{Name: "cookie", Remove: true}
+		}
+		return HeaderUpdate{Name: "cookie", Value: strings.Join(cookies, "; ")}
+	default:
+		return HeaderUpdate{Name: transport.name(), Remove: true}
+	}
+}
+
+// ExtractFirst returns the JWT of the first transport that contains one.
+func ExtractFirst(transports []Transport, headers map[string]string) (string, Transport, bool) {
+	for _, transport := range transports {
+		if token, ok := transport.Extract(headers); ok {
+			return token, transport, true
+		}
+	}
+
+	return "", Transport{}, false
+}
+
+func (transport Transport) kind() TransportKind {
+	if transport.Kind == "" {
+		return TransportHeader
+	}
+	return transport.Kind
+}
+
+func (transport Transport) name() string {
+	if transport.kind() == TransportCookie {
+		if transport.Name == "" {
+			return IdentityCookie
+		}
+		return transport.Name
+	}
+
+	if transport.Name == "" {
+		return IdentityHeader
+	}
+	return strings.ToLower(transport.Name)
+}
+
+func cutAuthorization(value string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], strings.TrimSpace(parts[1]), true
+}
+
+func parseCookies(value string) []*http.Cookie {
+	if value == "" {
+		return nil
+	}
+	request := http.Request{Header: http.Header{"Cookie": {value}}}
+	return request.Cookies()
+}
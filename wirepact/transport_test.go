@@ -0,0 +1,123 @@
+package wirepact
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTransports(t *testing.T) {
+	transports, err := ParseTransports("header:X-Identity, authorization,cookie,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Transport{
+		{Kind: TransportHeader, Name: "X-Identity"},
+		{Kind: TransportAuthorization},
+		{Kind: TransportCookie},
+	}
+	if !reflect.DeepEqual(transports, expected) {
+		t.Fatalf("unexpected transports %+v", transports)
+	}
+	if transports[0].String() != "header:x-identity" || transports[1].String() != "authorization" || transports[2].String() != "cookie:wirepact-identity" {
+		t.Fatalf("unexpected names %v", transports)
+	}
+
+	for _, value := range []string{"query:token", "authorization:bearer"} {
+		if _, err = ParseTransports(value); err == nil {
+			t.Fatalf("accepted the invalid transport %q", value)
+		}
+	}
+}
+
+func TestTransportExtract(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport Transport
+		headers   map[string]string
+		token     string
+	}{
+		{name: "default header", transport: Transport{}, headers: map[string]string{IdentityHeader: "jwt"}, token: "jwt"},
+		{name: "named header", transport: Transport{Kind: TransportHeader, Name: "X-Identity"}, headers: map[string]string{"x-identity": "jwt"}, token: "jwt"},
+		{name: "empty header", transport: Transport{}, headers: map[string]string{IdentityHeader: ""}},
+		{name: "authorization", transport: Transport{Kind: TransportAuthorization}, headers: map[string]string{AuthorizationHeader: "wirepact  jwt"}, token: "jwt"},
+		{name: "other authorization scheme", transport: Transport{Kind: TransportAuthorization}, headers: map[string]string{AuthorizationHeader: "Bearer jwt"}},
+		{name: "cookie", transport: Transport{Kind: TransportCookie}, headers: map[string]string{"cookie": "session=1; wirepact-identity=jwt"}, token: "jwt"},
+		{name: "named cookie", transport: Transport{Kind: TransportCookie, Name: "identity"}, headers: map[string]string{"cookie": "wirepact-identity=other; identity=jwt"}, token: "jwt"},
+		{name: "missing cookie", transport: Transport{Kind: TransportCookie}, headers: map[string]string{"cookie": "session=1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, ok := test.transport.Extract(test.headers)
+			if ok != (test.token != "") || token != test.token {
+				t.Fatalf("expected %q, got %q (%v)", test.token, token, ok)
+			}
+		})
+	}
+}
+
+func TestTransportSetAndUnset(t *testing.T) {
+	headers := map[string]string{"cookie": "session=1; wirepact-identity=old"}
+
+	tests := []struct {
+		name      string
+		transport Transport
+		set       HeaderUpdate
+		unset     HeaderUpdate
+	}{
+		{
+			name:      "header",
+			transport: Transport{Kind: TransportHeader, Name: "X-Identity"},
+			set:       HeaderUpdate{Name: "x-identity", Value: "jwt"},
+			unset:     HeaderUpdate{Name: "x-identity", Remove: true},
+		},
+		{
+			name:      "authorization",
+			transport: Transport{Kind: TransportAuthorization},
+			set:       HeaderUpdate{Name: AuthorizationHeader, Value: "WirePact jwt"},
+			unset:     HeaderUpdate{Name: AuthorizationHeader, Remove: true},
+		},
+		{
+			name:      "cookie",
+			transport: Transport{Kind: TransportCookie},
+			set:       HeaderUpdate{Name: "cookie", Value: "wirepact-identity=jwt; session=1"},
+			unset:     HeaderUpdate{Name: "cookie", Value: "session=1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if update := test.transport.Set("jwt", headers); update != test.set {
+				t.Fatalf("unexpected set %+v", update)
+			}
+			if update := test.transport.Unset(headers); update != test.unset {
+				t.Fatalf("unexpected unset %+v", update)
+			}
+		})
+	}
+
+	// The cookie header is removed if the JWT was the only cookie.
+	update := Transport{Kind: TransportCookie}.Unset(map[string]string{"cookie": "wirepact-identity=jwt"})
+	if update != (HeaderUpdate{Name: "cookie", Remove: true}) {
+		t.Fatalf("unexpected unset %+v", update)
+	}
+}
+
+func TestExtractFirst(t *testing.T) {
+	transports := []Transport{{Kind: TransportAuthorization}, {Kind: TransportCookie}, DefaultTransport}
+	headers := map[string]string{
+		AuthorizationHeader: "Bearer user-token",
+		"cookie":            "wirepact-identity=cookie-jwt",
+		IdentityHeader:      "header-jwt",
+	}
+
+	token, transport, ok := ExtractFirst(transports, headers)
+	if !ok || token != "cookie-jwt" || transport != transports[1] {
+		t.Fatalf("unexpected token %q of %v", token, transport)
+	}
+
+	_, _, ok = ExtractFirst(transports, map[string]string{})
+	if ok {
+		t.Fatal("extracted a token from empty headers")
+	}
+}